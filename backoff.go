@@ -0,0 +1,100 @@
+package gorpc
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff determines delays between consecutive attempts.
+//
+// Backoff is used by Client.ReconnectPolicy for delaying reconnects
+// to the server after connection errors.
+type Backoff interface {
+	// Delay returns the delay before the given attempt.
+	//
+	// Attempts are numbered starting from 1.
+	//
+	// The function may be called from concurrently running goroutines.
+	Delay(attempt int) time.Duration
+}
+
+// BackoffFunc is an adapter allowing using ordinary functions as Backoff.
+type BackoffFunc func(attempt int) time.Duration
+
+// Delay returns f(attempt).
+func (f BackoffFunc) Delay(attempt int) time.Duration {
+	return f(attempt)
+}
+
+// ConstantBackoff is a Backoff with constant delay between attempts.
+type ConstantBackoff time.Duration
+
+// Delay returns the constant delay regardless of the attempt.
+func (b ConstantBackoff) Delay(attempt int) time.Duration {
+	return time.Duration(b)
+}
+
+// ExponentialBackoff is a Backoff with exponentially growing delay
+// between attempts.
+//
+// It is recommended using non-zero Jitter when many clients may
+// reconnect to the same server simultaneously, for instance after
+// server restart. Jitter spreads reconnects over time, so the server
+// isn't overloaded by reconnect storms.
+type ExponentialBackoff struct {
+	// The delay before the first attempt.
+	// Default value is DefaultMinBackoffDelay.
+	MinDelay time.Duration
+
+	// The maximum delay between attempts.
+	// Default value is DefaultMaxBackoffDelay.
+	MaxDelay time.Duration
+
+	// The delay is multiplied by Multiplier after each attempt.
+	// Default value is 2.
+	Multiplier float64
+
+	// Jitter randomizes delays in the range
+	// [delay*(1-Jitter) ... delay*(1+Jitter)].
+	// Randomized delays don't exceed MaxDelay.
+	// Jitter must be in the range [0 ... 1].
+	//
+	// By default delays aren't randomized.
+	Jitter float64
+}
+
+// Delay returns exponentially growing delay for the given attempt.
+func (b *ExponentialBackoff) Delay(attempt int) time.Duration {
+	minDelay := b.MinDelay
+	if minDelay <= 0 {
+		minDelay = DefaultMinBackoffDelay
+	}
+	maxDelay := b.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = DefaultMaxBackoffDelay
+	}
+	multiplier := b.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+
+	d := float64(minDelay)
+	for i := 1; i < attempt && d < float64(maxDelay); i++ {
+		d *= multiplier
+	}
+	if d > float64(maxDelay) {
+		d = float64(maxDelay)
+	}
+
+	if b.Jitter > 0 {
+		jitter := b.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		d *= 1 + jitter*(2*rand.Float64()-1)
+		if d > float64(maxDelay) {
+			d = float64(maxDelay)
+		}
+	}
+	return time.Duration(d)
+}
@@ -0,0 +1,71 @@
+package gorpc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConstantBackoff(t *testing.T) {
+	b := ConstantBackoff(123 * time.Millisecond)
+	for i := 1; i < 10; i++ {
+		if d := b.Delay(i); d != 123*time.Millisecond {
+			t.Fatalf("unexpected delay for attempt #%d: %s. Expected 123ms", i, d)
+		}
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	b := &ExponentialBackoff{
+		MinDelay: 10 * time.Millisecond,
+		MaxDelay: 100 * time.Millisecond,
+	}
+	expectedDelays := []time.Duration{
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+		40 * time.Millisecond,
+		80 * time.Millisecond,
+		100 * time.Millisecond,
+		100 * time.Millisecond,
+	}
+	for i, expectedDelay := range expectedDelays {
+		if d := b.Delay(i + 1); d != expectedDelay {
+			t.Fatalf("unexpected delay for attempt #%d: %s. Expected %s", i+1, d, expectedDelay)
+		}
+	}
+	if d := b.Delay(1000000); d != 100*time.Millisecond {
+		t.Fatalf("unexpected delay for huge attempt: %s. Expected 100ms", d)
+	}
+}
+
+func TestExponentialBackoffJitter(t *testing.T) {
+	b := &ExponentialBackoff{
+		MinDelay: 100 * time.Millisecond,
+		MaxDelay: time.Second,
+		Jitter:   0.5,
+	}
+	distinctDelays := make(map[time.Duration]struct{})
+	for i := 0; i < 100; i++ {
+		d := b.Delay(1)
+		if d < 50*time.Millisecond || d > 150*time.Millisecond {
+			t.Fatalf("delay is out of jitter range: %s. Expected [50ms ... 150ms]", d)
+		}
+		distinctDelays[d] = struct{}{}
+	}
+	if len(distinctDelays) < 2 {
+		t.Fatalf("jitter must randomize delays")
+	}
+}
+
+func TestExponentialBackoffJitterMaxDelay(t *testing.T) {
+	b := &ExponentialBackoff{
+		MinDelay: 100 * time.Millisecond,
+		MaxDelay: time.Second,
+		Jitter:   0.5,
+	}
+	for i := 0; i < 100; i++ {
+		d := b.Delay(10)
+		if d < 500*time.Millisecond || d > time.Second {
+			t.Fatalf("delay is out of jitter range: %s. Expected [500ms ... 1s]", d)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package gorpc
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BalancingClient is an RPC client balancing calls among multiple servers.
+//
+// The client maintains a distinct Client per each server address.
+// Each call is routed to one of these clients by the Strategy.
+// Clients without established connections to their servers are skipped
+// while at least one client has established connections.
+//
+// The client must be started with BalancingClient.Start() before use.
+//
+// It is safe using a single balancing client across arbitrary number
+// of concurrently running goroutines.
+type BalancingClient struct {
+	// Server addresses to connect to.
+	//
+	// Addrs is ignored if Resolver is set.
+	Addrs []string
+
+	// Resolver for dynamic discovery of server addresses.
+	//
+	// If set, BalancingClient starts a client for each address returned
+	// by the resolver and stops clients for addresses that disappeared.
+	Resolver Resolver
+
+	// NewClient must return a client for the given server address.
+	//
+	// The returned client mustn't be started - BalancingClient starts
+	// and stops it when needed.
+	//
+	// By default NewTCPClient() is used.
+	NewClient func(addr string) *Client
+
+	// Strategy selects a client for each call.
+	//
+	// By default RoundRobinStrategy is used.
+	Strategy BalancingStrategy
+
+	// clients contains []*Client for the current server addresses.
+	clients atomic.Value
+
+	started  bool
+	stopChan chan struct{}
+	stopWg   sync.WaitGroup
+}
+
+// BalancingStrategy selects a client for the next call
+// in BalancingClient.
+type BalancingStrategy interface {
+	// Pick must return one of the given clients.
+	//
+	// clients always contains at least one client.
+	// The function may be called from concurrently running goroutines.
+	Pick(clients []*Client) *Client
+}
+
+// RoundRobinStrategy routes calls to clients in turn.
+type RoundRobinStrategy struct {
+	n uint32
+}
+
+// Pick returns the next client after the previously picked one.
+func (s *RoundRobinStrategy) Pick(clients []*Client) *Client {
+	n := atomic.AddUint32(&s.n, 1)
+	return clients[n%uint32(len(clients))]
+}
+
+// LeastPendingStrategy routes calls to the client with the minimum
+// number of pending requests.
+//
+// See also RandomTwoChoicesStrategy, which has lower overhead
+// for big number of clients.
+type LeastPendingStrategy struct{}
+
+// Pick returns the client with the minimum number of pending requests.
+func (s *LeastPendingStrategy) Pick(clients []*Client) *Client {
+	best := clients[0]
+	bestN := best.PendingRequestsCount()
+	for _, c := range clients[1:] {
+		if n := c.PendingRequestsCount(); n < bestN {
+			best, bestN = c, n
+		}
+	}
+	return best
+}
+
+// RandomTwoChoicesStrategy routes calls to the client with the smaller
+// number of pending requests among two randomly chosen clients.
+type RandomTwoChoicesStrategy struct{}
+
+// Pick returns the least loaded client among two random clients.
+func (s *RandomTwoChoicesStrategy) Pick(clients []*Client) *Client {
+	if len(clients) == 1 {
+		return clients[0]
+	}
+	i := rand.Intn(len(clients))
+	j := rand.Intn(len(clients) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := clients[i], clients[j]
+	if b.PendingRequestsCount() < a.PendingRequestsCount() {
+		return b
+	}
+	return a
+}
+
+// Start starts the balancing client. Establishes connections
+// to all the servers from BalancingClient.Addrs.
+func (bc *BalancingClient) Start() {
+	if bc.started {
+		panic("gorpc.BalancingClient: the given client is already started. Call BalancingClient.Stop() before calling BalancingClient.Start() again!")
+	}
+	bc.started = true
+
+	if bc.NewClient == nil {
+		bc.NewClient = NewTCPClient
+	}
+	if bc.Strategy == nil {
+		bc.Strategy = &RoundRobinStrategy{}
+	}
+
+	if bc.Resolver != nil {
+		bc.clients.Store([]*Client(nil))
+		bc.stopChan = make(chan struct{})
+		bc.stopWg.Add(1)
+		go bc.watchResolver()
+		return
+	}
+
+	clients := make([]*Client, 0, len(bc.Addrs))
+	for _, addr := range bc.Addrs {
+		c := bc.NewClient(addr)
+		c.Start()
+		clients = append(clients, c)
+	}
+	bc.clients.Store(clients)
+}
+
+func (bc *BalancingClient) watchResolver() {
+	defer bc.stopWg.Done()
+
+	watchResolver(bc.Resolver, bc.stopChan, func(addrs []string) {
+		oldClients := make(map[string]*Client)
+		for _, c := range bc.getClients() {
+			oldClients[c.Addr] = c
+		}
+
+		clients := make([]*Client, 0, len(addrs))
+		for _, addr := range addrs {
+			c, ok := oldClients[addr]
+			if ok {
+				delete(oldClients, addr)
+			} else {
+				c = bc.NewClient(addr)
+				c.Start()
+			}
+			clients = append(clients, c)
+		}
+		bc.clients.Store(clients)
+
+		// Stop removed clients in the background, since they may wait
+		// for pending requests' completion.
+		for _, c := range oldClients {
+			bc.stopWg.Add(1)
+			go func(c *Client) {
+				defer bc.stopWg.Done()
+				c.Stop()
+			}(c)
+		}
+	})
+}
+
+// Stop stops the balancing client. Stopped client can be started again.
+func (bc *BalancingClient) Stop() {
+	if !bc.started {
+		panic("gorpc.BalancingClient: the client must be started before stopping it")
+	}
+	if bc.stopChan != nil {
+		close(bc.stopChan)
+		bc.stopWg.Wait()
+		bc.stopChan = nil
+	}
+	for _, c := range bc.getClients() {
+		c.Stop()
+	}
+	bc.clients.Store([]*Client(nil))
+	bc.started = false
+}
+
+func (bc *BalancingClient) getClients() []*Client {
+	clients, _ := bc.clients.Load().([]*Client)
+	return clients
+}
+
+// Clients returns clients for all the servers the balancing client
+// currently works with.
+//
+// The returned clients may be used for obtaining per-server stats.
+// Do not start or stop them.
+func (bc *BalancingClient) Clients() []*Client {
+	return append([]*Client(nil), bc.getClients()...)
+}
+
+// PendingRequestsCount returns the instant number of pending requests
+// across all the servers.
+func (bc *BalancingClient) PendingRequestsCount() int {
+	n := 0
+	for _, c := range bc.getClients() {
+		n += c.PendingRequestsCount()
+	}
+	return n
+}
+
+func (bc *BalancingClient) pick() (*Client, error) {
+	clients := bc.getClients()
+	if len(clients) == 0 {
+		return nil, &ClientError{
+			Connection: true,
+			err:        fmt.Errorf("gorpc.BalancingClient: there are no servers to send the request to"),
+		}
+	}
+
+	healthyCount := 0
+	for _, c := range clients {
+		if c.isHealthy() {
+			healthyCount++
+		}
+	}
+	if healthyCount > 0 && healthyCount < len(clients) {
+		healthy := make([]*Client, 0, healthyCount)
+		for _, c := range clients {
+			if c.isHealthy() {
+				healthy = append(healthy, c)
+			}
+		}
+		if len(healthy) > 0 {
+			clients = healthy
+		}
+	}
+	return bc.Strategy.Pick(clients), nil
+}
+
+// Call sends the given request to one of the servers and obtains response
+// from it.
+//
+// See Client.Call for details.
+func (bc *BalancingClient) Call(request interface{}) (response interface{}, err error) {
+	c, err := bc.pick()
+	if err != nil {
+		return nil, err
+	}
+	return c.Call(request)
+}
+
+// CallTimeout sends the given request to one of the servers and obtains
+// response from it during the given timeout.
+//
+// See Client.CallTimeout for details.
+func (bc *BalancingClient) CallTimeout(request interface{}, timeout time.Duration) (response interface{}, err error) {
+	c, err := bc.pick()
+	if err != nil {
+		return nil, err
+	}
+	return c.CallTimeout(request, timeout)
+}
+
+// CallContext sends the given request to one of the servers and obtains
+// response from it until the given ctx is done.
+//
+// See Client.CallContext for details.
+func (bc *BalancingClient) CallContext(ctx context.Context, request interface{}) (response interface{}, err error) {
+	c, err := bc.pick()
+	if err != nil {
+		return nil, err
+	}
+	return c.CallContext(ctx, request)
+}
+
+// CallAsync starts async rpc call to one of the servers.
+//
+// See Client.CallAsync for details.
+func (bc *BalancingClient) CallAsync(request interface{}) (*AsyncResult, error) {
+	c, err := bc.pick()
+	if err != nil {
+		return nil, err
+	}
+	return c.CallAsync(request)
+}
+
+// Send sends the given request to one of the servers and doesn't wait
+// for response.
+//
+// See Client.Send for details.
+func (bc *BalancingClient) Send(request interface{}) error {
+	c, err := bc.pick()
+	if err != nil {
+		return err
+	}
+	return c.Send(request)
+}
@@ -0,0 +1,140 @@
+package gorpc
+
+import (
+	"testing"
+	"time"
+)
+
+func startBalancerServers(t *testing.T, n int) []*Server {
+	var servers []*Server
+	for i := 0; i < n; i++ {
+		id := i
+		s := startTestServer(t, &Server{
+			Handler: func(clientAddr string, request interface{}) interface{} {
+				return id
+			},
+		})
+		servers = append(servers, s)
+	}
+	return servers
+}
+
+func getServerAddrs(servers []*Server) []string {
+	var addrs []string
+	for _, s := range servers {
+		addrs = append(addrs, s.Addr)
+	}
+	return addrs
+}
+
+func waitForHealthyClients(t *testing.T, bc *BalancingClient, n int) {
+	for i := 0; i < 100; i++ {
+		healthy := 0
+		for _, c := range bc.Clients() {
+			if c.isHealthy() {
+				healthy++
+			}
+		}
+		if healthy == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("cannot wait for %d healthy clients", n)
+}
+
+func TestBalancingClientRoundRobin(t *testing.T) {
+	servers := startBalancerServers(t, 3)
+	for _, s := range servers {
+		defer s.Stop()
+	}
+
+	bc := &BalancingClient{
+		Addrs: getServerAddrs(servers),
+	}
+	bc.Start()
+	defer bc.Stop()
+	waitForHealthyClients(t, bc, 3)
+
+	hits := make(map[int]int)
+	for i := 0; i < 30; i++ {
+		resp, err := bc.Call(i)
+		if err != nil {
+			t.Fatalf("unexpected error: [%s]", err)
+		}
+		hits[resp.(int)]++
+	}
+	for i := 0; i < 3; i++ {
+		if hits[i] != 10 {
+			t.Fatalf("unexpected number of calls to server #%d: %d. Expected 10", i, hits[i])
+		}
+	}
+}
+
+func TestBalancingClientStrategies(t *testing.T) {
+	strategies := []BalancingStrategy{
+		&LeastPendingStrategy{},
+		&RandomTwoChoicesStrategy{},
+	}
+	for _, strategy := range strategies {
+		servers := startBalancerServers(t, 3)
+
+		bc := &BalancingClient{
+			Addrs:    getServerAddrs(servers),
+			Strategy: strategy,
+		}
+		bc.Start()
+		waitForHealthyClients(t, bc, 3)
+
+		for i := 0; i < 30; i++ {
+			if _, err := bc.Call(i); err != nil {
+				t.Fatalf("unexpected error for %T: [%s]", strategy, err)
+			}
+		}
+
+		bc.Stop()
+		for _, s := range servers {
+			s.Stop()
+		}
+	}
+}
+
+func TestBalancingClientSkipUnhealthy(t *testing.T) {
+	servers := startBalancerServers(t, 3)
+	defer servers[0].Stop()
+	defer servers[2].Stop()
+
+	bc := &BalancingClient{
+		Addrs: getServerAddrs(servers),
+	}
+	bc.Start()
+	defer bc.Stop()
+	waitForHealthyClients(t, bc, 3)
+
+	servers[1].Stop()
+	waitForHealthyClients(t, bc, 2)
+
+	for i := 0; i < 30; i++ {
+		resp, err := bc.Call(i)
+		if err != nil {
+			t.Fatalf("unexpected error: [%s]", err)
+		}
+		if resp.(int) == 1 {
+			t.Fatalf("the call mustn't be routed to the stopped server")
+		}
+	}
+}
+
+func TestBalancingClientNoAddrs(t *testing.T) {
+	bc := &BalancingClient{}
+	bc.Start()
+	defer bc.Stop()
+
+	_, err := bc.Call(123)
+	if err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	if !err.(*ClientError).Connection {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+}
@@ -728,6 +728,66 @@ func BenchmarkEchoStructNocompress10000Workers(b *testing.B) {
 	benchEchoStruct(b, 10000, true, false)
 }
 
+func BenchmarkEchoBytes1Worker(b *testing.B) {
+	benchEchoBytes(b, 1, false, false)
+}
+
+func BenchmarkEchoBytes10Workers(b *testing.B) {
+	benchEchoBytes(b, 10, false, false)
+}
+
+func BenchmarkEchoBytes100Workers(b *testing.B) {
+	benchEchoBytes(b, 100, false, false)
+}
+
+func BenchmarkEchoBytes1000Workers(b *testing.B) {
+	benchEchoBytes(b, 1000, false, false)
+}
+
+func BenchmarkEchoBytes10000Workers(b *testing.B) {
+	benchEchoBytes(b, 10000, false, false)
+}
+
+func BenchmarkEchoBytesUnix1Worker(b *testing.B) {
+	benchEchoBytes(b, 1, false, true)
+}
+
+func BenchmarkEchoBytesUnix10Workers(b *testing.B) {
+	benchEchoBytes(b, 10, false, true)
+}
+
+func BenchmarkEchoBytesUnix100Workers(b *testing.B) {
+	benchEchoBytes(b, 100, false, true)
+}
+
+func BenchmarkEchoBytesUnix1000Workers(b *testing.B) {
+	benchEchoBytes(b, 1000, false, true)
+}
+
+func BenchmarkEchoBytesUnix10000Workers(b *testing.B) {
+	benchEchoBytes(b, 10000, false, true)
+}
+
+func BenchmarkEchoBytesNocompress1Worker(b *testing.B) {
+	benchEchoBytes(b, 1, true, false)
+}
+
+func BenchmarkEchoBytesNocompress10Workers(b *testing.B) {
+	benchEchoBytes(b, 10, true, false)
+}
+
+func BenchmarkEchoBytesNocompress100Workers(b *testing.B) {
+	benchEchoBytes(b, 100, true, false)
+}
+
+func BenchmarkEchoBytesNocompress1000Workers(b *testing.B) {
+	benchEchoBytes(b, 1000, true, false)
+}
+
+func BenchmarkEchoBytesNocompress10000Workers(b *testing.B) {
+	benchEchoBytes(b, 10000, true, false)
+}
+
 func benchEchoNil(b *testing.B, workers int, disableCompression, isUnixTransport bool) {
 	benchEchoFunc(b, workers, disableCompression, isUnixTransport, func(c *Client, n int) {
 		resp, err := c.Call(nil)
@@ -811,6 +871,22 @@ func benchEchoStruct(b *testing.B, workers int, disableCompression, isUnixTransp
 	})
 }
 
+func benchEchoBytes(b *testing.B, workers int, disableCompression, isUnixTransport bool) {
+	s, c := createEchoServerAndClient(b, disableCompression, workers, isUnixTransport)
+	s.BytesHandler = echoBytesHandler
+	benchClientServer(b, workers, c, s, func(n int) {
+		req := []byte(fmt.Sprintf("test bytes %d", n))
+		var buf [64]byte
+		resp, err := c.CallBytes(buf[:0], req)
+		if err != nil {
+			b.Fatalf("Unexpected error: [%s]", err)
+		}
+		if !bytes.Equal(resp, req) {
+			b.Fatalf("Unexpected value returned: %q. Expected %q", resp, req)
+		}
+	})
+}
+
 func benchEchoFunc(b *testing.B, workers int, disableCompression, isUnixTransport bool, f func(*Client, int)) {
 	s, c := createEchoServerAndClient(b, disableCompression, workers, isUnixTransport)
 	benchClientServer(b, workers, c, s, func(n int) { f(c, n) })
@@ -0,0 +1,288 @@
+package gorpc
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of CircuitBreaker.
+type CircuitState int
+
+const (
+	// CircuitClosed is the normal state - all the calls are passed
+	// to the server.
+	CircuitClosed CircuitState = iota
+
+	// CircuitOpen state means the server is considered unhealthy.
+	// All the calls immediately fail with ClientError.CircuitOpen.
+	CircuitOpen
+
+	// CircuitHalfOpen state means the server is probed with a limited
+	// number of trial calls. Other calls fail with ClientError.CircuitOpen.
+	CircuitHalfOpen
+)
+
+// String returns human-readable circuit state.
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("CircuitState(%d)", int(s))
+	}
+}
+
+// CircuitBreaker makes Client calls fail fast against unhealthy servers.
+//
+// The breaker opens when the ratio of failed calls during Window reaches
+// FailureRatio. Open breaker immediately fails calls with
+// ClientError.CircuitOpen instead of waiting for the call timeout.
+// After OpenTimeout the breaker becomes half-open and passes up to
+// HalfOpenCalls trial calls to the server. The breaker is closed
+// if all the trial calls succeed. Otherwise it is opened again.
+//
+// Outcomes of Client.Call*() and Batch.Call*() are tracked by the breaker.
+// Client.CallAsync() and Client.Send() calls fail while the breaker isn't
+// closed, but their outcomes aren't tracked.
+//
+// CircuitBreaker may be set via Client.CircuitBreaker.
+// The same breaker mustn't be shared among multiple clients.
+type CircuitBreaker struct {
+	// Interval for collecting call outcomes.
+	// Default value is DefaultCircuitWindow.
+	Window time.Duration
+
+	// The minimum number of calls during Window required for opening
+	// the breaker.
+	// Default value is DefaultCircuitMinCalls.
+	MinCalls int
+
+	// The ratio of failed calls during Window for opening the breaker.
+	// Default value is DefaultCircuitFailureRatio.
+	FailureRatio float64
+
+	// How long the breaker stays open before becoming half-open.
+	// Default value is DefaultCircuitOpenTimeout.
+	OpenTimeout time.Duration
+
+	// The number of trial calls in half-open state.
+	// Default value is 1.
+	HalfOpenCalls int
+
+	// IsFailure must return true if the call failed with the given error
+	// indicates unhealthy server.
+	//
+	// By default ClientError.Timeout and ClientError.Connection errors
+	// are considered failures.
+	IsFailure func(err *ClientError) bool
+
+	lock  sync.Mutex
+	state CircuitState
+
+	windowStart time.Time
+	calls       int
+	failures    int
+
+	openedAt time.Time
+
+	trialCalls     int
+	trialSuccesses int
+
+	// generation is incremented on every state change, so outcomes
+	// of calls allowed in the previous state could be ignored.
+	generation uint64
+}
+
+// circuitToken identifies the call allowed by CircuitBreaker.
+type circuitToken struct {
+	// generation is the breaker generation the call has been allowed in.
+	generation uint64
+
+	// trial is set if the call has been allowed as half-open trial call.
+	trial bool
+}
+
+func isCircuitFailureByDefault(err *ClientError) bool {
+	return err.Timeout || err.Connection
+}
+
+// State returns the current breaker state.
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.lock.Lock()
+	cb.updateState(time.Now())
+	state := cb.state
+	cb.lock.Unlock()
+	return state
+}
+
+// allow returns true if the call may be sent to the server.
+//
+// Allowed calls must be finished with done() and the returned token.
+func (cb *CircuitBreaker) allow() (circuitToken, bool) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	cb.updateState(time.Now())
+	token := circuitToken{
+		generation: cb.generation,
+	}
+	switch cb.state {
+	case CircuitClosed:
+		return token, true
+	case CircuitHalfOpen:
+		if cb.trialCalls < cb.halfOpenCalls() {
+			cb.trialCalls++
+			token.trial = true
+			return token, true
+		}
+	}
+	return token, false
+}
+
+// allowUntracked returns true if the call, which outcome isn't tracked,
+// may be sent to the server.
+//
+// Such calls are allowed only in closed state, since they cannot be
+// used as trial calls.
+func (cb *CircuitBreaker) allowUntracked() bool {
+	cb.lock.Lock()
+	cb.updateState(time.Now())
+	ok := cb.state == CircuitClosed
+	cb.lock.Unlock()
+	return ok
+}
+
+// done registers the outcome of the call allowed by allow().
+//
+// Outcomes of calls allowed before the last state change are ignored,
+// so calls allowed in closed state and finished late don't affect
+// the result of half-open trial calls.
+func (cb *CircuitBreaker) done(token circuitToken, err error) {
+	failure := false
+	canceled := false
+	if err != nil {
+		ce, ok := err.(*ClientError)
+		if ok {
+			isFailure := cb.IsFailure
+			if isFailure == nil {
+				isFailure = isCircuitFailureByDefault
+			}
+			failure = isFailure(ce)
+			canceled = ce.Canceled
+		}
+	}
+
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	now := time.Now()
+	cb.updateState(now)
+	if token.generation != cb.generation {
+		return
+	}
+	if canceled {
+		// Canceled calls say nothing about the server health.
+		if token.trial {
+			cb.trialCalls--
+		}
+		return
+	}
+	switch cb.state {
+	case CircuitClosed:
+		cb.calls++
+		if failure {
+			cb.failures++
+		}
+		if cb.calls >= cb.minCalls() && float64(cb.failures) >= cb.failureRatio()*float64(cb.calls) {
+			cb.open(now)
+		}
+	case CircuitHalfOpen:
+		if failure {
+			cb.open(now)
+			return
+		}
+		cb.trialSuccesses++
+		if cb.trialSuccesses >= cb.halfOpenCalls() {
+			cb.setState(CircuitClosed)
+			cb.resetWindow(now)
+		}
+	}
+}
+
+func (cb *CircuitBreaker) updateState(now time.Time) {
+	switch cb.state {
+	case CircuitClosed:
+		if now.Sub(cb.windowStart) > cb.window() {
+			cb.resetWindow(now)
+		}
+	case CircuitOpen:
+		if now.Sub(cb.openedAt) >= cb.openTimeout() {
+			cb.setState(CircuitHalfOpen)
+			cb.trialCalls = 0
+			cb.trialSuccesses = 0
+		}
+	}
+}
+
+func (cb *CircuitBreaker) open(now time.Time) {
+	cb.setState(CircuitOpen)
+	cb.openedAt = now
+}
+
+func (cb *CircuitBreaker) setState(state CircuitState) {
+	cb.state = state
+	cb.generation++
+}
+
+func (cb *CircuitBreaker) resetWindow(now time.Time) {
+	cb.windowStart = now
+	cb.calls = 0
+	cb.failures = 0
+}
+
+func (cb *CircuitBreaker) window() time.Duration {
+	if cb.Window <= 0 {
+		return DefaultCircuitWindow
+	}
+	return cb.Window
+}
+
+func (cb *CircuitBreaker) minCalls() int {
+	if cb.MinCalls <= 0 {
+		return DefaultCircuitMinCalls
+	}
+	return cb.MinCalls
+}
+
+func (cb *CircuitBreaker) failureRatio() float64 {
+	if cb.FailureRatio <= 0 {
+		return DefaultCircuitFailureRatio
+	}
+	return cb.FailureRatio
+}
+
+func (cb *CircuitBreaker) openTimeout() time.Duration {
+	if cb.OpenTimeout <= 0 {
+		return DefaultCircuitOpenTimeout
+	}
+	return cb.OpenTimeout
+}
+
+func (cb *CircuitBreaker) halfOpenCalls() int {
+	if cb.HalfOpenCalls <= 0 {
+		return 1
+	}
+	return cb.HalfOpenCalls
+}
+
+func circuitOpenClientError(c *Client) error {
+	return &ClientError{
+		CircuitOpen: true,
+		err:         fmt.Errorf("gorpc.Client: [%s]. The circuit breaker is open, since the server is unhealthy", c.Addr),
+	}
+}
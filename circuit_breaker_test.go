@@ -0,0 +1,183 @@
+package gorpc
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerStates(t *testing.T) {
+	cb := &CircuitBreaker{
+		MinCalls:    4,
+		OpenTimeout: 50 * time.Millisecond,
+	}
+	timeoutErr := &ClientError{Timeout: true}
+	serverErr := &ClientError{Server: true}
+
+	if cb.State() != CircuitClosed {
+		t.Fatalf("unexpected initial state: %s. Expected %s", cb.State(), CircuitClosed)
+	}
+
+	// Server errors don't open the breaker.
+	for i := 0; i < 10; i++ {
+		token, ok := cb.allow()
+		if !ok {
+			t.Fatalf("closed breaker must allow calls")
+		}
+		cb.done(token, serverErr)
+	}
+	if cb.State() != CircuitClosed {
+		t.Fatalf("unexpected state after server errors: %s. Expected %s", cb.State(), CircuitClosed)
+	}
+
+	cb.resetWindow(time.Now())
+	for i := 0; i < 4; i++ {
+		token, ok := cb.allow()
+		if !ok {
+			t.Fatalf("closed breaker must allow calls")
+		}
+		cb.done(token, timeoutErr)
+	}
+	if cb.State() != CircuitOpen {
+		t.Fatalf("unexpected state after timeouts: %s. Expected %s", cb.State(), CircuitOpen)
+	}
+	if _, ok := cb.allow(); ok || cb.allowUntracked() {
+		t.Fatalf("open breaker mustn't allow calls")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if cb.State() != CircuitHalfOpen {
+		t.Fatalf("unexpected state after OpenTimeout: %s. Expected %s", cb.State(), CircuitHalfOpen)
+	}
+	if cb.allowUntracked() {
+		t.Fatalf("half-open breaker mustn't allow untracked calls")
+	}
+	token, ok := cb.allow()
+	if !ok {
+		t.Fatalf("half-open breaker must allow a trial call")
+	}
+	if _, ok := cb.allow(); ok {
+		t.Fatalf("half-open breaker mustn't allow more than HalfOpenCalls trial calls")
+	}
+
+	// Failed trial call opens the breaker again.
+	cb.done(token, timeoutErr)
+	if cb.State() != CircuitOpen {
+		t.Fatalf("unexpected state after failed trial call: %s. Expected %s", cb.State(), CircuitOpen)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if token, ok = cb.allow(); !ok {
+		t.Fatalf("half-open breaker must allow a trial call")
+	}
+	cb.done(token, nil)
+	if cb.State() != CircuitClosed {
+		t.Fatalf("unexpected state after successful trial call: %s. Expected %s", cb.State(), CircuitClosed)
+	}
+}
+
+func TestCircuitBreakerLateOutcomes(t *testing.T) {
+	cb := &CircuitBreaker{
+		MinCalls:    1,
+		OpenTimeout: 50 * time.Millisecond,
+	}
+	timeoutErr := &ClientError{Timeout: true}
+
+	// The calls allowed in closed state are finished after the breaker
+	// becomes half-open.
+	var lateTokens []circuitToken
+	for i := 0; i < 3; i++ {
+		token, ok := cb.allow()
+		if !ok {
+			t.Fatalf("closed breaker must allow calls")
+		}
+		lateTokens = append(lateTokens, token)
+	}
+	token, _ := cb.allow()
+	cb.done(token, timeoutErr)
+	if cb.State() != CircuitOpen {
+		t.Fatalf("unexpected state after timeout: %s. Expected %s", cb.State(), CircuitOpen)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	trialToken, ok := cb.allow()
+	if !ok {
+		t.Fatalf("half-open breaker must allow a trial call")
+	}
+
+	// Late outcomes mustn't be counted as trial results.
+	cb.done(lateTokens[0], nil)
+	cb.done(lateTokens[1], timeoutErr)
+	cb.done(lateTokens[2], ErrCanceled)
+	if cb.State() != CircuitHalfOpen {
+		t.Fatalf("unexpected state after late outcomes: %s. Expected %s", cb.State(), CircuitHalfOpen)
+	}
+	if _, ok := cb.allow(); ok {
+		t.Fatalf("half-open breaker mustn't allow more than HalfOpenCalls trial calls")
+	}
+
+	cb.done(trialToken, nil)
+	if cb.State() != CircuitClosed {
+		t.Fatalf("unexpected state after successful trial call: %s. Expected %s", cb.State(), CircuitClosed)
+	}
+}
+
+func TestClientCircuitBreaker(t *testing.T) {
+	var slow int32 = 1
+	s := &Server{
+		Addr: getRandomAddr(),
+		Handler: func(clientAddr string, request interface{}) interface{} {
+			if atomic.LoadInt32(&slow) != 0 {
+				time.Sleep(200 * time.Millisecond)
+			}
+			return request
+		},
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := &Client{
+		Addr: s.Addr,
+		CircuitBreaker: &CircuitBreaker{
+			MinCalls:    3,
+			OpenTimeout: 300 * time.Millisecond,
+		},
+	}
+	c.Start()
+	defer c.Stop()
+
+	for i := 0; i < 3; i++ {
+		_, err := c.CallTimeout(i, 20*time.Millisecond)
+		if err == nil || !err.(*ClientError).Timeout {
+			t.Fatalf("expecting timeout error. Got [%v]", err)
+		}
+	}
+
+	startTime := time.Now()
+	_, err := c.CallTimeout(123, time.Second)
+	if err == nil || !err.(*ClientError).CircuitOpen {
+		t.Fatalf("expecting circuit open error. Got [%v]", err)
+	}
+	if time.Since(startTime) > 100*time.Millisecond {
+		t.Fatalf("too long call with open circuit breaker: %s", time.Since(startTime))
+	}
+	if _, err = c.CallAsync(123); err == nil || !err.(*ClientError).CircuitOpen {
+		t.Fatalf("expecting circuit open error. Got [%v]", err)
+	}
+
+	atomic.StoreInt32(&slow, 0)
+	time.Sleep(400 * time.Millisecond)
+
+	resp, err := c.CallTimeout(123, time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	if resp.(int) != 123 {
+		t.Fatalf("unexpected response: %v. Expected 123", resp)
+	}
+	if c.CircuitBreaker.State() != CircuitClosed {
+		t.Fatalf("unexpected state: %s. Expected %s", c.CircuitBreaker.State(), CircuitClosed)
+	}
+}
@@ -1,6 +1,8 @@
 package gorpc
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"runtime"
@@ -28,8 +30,24 @@ type Client struct {
 	//   * Unix sockets - see NewUnixClient() and NewUnixServer().
 	//
 	// By default TCP transport is used.
+	//
+	// If Resolver is set, Addr is used only in log messages.
 	Addr string
 
+	// Resolver for dynamic discovery of server addresses.
+	//
+	// If set, the client establishes Conns connections to each address
+	// returned by the resolver and follows address set changes without
+	// restarting. Requests are spread among all the established
+	// connections.
+	//
+	// Connections to removed addresses stop accepting new requests
+	// and are closed after obtaining responses for pending requests
+	// or after RequestTimeout.
+	//
+	// By default the client connects only to Addr.
+	Resolver Resolver
+
 	// The number of concurrent connections the client should establish
 	// to the sever.
 	// By default only one connection is established.
@@ -41,6 +59,9 @@ type Client struct {
 	// of concurrent goroutines calling client's methods.
 	// Otherwise a lot of ClientError.Overflow errors may appear.
 	//
+	// The limit is shared among requests with all the priorities.
+	// See Priority for details.
+	//
 	// Default is DefaultPendingMessages.
 	PendingRequests int
 
@@ -57,18 +78,111 @@ type Client struct {
 	// Default value is DefaultRequestTimeout.
 	RequestTimeout time.Duration
 
+	// RetryPolicy determines how failed Call, CallTimeout and CallContext
+	// calls are retried.
+	//
+	// Set RetryPolicy only if all the calls performed via the client
+	// are idempotent. Use DispatcherClient.SetRetryPolicy for enabling
+	// retries only for the given functions.
+	//
+	// By default failed calls aren't retried.
+	RetryPolicy *RetryPolicy
+
+	// CircuitBreaker makes calls fail fast with ClientError.CircuitOpen
+	// when the server is unhealthy instead of waiting for the call timeout.
+	//
+	// By default circuit breaker is disabled.
+	CircuitBreaker *CircuitBreaker
+
 	// Disable data compression.
 	// By default data compression is enabled.
 	DisableCompression bool
 
+	// Compressors supported by the client in the order of preference.
+	//
+	// The client advertises the compressors during the handshake and
+	// the server picks the first compressor it supports. Data isn't
+	// compressed if the server supports none of the compressors.
+	// See Server.Compressors.
+	//
+	// Compressors are ignored if DisableCompression is set.
+	//
+	// By default FlateCompressor is used.
+	Compressors []Compressor
+
+	// Use the legacy single-byte handshake instead of the versioned
+	// handshake.
+	//
+	// Codec must be GobCodec in this case, Compressors are ignored
+	// and FlateCompressor is used if compression is enabled.
+	//
+	// The client with GobCodec falls back to the legacy handshake
+	// automatically if the server closes the connection or replies
+	// with unexpected data during the versioned handshake, since old
+	// servers don't support it. The fallback is remembered per server
+	// address until the server closes the connection established
+	// with the legacy handshake soon after the handshake. Set
+	// LegacyHandshake for connecting to old servers without failed
+	// versioned handshake attempts.
+	//
+	// Old servers enable compression after obtaining any non-zero
+	// legacy handshake byte, so GOAWAY support is advertised only
+	// if compression is enabled. Connections with DisableCompression
+	// don't obtain GOAWAY on Server.Shutdown, so new requests sent to such
+	// connections during the shutdown fail with retriable errors.
+	//
+	// By default the versioned handshake is used.
+	LegacyHandshake bool
+
+	// Codec for encoding requests and decoding responses.
+	//
+	// The server must support the codec. See Server.Codecs.
+	// Connections to servers without codecs' support fail
+	// during the handshake.
+	//
+	// By default GobCodec is used.
+	Codec Codec
+
 	// Size of send buffer per each underlying connection in bytes.
 	// Default value is DefaultBufferSize.
 	SendBufferSize int
 
+	// ReconnectPolicy determines delays before reconnects to the server.
+	//
+	// The delay is applied before every reconnect, including reconnects
+	// after failed handshakes and closed connections. The attempt number
+	// passed to ReconnectPolicy is reset only after the connection
+	// stays established for at least 10 seconds.
+	//
+	// Use ExponentialBackoff with non-zero Jitter for avoiding reconnect
+	// storms when many clients connect to the same server.
+	//
+	// By default ExponentialBackoff is used with delays growing
+	// from DefaultMinBackoffDelay to DefaultReconnectDelay and 20% jitter.
+	ReconnectPolicy Backoff
+
 	// Size of recv buffer per each underlying connection in bytes.
 	// Default value is DefaultBufferSize.
 	RecvBufferSize int
 
+	// The maximum duration for the handshake with the server.
+	//
+	// Default value is DefaultHandshakeTimeout.
+	HandshakeTimeout time.Duration
+
+	// The maximum size of a response the client accepts from the server
+	// in bytes.
+	//
+	// The limit is advertised to the server during the handshake,
+	// so the server replaces oversized responses with an error.
+	// Only the call with oversized response fails in this case, while
+	// the connection remains usable.
+	//
+	// The limit isn't enforced if Client.LegacyHandshake is set.
+	//
+	// By default the response size is unlimited.
+	MaxResponseSize int
+
 	// OnConnect is called whenever connection to server is established.
 	// The callback can be used for authentication/authorization/encryption
 	// and/or for custom transport wrapping.
@@ -77,9 +191,17 @@ type Client struct {
 	// transport implementation.
 	OnConnect OnConnectFunc
 
+	// OnConnectionStateChange is called whenever a connection to the server
+	// is established, closed or cannot be established.
+	//
+	// The callback is called synchronously from connection goroutines,
+	// so it mustn't block.
+	OnConnectionStateChange ConnectionStateFunc
+
 	// The client calls this callback when it needs new connection
 	// to the server.
-	// The client passes Client.Addr into Dial().
+	// The client passes Client.Addr or addresses obtained from
+	// Client.Resolver into Dial().
 	//
 	// Override this callback if you want custom underlying transport
 	// and/or authentication/authorization.
@@ -106,7 +228,37 @@ type Client struct {
 	Stats ConnStats
 
 	pendingRequestsCount uint32
-	requestsChan         chan *AsyncResult
+
+	interceptors []ClientInterceptor
+
+	// Requests' queues for PriorityHigh, PriorityNormal
+	// and PriorityBackground requests.
+	highRequestsChan       chan *AsyncResult
+	requestsChan           chan *AsyncResult
+	backgroundRequestsChan chan *AsyncResult
+
+	// queuedRequests is the number of requests in requests' queues
+	// including requests, which are about to be queued.
+	// It doesn't exceed PendingRequests. See reserveQueueSlot.
+	queuedRequests uint32
+
+	// The number of established connections to the server.
+	connectedConns int32
+
+	// connectedLock protects connectedConns updates and connectedChan.
+	connectedLock sync.Mutex
+
+	// connectedChan is closed when the first connection is established.
+	connectedChan chan struct{}
+
+	// legacyServers contains addresses of servers, which don't support
+	// the versioned handshake. See Client.LegacyHandshake.
+	legacyServers     map[string]struct{}
+	legacyServersLock sync.Mutex
+
+	// connsStats contains stats of the established connections.
+	connsStats     map[*ConnStats]struct{}
+	connsStatsLock sync.Mutex
 
 	clientStopChan chan struct{}
 	stopWg         sync.WaitGroup
@@ -141,8 +293,25 @@ func (c *Client) Start() {
 	if c.RecvBufferSize <= 0 {
 		c.RecvBufferSize = DefaultBufferSize
 	}
+	if c.HandshakeTimeout <= 0 {
+		c.HandshakeTimeout = DefaultHandshakeTimeout
+	}
+	if c.Codec == nil {
+		c.Codec = GobCodec
+	}
+	if err := validateCodec(c.Codec); err != nil {
+		panic(fmt.Sprintf("gorpc.Client: invalid Client.Codec: %s", err))
+	}
+	if err := validateCompressors(c.Compressors); err != nil {
+		panic(fmt.Sprintf("gorpc.Client: invalid Client.Compressors: %s", err))
+	}
+	if c.LegacyHandshake && c.Codec.Name() != GobCodec.Name() {
+		panic(fmt.Sprintf("gorpc.Client: Client.Codec %q cannot be used with Client.LegacyHandshake", c.Codec.Name()))
+	}
 
+	c.highRequestsChan = make(chan *AsyncResult, c.PendingRequests)
 	c.requestsChan = make(chan *AsyncResult, c.PendingRequests)
+	c.backgroundRequestsChan = make(chan *AsyncResult, c.PendingRequests)
 	c.clientStopChan = make(chan struct{})
 
 	if c.Conns <= 0 {
@@ -151,13 +320,42 @@ func (c *Client) Start() {
 	if c.Dial == nil {
 		c.Dial = defaultDial
 	}
+	if c.ReconnectPolicy == nil {
+		c.ReconnectPolicy = &ExponentialBackoff{
+			MinDelay: DefaultMinBackoffDelay,
+			MaxDelay: DefaultReconnectDelay,
+			Jitter:   0.2,
+		}
+	}
+
+	if c.Resolver != nil {
+		c.stopWg.Add(1)
+		go clientResolver(c)
+		return
+	}
 
 	for i := 0; i < c.Conns; i++ {
 		c.stopWg.Add(1)
-		go clientHandler(c)
+		go clientHandler(c, c.Addr, c.clientStopChan, nil)
 	}
 }
 
+// Use registers the given interceptors for all the calls made
+// via the client.
+//
+// Interceptors wrap Call*, CallAsync, Send and Batch calls, including
+// calls made via DispatcherClient and DispatcherBatch. Interceptors
+// are called in the order they are registered. Every retry attempt
+// made according to RetryPolicy is intercepted separately.
+//
+// Errors occurred in intercepted CallAsync calls are returned
+// via AsyncResult.Error.
+//
+// The function must be called before Client.Start().
+func (c *Client) Use(interceptors ...ClientInterceptor) {
+	c.interceptors = append(c.interceptors, interceptors...)
+}
+
 // Stop stops rpc client. Stopped client can be started again.
 func (c *Client) Stop() {
 	if c.clientStopChan == nil {
@@ -177,7 +375,168 @@ func (c *Client) Stop() {
 // this function.
 func (c *Client) PendingRequestsCount() int {
 	n := atomic.LoadUint32(&c.pendingRequestsCount)
-	return int(n) + len(c.requestsChan)
+	return int(n) + c.queuedRequestsCount()
+}
+
+// queuedRequestsCount returns the number of requests waiting
+// for sending to the server.
+func (c *Client) queuedRequestsCount() int {
+	return int(atomic.LoadUint32(&c.queuedRequests))
+}
+
+// reserveQueueSlot reserves a slot for new request in requests' queues.
+//
+// Every requests' queue may hold PendingRequests requests, so sending
+// the request to any queue doesn't block after reserving the slot.
+//
+// Returns false if requests' queues are full.
+func (c *Client) reserveQueueSlot() bool {
+	for {
+		n := atomic.LoadUint32(&c.queuedRequests)
+		if int(n) >= c.PendingRequests {
+			return false
+		}
+		if atomic.CompareAndSwapUint32(&c.queuedRequests, n, n+1) {
+			return true
+		}
+	}
+}
+
+// releaseQueueSlot must be called after obtaining the request
+// from requests' queues.
+func (c *Client) releaseQueueSlot() {
+	atomic.AddUint32(&c.queuedRequests, ^uint32(0))
+}
+
+func (c *Client) getRequestsChan(p Priority) chan *AsyncResult {
+	switch p.lane() {
+	case PriorityHigh:
+		return c.highRequestsChan
+	case PriorityBackground:
+		return c.backgroundRequestsChan
+	default:
+		return c.requestsChan
+	}
+}
+
+// isLegacyServer returns true if the server at addr doesn't support
+// the versioned handshake.
+func (c *Client) isLegacyServer(addr string) bool {
+	c.legacyServersLock.Lock()
+	_, ok := c.legacyServers[addr]
+	c.legacyServersLock.Unlock()
+	return ok
+}
+
+func (c *Client) setLegacyServer(addr string, legacy bool) {
+	c.legacyServersLock.Lock()
+	if legacy {
+		if c.legacyServers == nil {
+			c.legacyServers = make(map[string]struct{})
+		}
+		c.legacyServers[addr] = struct{}{}
+	} else {
+		delete(c.legacyServers, addr)
+	}
+	c.legacyServersLock.Unlock()
+}
+
+// ConnectedConns returns the number of established connections
+// to the server.
+//
+// Connections draining after GOAWAY from the server or after the address
+// removal by Client.Resolver aren't counted, since they don't accept
+// new requests.
+func (c *Client) ConnectedConns() int {
+	return int(atomic.LoadInt32(&c.connectedConns))
+}
+
+// ConnsStats returns stats' snapshots of the established connections
+// to the server.
+//
+// Connection stats contain only counters related to reading and writing
+// such as BytesWritten and UncompressedBytesWritten, so
+// ConnStats.CompressionRatio() may be used for obtaining the compression
+// ratio of every connection. Client.Stats contains aggregate stats
+// for all the connections.
+func (c *Client) ConnsStats() []*ConnStats {
+	c.connsStatsLock.Lock()
+	stats := make([]*ConnStats, 0, len(c.connsStats))
+	for cs := range c.connsStats {
+		stats = append(stats, cs.Snapshot())
+	}
+	c.connsStatsLock.Unlock()
+	return stats
+}
+
+func (c *Client) setConnStats(cs *ConnStats, connected bool) {
+	c.connsStatsLock.Lock()
+	if connected {
+		if c.connsStats == nil {
+			c.connsStats = make(map[*ConnStats]struct{})
+		}
+		c.connsStats[cs] = struct{}{}
+	} else {
+		delete(c.connsStats, cs)
+	}
+	c.connsStatsLock.Unlock()
+}
+
+// IsConnected returns true if the client has at least one established
+// connection to the server.
+func (c *Client) IsConnected() bool {
+	return c.ConnectedConns() > 0
+}
+
+// WaitConnected waits until the client establishes at least one connection
+// to the server.
+//
+// Returns ctx.Err() if the ctx is done before the connection is established.
+//
+// The function may be used for readiness probes after Client.Start().
+func (c *Client) WaitConnected(ctx context.Context) error {
+	c.connectedLock.Lock()
+	if atomic.LoadInt32(&c.connectedConns) > 0 {
+		c.connectedLock.Unlock()
+		return nil
+	}
+	if c.connectedChan == nil {
+		c.connectedChan = make(chan struct{})
+	}
+	ch := c.connectedChan
+	c.connectedLock.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Client) addConnectedConns(delta int32) {
+	c.connectedLock.Lock()
+	n := atomic.AddInt32(&c.connectedConns, delta)
+	if n > 0 && c.connectedChan != nil {
+		close(c.connectedChan)
+		c.connectedChan = nil
+	}
+	c.connectedLock.Unlock()
+}
+
+func (c *Client) notifyConnectionState(addr string, state ConnectionState, err error) {
+	if c.OnConnectionStateChange != nil {
+		c.OnConnectionStateChange(addr, state, err)
+	}
+}
+
+// isHealthy returns true if the client has at least one established
+// connection to the server and its circuit breaker isn't open.
+func (c *Client) isHealthy() bool {
+	if !c.IsConnected() {
+		return false
+	}
+	return c.CircuitBreaker == nil || c.CircuitBreaker.State() != CircuitOpen
 }
 
 // Call sends the given request to the server and obtains response
@@ -215,8 +574,122 @@ func (c *Client) Call(request interface{}) (response interface{}, err error) {
 //
 // Don't forget starting the client with Client.Start() before calling Client.Call().
 func (c *Client) CallTimeout(request interface{}, timeout time.Duration) (response interface{}, err error) {
+	if c.RetryPolicy == nil {
+		return c.callTimeout(request, timeout, PriorityNormal, nil)
+	}
+	return c.RetryPolicy.call(timeout, nil, func(timeout time.Duration) (interface{}, error) {
+		return c.callTimeout(request, timeout, PriorityNormal, nil)
+	})
+}
+
+func (c *Client) callTimeout(request interface{}, timeout time.Duration, priority Priority, hp *HedgePolicy) (response interface{}, err error) {
+	if len(c.interceptors) > 0 {
+		return c.intercept(context.Background(), request, false, false, func(ctx context.Context, request interface{}) (interface{}, error) {
+			return c.doCallTimeout(ctx, request, timeout, priority, hp)
+		})
+	}
+	return c.doCallTimeout(context.Background(), request, timeout, priority, hp)
+}
+
+// CallBytes sends the given raw request to the server and appends
+// the raw response returned from Server.BytesHandler to dst.
+//
+// Raw requests and responses bypass Client.Codec, so CallBytes is suitable
+// for payloads serialized by the application itself (for instance,
+// protobuf). Interceptors registered via Client.Use() aren't applied
+// to CallBytes.
+//
+// CallBytes requires length-prefixed framing, so it returns error
+// if Client.LegacyHandshake is set.
+//
+// The request may be modified after CallBytes returns.
+func (c *Client) CallBytes(dst, request []byte) (response []byte, err error) {
+	return c.CallBytesTimeout(dst, request, c.RequestTimeout)
+}
+
+// CallBytesTimeout is the same as CallBytes, but uses the given timeout
+// instead of Client.RequestTimeout.
+func (c *Client) CallBytesTimeout(dst, request []byte, timeout time.Duration) (response []byte, err error) {
+	if c.RetryPolicy == nil {
+		return c.callBytesTimeout(dst, request, timeout)
+	}
+	_, err = c.RetryPolicy.call(timeout, nil, func(timeout time.Duration) (interface{}, error) {
+		var err error
+		dst, err = c.callBytesTimeout(dst, request, timeout)
+		return nil, err
+	})
+	return dst, err
+}
+
+func (c *Client) callBytesTimeout(dst, request []byte, timeout time.Duration) (response []byte, err error) {
+	if c.CircuitBreaker != nil {
+		token, ok := c.CircuitBreaker.allow()
+		if !ok {
+			return dst, circuitOpenClientError(c)
+		}
+		defer func() { c.CircuitBreaker.done(token, err) }()
+	}
+
+	// Copy the request, since it may be written to the connection
+	// after the call is timed out.
+	rm := acquireRawMessage()
+	rm.B = append(rm.B[:0], request...)
+
 	var m *AsyncResult
-	if m, err = c.callAsync(request, false, true); err != nil {
+	if m, err = c.callAsync(rm, nil, time.Now().Add(timeout), PriorityNormal, false, true); err != nil {
+		releaseRawMessage(rm)
+		return dst, err
+	}
+
+	t := acquireTimer(timeout)
+
+	select {
+	case <-m.Done:
+		if err = m.Error; err == nil {
+			if resp, ok := m.Response.(*rawMessage); ok {
+				dst = append(dst, resp.B...)
+				releaseRawMessage(resp)
+			} else {
+				err = &ClientError{
+					Server: true,
+					err:    fmt.Errorf("gorpc.Client: [%s]. Unexpected response type for raw request: %T", c.Addr, m.Response),
+				}
+			}
+		}
+		releaseAsyncResult(m)
+	case <-t.C:
+		m.Cancel()
+		err = getClientTimeoutError(c, timeout)
+	}
+
+	releaseTimer(t)
+	return dst, err
+}
+
+// doCallTimeout uses ctx only for obtaining metadata.
+func (c *Client) doCallTimeout(ctx context.Context, request interface{}, timeout time.Duration, priority Priority, hp *HedgePolicy) (response interface{}, err error) {
+	if c.CircuitBreaker != nil {
+		token, ok := c.CircuitBreaker.allow()
+		if !ok {
+			return nil, circuitOpenClientError(c)
+		}
+		defer func() { c.CircuitBreaker.done(token, err) }()
+	}
+
+	md, respMD := metadataFromContext(ctx)
+	if hp != nil {
+		t := acquireTimer(timeout)
+		var ok bool
+		response, ok, err = c.callHedged(request, md, respMD, time.Now().Add(timeout), priority, hp, t.C, nil)
+		releaseTimer(t)
+		if !ok {
+			err = getClientTimeoutError(c, timeout)
+		}
+		return response, err
+	}
+
+	var m *AsyncResult
+	if m, err = c.callAsync(request, md, time.Now().Add(timeout), priority, false, true); err != nil {
 		return nil, err
 	}
 
@@ -225,6 +698,7 @@ func (c *Client) CallTimeout(request interface{}, timeout time.Duration) (respon
 	select {
 	case <-m.Done:
 		response, err = m.Response, m.Error
+		setResponseMetadata(respMD, m.Metadata)
 		releaseAsyncResult(m)
 	case <-t.C:
 		m.Cancel()
@@ -235,6 +709,92 @@ func (c *Client) CallTimeout(request interface{}, timeout time.Duration) (respon
 	return
 }
 
+// CallContext sends the given request to the server and obtains response
+// from the server.
+// Returns non-nil error if the response cannot be obtained before
+// the ctx is done or server connection problems occur.
+// The returned error can be casted to ClientError.
+//
+// Client.RequestTimeout is used if the ctx has no deadline.
+//
+// The request is canceled on the server side if the ctx is done before
+// the response is obtained, so the server may stop processing it.
+//
+// Request and response types may be arbitrary. All the request and response
+// types the client may use must be registered via RegisterType() before
+// starting the client.
+// There is no need in registering base Go types such as int, string, bool,
+// float64, etc. or arrays, slices and maps containing base Go types.
+//
+// Hint: use Dispatcher for distinct calls' construction.
+//
+// Don't forget starting the client with Client.Start() before calling Client.CallContext().
+func (c *Client) CallContext(ctx context.Context, request interface{}) (response interface{}, err error) {
+	ctx, cancel := c.withRequestTimeout(ctx)
+	defer cancel()
+
+	if c.RetryPolicy == nil {
+		return c.callContext(ctx, request)
+	}
+	return c.RetryPolicy.callContext(ctx, func(ctx context.Context) (interface{}, error) {
+		return c.callContext(ctx, request)
+	})
+}
+
+// withRequestTimeout returns ctx with Client.RequestTimeout deadline
+// if the given ctx has no deadline.
+func (c *Client) withRequestTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, c.RequestTimeout)
+}
+
+func (c *Client) callContext(ctx context.Context, request interface{}) (response interface{}, err error) {
+	if len(c.interceptors) > 0 {
+		return c.intercept(ctx, request, false, false, c.doCallContext)
+	}
+	return c.doCallContext(ctx, request)
+}
+
+func (c *Client) doCallContext(ctx context.Context, request interface{}) (response interface{}, err error) {
+	if c.CircuitBreaker != nil {
+		token, ok := c.CircuitBreaker.allow()
+		if !ok {
+			return nil, circuitOpenClientError(c)
+		}
+		defer func() { c.CircuitBreaker.done(token, err) }()
+	}
+
+	deadline, _ := ctx.Deadline()
+	priority, _ := priorityFromContext(ctx)
+	md, respMD := metadataFromContext(ctx)
+	if hp := hedgePolicyFromContext(ctx); hp != nil {
+		var ok bool
+		response, ok, err = c.callHedged(request, md, respMD, deadline, priority, hp, nil, ctx.Done())
+		if !ok {
+			err = getClientContextError(c, ctx)
+		}
+		return response, err
+	}
+
+	var m *AsyncResult
+	if m, err = c.callAsync(request, md, deadline, priority, false, true); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-m.Done:
+		response, err = m.Response, m.Error
+		setResponseMetadata(respMD, m.Metadata)
+		releaseAsyncResult(m)
+	case <-ctx.Done():
+		m.Cancel()
+		err = getClientContextError(c, ctx)
+	}
+	return
+}
+
 func acquireAsyncResult() *AsyncResult {
 	v := asyncResultPool.Get()
 	if v == nil {
@@ -248,10 +808,16 @@ var zeroTime time.Time
 func releaseAsyncResult(m *AsyncResult) {
 	m.Response = nil
 	m.Error = nil
+	m.Metadata = nil
 	m.Done = nil
 	m.request = nil
+	m.metadata = nil
 	m.t = zeroTime
+	m.deadline = zeroTime
 	m.done = nil
+	m.msgID = 0
+	m.cancelsChan = nil
+	m.canceled = 0
 	asyncResultPool.Put(m)
 }
 
@@ -266,6 +832,22 @@ func getClientTimeoutError(c *Client, timeout time.Duration) error {
 	}
 }
 
+func getClientContextError(c *Client, ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		deadline, _ := ctx.Deadline()
+		err := fmt.Errorf("gorpc.Client: [%s]. Cannot obtain response before deadline=%s", c.Addr, deadline)
+		c.LogError("%s", err)
+		return &ClientError{
+			Timeout: true,
+			err:     err,
+		}
+	}
+	return &ClientError{
+		Canceled: true,
+		err:      fmt.Errorf("gorpc.Client: [%s]. The call has been canceled: [%s]", c.Addr, ctx.Err()),
+	}
+}
+
 // Send sends the given request to the server and doesn't wait for response.
 //
 // Since this is 'fire and forget' function, which never waits for response,
@@ -284,7 +866,25 @@ func getClientTimeoutError(c *Client, timeout time.Duration) error {
 //
 // Don't forget starting the client with Client.Start() before calling Client.Send().
 func (c *Client) Send(request interface{}) error {
-	_, err := c.callAsync(request, true, true)
+	return c.send(request, PriorityNormal)
+}
+
+func (c *Client) send(request interface{}, priority Priority) error {
+	if len(c.interceptors) > 0 {
+		_, err := c.intercept(context.Background(), request, true, false, func(ctx context.Context, request interface{}) (interface{}, error) {
+			md, _ := metadataFromContext(ctx)
+			return nil, c.doSend(request, md, priority)
+		})
+		return err
+	}
+	return c.doSend(request, nil, priority)
+}
+
+func (c *Client) doSend(request interface{}, md Metadata, priority Priority) error {
+	if c.CircuitBreaker != nil && !c.CircuitBreaker.allowUntracked() {
+		return circuitOpenClientError(c)
+	}
+	_, err := c.callAsync(request, md, zeroTime, priority, true, true)
 	return err
 }
 
@@ -297,25 +897,70 @@ type AsyncResult struct {
 	// The error can be casted to ClientError.
 	Error error
 
+	// Response metadata sent by the server.
+	//
+	// The metadata can be read only after <-Done unblocks.
+	Metadata Metadata
+
 	// Response and Error become available after <-Done unblocks.
 	Done <-chan struct{}
 
 	request  interface{}
+	metadata Metadata
 	t        time.Time
+	deadline time.Time
 	done     chan struct{}
 	canceled uint32
+
+	// lock protects msgID and cancelsChan, which are set by clientWriter
+	// before the request is sent to the server.
+	lock        sync.Mutex
+	msgID       uint64
+	cancelsChan chan<- uint64
 }
 
 // Cancel cancels async call.
 //
 // Canceled call isn't sent to the server unless it is already sent there.
-// Canceled call may successfully complete if it has been already sent
-// to the server before Cancel call.
+// If the call has been already sent to the server, then the server
+// is notified about the cancellation, so it may skip the call processing.
+// Canceled call may successfully complete if the server managed
+// to process it before the cancellation notification.
 //
 // It is safe calling this function multiple times from concurrently
 // running goroutines.
 func (m *AsyncResult) Cancel() {
 	atomic.StoreUint32(&m.canceled, 1)
+
+	m.lock.Lock()
+	cancelsChan, msgID := m.cancelsChan, m.msgID
+	m.cancelsChan = nil
+	m.lock.Unlock()
+
+	if cancelsChan != nil {
+		// Cancellation notification is best-effort, so don't block
+		// if the connection is overloaded with cancellations.
+		select {
+		case cancelsChan <- msgID:
+		default:
+		}
+	}
+}
+
+// setSent registers the msgID the call is sent with, so Cancel
+// could notify the server via cancelsChan. The notification is sent
+// by clientWriter, so it always follows the request.
+//
+// Returns false if the call has been already canceled.
+func (m *AsyncResult) setSent(msgID uint64, cancelsChan chan<- uint64) bool {
+	m.lock.Lock()
+	canceled := m.isCanceled()
+	if !canceled {
+		m.msgID = msgID
+		m.cancelsChan = cancelsChan
+	}
+	m.lock.Unlock()
+	return !canceled
 }
 
 func (m *AsyncResult) isCanceled() bool {
@@ -347,10 +992,26 @@ func (m *AsyncResult) isCanceled() bool {
 // Don't forget starting the client with Client.Start() before
 // calling Client.CallAsync().
 func (c *Client) CallAsync(request interface{}) (*AsyncResult, error) {
-	return c.callAsync(request, false, false)
+	return c.callAsyncPriority(request, PriorityNormal)
 }
 
-func (c *Client) callAsync(request interface{}, skipResponse bool, usePool bool) (m *AsyncResult, err error) {
+func (c *Client) callAsyncPriority(request interface{}, priority Priority) (*AsyncResult, error) {
+	if len(c.interceptors) > 0 {
+		return c.interceptAsync(request, false, func(request interface{}, md Metadata) (*AsyncResult, error) {
+			return c.doCallAsyncPriority(request, md, priority)
+		})
+	}
+	return c.doCallAsyncPriority(request, nil, priority)
+}
+
+func (c *Client) doCallAsyncPriority(request interface{}, md Metadata, priority Priority) (*AsyncResult, error) {
+	if c.CircuitBreaker != nil && !c.CircuitBreaker.allowUntracked() {
+		return nil, circuitOpenClientError(c)
+	}
+	return c.callAsync(request, md, zeroTime, priority, false, false)
+}
+
+func (c *Client) callAsync(request interface{}, md Metadata, deadline time.Time, priority Priority, skipResponse bool, usePool bool) (m *AsyncResult, err error) {
 	if skipResponse {
 		usePool = true
 	}
@@ -361,58 +1022,78 @@ func (c *Client) callAsync(request interface{}, skipResponse bool, usePool bool)
 		m = &AsyncResult{}
 	}
 	m.request = request
+	m.metadata = md
 	if !skipResponse {
 		m.t = time.Now()
+		m.deadline = deadline
 		m.done = make(chan struct{})
 		m.Done = m.done
 	}
 
-	select {
-	case c.requestsChan <- m:
+	priority = priority.lane()
+	requestsChan := c.getRequestsChan(priority)
+	if c.reserveQueueSlot() {
+		requestsChan <- m
 		return m, nil
-	default:
-		// Try substituting the oldest async request by the new one
-		// on requests' queue overflow.
-		// This increases the chances for new request to succeed
-		// without timeout.
-		if skipResponse {
-			// Immediately notify the caller not interested
-			// in the response on requests' queue overflow, since
-			// there are no other ways to notify it later.
-			releaseAsyncResult(m)
-			return nil, overflowClientError(c)
-		}
+	}
 
-		select {
-		case mm := <-c.requestsChan:
-			if mm.done != nil {
-				mm.Error = overflowClientError(c)
-				close(mm.done)
-			} else {
-				releaseAsyncResult(mm)
-			}
-		default:
-		}
+	// Try substituting the oldest async request with lower priority
+	// by the new one on requests' queue overflow.
+	// This increases the chances for new request to succeed
+	// without timeout.
+	//
+	// The queue slot of the evicted request is passed to the new one,
+	// so concurrent callers cannot occupy it meanwhile.
+	evicted := false
+	for p := PriorityBackground; p < priority && !evicted; p++ {
+		evicted = c.evictRequest(p)
+	}
+	if !evicted && !skipResponse {
+		evicted = c.evictRequest(priority)
+	}
+	if !evicted {
+		// Immediately notify the caller on requests' queue overflow.
+		// Callers not interested in the response have no other ways
+		// to be notified later.
+		//
+		// Release m even if usePool = true, since m wasn't exposed
+		// to the caller yet.
+		releaseAsyncResult(m)
+		return nil, overflowClientError(c)
+	}
+	requestsChan <- m
+	return m, nil
+}
 
-		select {
-		case c.requestsChan <- m:
-			return m, nil
-		default:
-			// Release m even if usePool = true, since m wasn't exposed
-			// to the caller yet.
+// evictRequest fails the oldest request with the given priority
+// with overflow error.
+//
+// The queue slot of the evicted request isn't released, so the caller
+// must use it for the new request.
+//
+// Returns false if there are no requests with the given priority.
+func (c *Client) evictRequest(p Priority) bool {
+	select {
+	case m := <-c.getRequestsChan(p):
+		if m.done != nil {
+			m.Error = overflowClientError(c)
+			close(m.done)
+		} else {
 			releaseAsyncResult(m)
-			return nil, overflowClientError(c)
 		}
+		return true
+	default:
+		return false
 	}
 }
 
 func overflowClientError(c *Client) error {
-	err := fmt.Errorf("gorpc.Client: [%s]. Requests' queue with size=%d is overflown. Try increasing Client.PendingRequests value", c.Addr, cap(c.requestsChan))
+	err := fmt.Errorf("gorpc.Client: [%s]. Requests' queue with size=%d is overflown. Try increasing Client.PendingRequests value", c.Addr, c.PendingRequests)
 	c.LogError("%s", err)
 	return &ClientError{
 		Overflow: true,
 		err: fmt.Errorf("gorpc.Client: [%s]. Requests' queue with size=%d is overflown. "+
-			"Try increasing Client.PendingRequests value", c.Addr, cap(c.requestsChan)),
+			"Try increasing Client.PendingRequests value", c.Addr, c.PendingRequests),
 	}
 }
 
@@ -534,16 +1215,25 @@ func (b *Batch) Call() error {
 //
 // It is guaranteed that all <-BatchResult.Done channels are unblocked after
 // the CallTimeout returns.
-func (b *Batch) CallTimeout(timeout time.Duration) error {
+func (b *Batch) CallTimeout(timeout time.Duration) (err error) {
+	if cb := b.c.CircuitBreaker; cb != nil {
+		token, ok := cb.allow()
+		if !ok {
+			return circuitOpenClientError(b.c)
+		}
+		defer func() { cb.done(token, err) }()
+	}
+
 	b.opsLock.Lock()
 	ops := b.ops
 	b.ops = nil
 	b.opsLock.Unlock()
 
+	deadline := time.Now().Add(timeout)
 	results := make([]*AsyncResult, len(ops))
 	for i := range ops {
 		op := ops[i]
-		m, err := callAsyncRetry(b.c, op.request, op.done == nil, 5)
+		m, err := b.callAsync(op.request, deadline, op.done == nil)
 		if err != nil {
 			return err
 		}
@@ -567,7 +1257,9 @@ func (b *Batch) CallTimeout(timeout time.Duration) error {
 			releaseTimer(t)
 			err := getClientTimeoutError(b.c, timeout)
 			for ; i < len(results); i++ {
-				results[i].Cancel()
+				if results[i] != nil {
+					results[i].Cancel()
+				}
 				op = ops[i]
 				op.Error = err
 				if op.done != nil {
@@ -583,10 +1275,23 @@ func (b *Batch) CallTimeout(timeout time.Duration) error {
 	return nil
 }
 
-func callAsyncRetry(c *Client, request interface{}, skipResponse bool, retriesCount int) (*AsyncResult, error) {
+// callAsync sends the batched request via interceptors registered
+// with Client.Use().
+//
+// The returned AsyncResult may be nil for skipResponse requests.
+func (b *Batch) callAsync(request interface{}, deadline time.Time, skipResponse bool) (*AsyncResult, error) {
+	if len(b.c.interceptors) > 0 {
+		return b.c.interceptAsync(request, skipResponse, func(request interface{}, md Metadata) (*AsyncResult, error) {
+			return callAsyncRetry(b.c, request, md, deadline, skipResponse, 5)
+		})
+	}
+	return callAsyncRetry(b.c, request, nil, deadline, skipResponse, 5)
+}
+
+func callAsyncRetry(c *Client, request interface{}, md Metadata, deadline time.Time, skipResponse bool, retriesCount int) (*AsyncResult, error) {
 	retriesCount++
 	for {
-		m, err := c.callAsync(request, skipResponse, false)
+		m, err := c.callAsync(request, md, deadline, PriorityNormal, skipResponse, false)
 		if err == nil {
 			return m, nil
 		}
@@ -619,6 +1324,19 @@ type ClientError struct {
 	// May be set if AsyncResult.Cancel is called.
 	Canceled bool
 
+	// Set if the call has been rejected by Client.CircuitBreaker.
+	CircuitOpen bool
+
+	// Set if the server rejected the request without processing it
+	// because of server limits such as Server.MaxInFlightPerConn
+	// or Server.MaxRequestSize.
+	Rejected bool
+
+	// Set together with Rejected if the request size exceeds
+	// Server.MaxRequestSize. Such requests are never retried by default,
+	// since they cannot succeed.
+	Oversized bool
+
 	err error
 }
 
@@ -633,90 +1351,200 @@ var ErrCanceled = &ClientError{
 	err:      fmt.Errorf("the call has been canceled"),
 }
 
-func clientHandler(c *Client) {
+func clientResolver(c *Client) {
+	defer c.stopWg.Done()
+
+	stopChan := c.clientStopChan
+	addrRemovedChans := make(map[string]chan struct{})
+	watchResolver(c.Resolver, stopChan, func(addrs []string) {
+		newAddrs := make(map[string]struct{}, len(addrs))
+		for _, addr := range addrs {
+			newAddrs[addr] = struct{}{}
+			if _, ok := addrRemovedChans[addr]; ok {
+				continue
+			}
+			removedChan := make(chan struct{})
+			addrRemovedChans[addr] = removedChan
+			for i := 0; i < c.Conns; i++ {
+				c.stopWg.Add(1)
+				go clientHandler(c, addr, stopChan, removedChan)
+			}
+		}
+		for addr, removedChan := range addrRemovedChans {
+			if _, ok := newAddrs[addr]; !ok {
+				close(removedChan)
+				delete(addrRemovedChans, addr)
+			}
+		}
+	})
+}
+
+// healthyConnDuration is the minimum duration the connection must stay
+// established before resetting the attempt number for Client.ReconnectPolicy.
+const healthyConnDuration = 10 * time.Second
+
+// clientHandler maintains connection to addr until the client is stopped
+// or addr is removed by Client.Resolver. removedChan is closed
+// in the latter case.
+func clientHandler(c *Client, addr string, stopChan, removedChan <-chan struct{}) {
 	defer c.stopWg.Done()
 
 	var conn io.ReadWriteCloser
 	var err error
 	var stopping atomic.Value
 
+	// The number of consecutive reconnects without healthy connection.
+	attempts := 0
+	isReconnect := false
+
 	for {
+		if isReconnect {
+			// Delay every reconnect, so connections closed by the server
+			// right after the handshake don't result in reconnect storms.
+			attempts++
+			t := acquireTimer(c.ReconnectPolicy.Delay(attempts))
+			select {
+			case <-stopChan:
+				releaseTimer(t)
+				return
+			case <-removedChan:
+				releaseTimer(t)
+				return
+			case <-t.C:
+			}
+			releaseTimer(t)
+			c.Stats.incReconnectAttempts()
+		}
+		isReconnect = true
+
 		dialChan := make(chan struct{})
 		go func() {
-			if conn, err = c.Dial(c.Addr); err != nil {
+			if conn, err = c.Dial(addr); err != nil {
 				if stopping.Load() == nil {
-					c.LogError("gorpc.Client: [%s]. Cannot establish rpc connection: [%s]", c.Addr, err)
+					c.LogError("gorpc.Client: [%s]. Cannot establish rpc connection: [%s]", addr, err)
 				}
 			}
 			close(dialChan)
 		}()
 
 		select {
-		case <-c.clientStopChan:
+		case <-stopChan:
 			stopping.Store(true)
 			<-dialChan
 			return
+		case <-removedChan:
+			stopping.Store(true)
+			<-dialChan
+			if conn != nil {
+				conn.Close()
+			}
+			return
 		case <-dialChan:
 			c.Stats.incDialCalls()
 		}
 
 		if err != nil {
 			c.Stats.incDialErrors()
-			select {
-			case <-c.clientStopChan:
-				return
-			case <-time.After(time.Second):
-			}
+			c.notifyConnectionState(addr, ConnectionDialFailed, err)
 			continue
 		}
 
-		clientHandleConnection(c, conn)
+		legacyFallback := !c.LegacyHandshake && c.isLegacyServer(addr)
+		startTime := time.Now()
+		if clientHandleConnection(c, addr, conn, stopChan, removedChan) && time.Since(startTime) >= healthyConnDuration {
+			attempts = 0
+		} else if legacyFallback {
+			// The server closed the connection soon after the legacy
+			// handshake, so it may be a new server rejecting connections
+			// for other reasons. Try the versioned handshake again.
+			c.setLegacyServer(addr, false)
+		}
 
 		select {
-		case <-c.clientStopChan:
+		case <-stopChan:
+			return
+		case <-removedChan:
 			return
 		default:
 		}
 	}
 }
 
-func clientHandleConnection(c *Client, conn io.ReadWriteCloser) {
+// clientHandleConnection serves the connection until it is closed.
+//
+// Returns false if the connection has been closed before establishing it.
+func clientHandleConnection(c *Client, addr string, conn io.ReadWriteCloser, clientStopChan, removedChan <-chan struct{}) bool {
 	if c.OnConnect != nil {
-		newConn, err := c.OnConnect(c.Addr, conn)
+		newConn, err := c.OnConnect(addr, conn)
 		if err != nil {
-			c.LogError("gorpc.Client: [%s]. OnConnect error: [%s]", c.Addr, err)
+			c.LogError("gorpc.Client: [%s]. OnConnect error: [%s]", addr, err)
 			if conn != nil {
 				conn.Close()
 			}
-			return
+			c.notifyConnectionState(addr, ConnectionDialFailed, err)
+			return false
 		}
 		conn = newConn
 	}
 
-	var buf [1]byte
-	if !c.DisableCompression {
-		buf[0] = 1
-	}
-	_, err := conn.Write(buf[:])
+	params, err := clientHandshakeTimeout(c, addr, conn, clientStopChan)
 	if err != nil {
-		c.LogError("gorpc.Client: [%s]. Error when writing handshake to server: [%s]", c.Addr, err)
+		c.LogError("gorpc.Client: [%s]. Error during handshake with server: [%s]", addr, err)
 		conn.Close()
-		return
+		c.notifyConnectionState(addr, ConnectionDialFailed, err)
+		return false
 	}
 
+	params.stats = &ConnStats{}
+	c.setConnStats(params.stats, true)
+	c.addConnectedConns(1)
+	c.notifyConnectionState(addr, ConnectionEstablished, nil)
+
 	stopChan := make(chan struct{})
 
 	pendingRequests := make(map[uint64]*AsyncResult)
 	var pendingRequestsLock sync.Mutex
 
+	cancelsChan := make(chan uint64, c.PendingRequests)
+
+	// goAwayChan is closed when the server sends GOAWAY control frame.
+	goAwayChan := make(chan struct{})
+
+	// drainChan is closed after the writer stops sending requests
+	// to the removed address, so the reader returns after obtaining
+	// responses for all the pending requests.
+	drainChan := make(chan struct{})
+
 	writerDone := make(chan error, 1)
-	go clientWriter(c, conn, pendingRequests, &pendingRequestsLock, stopChan, writerDone)
+	go clientWriter(c, addr, conn, params, pendingRequests, &pendingRequestsLock, cancelsChan, goAwayChan, removedChan, stopChan, writerDone)
 
 	readerDone := make(chan error, 1)
-	go clientReader(c, conn, pendingRequests, &pendingRequestsLock, readerDone)
+	go clientReader(c, addr, conn, params, pendingRequests, &pendingRequestsLock, goAwayChan, drainChan, readerDone)
 
 	select {
 	case err = <-writerDone:
+		if err == errGoAway || err == errAddrRemoved {
+			// Let the connection deliver responses for pending requests
+			// in the background, while the caller establishes
+			// a new connection.
+			// The draining connection doesn't accept new requests,
+			// so it mustn't be counted in ConnectedConns.
+			c.addConnectedConns(-1)
+			c.setConnStats(params.stats, false)
+			var drainTimeout time.Duration
+			if err == errAddrRemoved {
+				// The server isn't going to close the connection,
+				// so limit the drain duration.
+				drainTimeout = c.RequestTimeout
+				close(drainChan)
+			}
+			c.stopWg.Add(1)
+			go func() {
+				defer c.stopWg.Done()
+				clientDrainConnection(c, addr, conn, pendingRequests, &pendingRequestsLock, stopChan, readerDone, clientStopChan, drainTimeout)
+			}()
+			return true
+		}
 		close(stopChan)
 		conn.Close()
 		<-readerDone
@@ -724,19 +1552,101 @@ func clientHandleConnection(c *Client, conn io.ReadWriteCloser) {
 		close(stopChan)
 		conn.Close()
 		<-writerDone
-	case <-c.clientStopChan:
+	case <-clientStopChan:
 		close(stopChan)
 		conn.Close()
 		<-readerDone
 		<-writerDone
 	}
 
+	c.addConnectedConns(-1)
+	c.setConnStats(params.stats, false)
+	clientCloseConnection(c, addr, pendingRequests, err)
+	return true
+}
+
+// errGoAway is returned by clientWriter after GOAWAY control frame
+// is obtained from the server.
+var errGoAway = errors.New("GOAWAY control frame has been obtained from the server")
+
+// errAddrRemoved is returned by clientWriter after the server address
+// has been removed by Client.Resolver.
+var errAddrRemoved = errors.New("the server address has been removed by Client.Resolver")
+
+// clientDrainConnection waits until the server closes the connection
+// after GOAWAY control frame or until the reader obtains responses
+// for all the pending requests after the address removal.
+//
+// The connection is closed after drainTimeout if it is non-zero.
+func clientDrainConnection(c *Client, addr string, conn io.ReadWriteCloser, pendingRequests map[uint64]*AsyncResult, pendingRequestsLock *sync.Mutex,
+	stopChan chan struct{}, readerDone <-chan error, clientStopChan <-chan struct{}, drainTimeout time.Duration) {
+
+	var timeoutChan <-chan time.Time
+	if drainTimeout > 0 {
+		pendingRequestsLock.Lock()
+		n := len(pendingRequests)
+		pendingRequestsLock.Unlock()
+		if n == 0 {
+			// There are no pending requests, so the reader may wait
+			// for responses forever.
+			close(stopChan)
+			conn.Close()
+			<-readerDone
+			clientCloseConnection(c, addr, pendingRequests, nil)
+			return
+		}
+		t := acquireTimer(drainTimeout)
+		defer releaseTimer(t)
+		timeoutChan = t.C
+	}
+
+	var err error
+	select {
+	case err = <-readerDone:
+		pendingRequestsLock.Lock()
+		n := len(pendingRequests)
+		pendingRequestsLock.Unlock()
+		if n == 0 {
+			// The server closed the connection after sending all
+			// the responses.
+			err = nil
+		}
+		close(stopChan)
+		conn.Close()
+	case <-clientStopChan:
+		close(stopChan)
+		conn.Close()
+		<-readerDone
+	case <-timeoutChan:
+		close(stopChan)
+		conn.Close()
+		<-readerDone
+	}
+
+	clientCloseConnection(c, addr, pendingRequests, err)
+}
+
+// clientCloseConnection notifies pending requests and the client
+// about the closed connection.
+//
+// The caller must remove the connection from ConnectedConns.
+func clientCloseConnection(c *Client, addr string, pendingRequests map[uint64]*AsyncResult, err error) {
+	c.notifyConnectionState(addr, ConnectionClosed, err)
+
 	if err != nil {
 		c.LogError("%s", err)
 		err = &ClientError{
 			Connection: true,
 			err:        err,
 		}
+	} else {
+		// The connection has been closed on purpose (for instance, the server
+		// address has been removed by Client.Resolver), so pending requests
+		// won't obtain responses.
+		err = &ClientError{
+			Connection: true,
+			err:        fmt.Errorf("gorpc.Client: [%s]. The connection to the server has been closed", addr),
+		}
 	}
 	for _, m := range pendingRequests {
 		atomic.AddUint32(&c.pendingRequestsCount, ^uint32(0))
@@ -747,13 +1657,60 @@ func clientHandleConnection(c *Client, conn io.ReadWriteCloser) {
 	}
 }
 
-func clientWriter(c *Client, w io.Writer, pendingRequests map[uint64]*AsyncResult, pendingRequestsLock *sync.Mutex, stopChan <-chan struct{}, done chan<- error) {
+// nextRequest returns the request with the highest priority from requests'
+// queues without blocking.
+//
+// Returns nil if requests' queues are empty.
+func (c *Client) nextRequest() *AsyncResult {
+	return c.nextRequestAbove(PriorityBackground - 1)
+}
+
+// nextRequestAbove returns the request with the highest priority from
+// queues for priorities higher than lane without blocking.
+//
+// Returns nil if these queues are empty.
+func (c *Client) nextRequestAbove(lane Priority) *AsyncResult {
+	for p := PriorityHigh; p > lane; p-- {
+		select {
+		case m := <-c.getRequestsChan(p):
+			c.releaseQueueSlot()
+			return m
+		default:
+		}
+	}
+	return nil
+}
+
+func clientWriter(c *Client, addr string, w io.Writer, params *connParams, pendingRequests map[uint64]*AsyncResult, pendingRequestsLock *sync.Mutex,
+	cancelsChan chan uint64, goAwayChan, removedChan, stopChan <-chan struct{}, done chan<- error) {
 	var err error
 	defer func() { done <- err }()
 
-	e := newMessageEncoder(w, c.SendBufferSize, !c.DisableCompression, &c.Stats)
+	// deferred is the request obtained while waiting for new requests.
+	// It is sent after requests with higher priority, which may be queued
+	// meanwhile, since select picks ready requests' queue at random.
+	// The queue slot is held by the deferred request until it is sent.
+	var deferred *AsyncResult
+	var deferredLane Priority
+	defer func() {
+		if deferred != nil {
+			// Return the request to its queue, so it could be sent
+			// via another connection.
+			c.getRequestsChan(deferredLane) <- deferred
+		}
+	}()
+
+	e := newMessageEncoder(w, c.SendBufferSize, params, &c.Stats)
 	defer e.Close()
 
+	// Servers, which don't acknowledge capCancel, would process
+	// cancellation notifications as usual requests, so the calls
+	// canceled after sending aren't notified to such servers.
+	sentCancelsChan := cancelsChan
+	if !params.cancel {
+		sentCancelsChan = nil
+	}
+
 	t := time.NewTimer(c.FlushDelay)
 	var flushChan <-chan time.Time
 	var wr wireRequest
@@ -761,31 +1718,89 @@ func clientWriter(c *Client, w io.Writer, pendingRequests map[uint64]*AsyncResul
 	for {
 		var m *AsyncResult
 
+		var cancelID uint64
+
 		select {
-		case m = <-c.requestsChan:
+		case cancelID = <-cancelsChan:
+		case <-goAwayChan:
+			// Stop sending new requests to the connection.
+			if err = e.Flush(); err != nil {
+				err = fmt.Errorf("gorpc.Client: [%s]. Cannot flush requests to underlying stream: [%s]", addr, err)
+				return
+			}
+			err = errGoAway
+			return
+		case <-removedChan:
+			if err = e.Flush(); err != nil {
+				err = fmt.Errorf("gorpc.Client: [%s]. Cannot flush requests to underlying stream: [%s]", addr, err)
+				return
+			}
+			err = errAddrRemoved
+			return
 		default:
-			// Give the last chance for ready goroutines filling c.requestsChan :)
+			if deferred == nil {
+				m = c.nextRequest()
+			} else if m = c.nextRequestAbove(deferredLane); m == nil {
+				m = deferred
+				deferred = nil
+				c.releaseQueueSlot()
+			}
+		}
+		if m == nil && cancelID == 0 {
+			// Give the last chance for ready goroutines filling requests' queues :)
 			runtime.Gosched()
-
+			m = c.nextRequest()
+		}
+		if m == nil && cancelID == 0 {
+			var lane Priority
 			select {
 			case <-stopChan:
 				return
+			case m = <-c.highRequestsChan:
+				lane = PriorityHigh
 			case m = <-c.requestsChan:
+				lane = PriorityNormal
+			case m = <-c.backgroundRequestsChan:
+				lane = PriorityBackground
+			case cancelID = <-cancelsChan:
+			case <-goAwayChan:
+				// Handle GOAWAY on the next iteration.
+				continue
+			case <-removedChan:
+				// Handle the address removal on the next iteration.
+				continue
 			case <-flushChan:
 				if err = e.Flush(); err != nil {
-					err = fmt.Errorf("gorpc.Client: [%s]. Cannot flush requests to underlying stream: [%s]", c.Addr, err)
+					err = fmt.Errorf("gorpc.Client: [%s]. Cannot flush requests to underlying stream: [%s]", addr, err)
 					return
 				}
 				flushChan = nil
 				continue
 			}
+			if m != nil {
+				if h := c.nextRequestAbove(lane); h != nil {
+					deferred = m
+					deferredLane = lane
+					m = h
+				} else {
+					c.releaseQueueSlot()
+				}
+			}
 		}
 
 		if flushChan == nil {
 			flushChan = getFlushChan(t, c.FlushDelay)
 		}
 
+		if m == nil {
+			if err = writeCancel(addr, e, cancelID); err != nil {
+				return
+			}
+			continue
+		}
+
 		if m.isCanceled() {
+			releaseRawRequest(m)
 			if m.done != nil {
 				m.Error = ErrCanceled
 				close(m.done)
@@ -795,6 +1810,32 @@ func clientWriter(c *Client, w io.Writer, pendingRequests map[uint64]*AsyncResul
 			continue
 		}
 
+		if _, ok := m.request.(*rawMessage); ok && !params.framed {
+			releaseRawRequest(m)
+			m.Error = &ClientError{
+				err: fmt.Errorf("gorpc.Client: [%s]. Raw requests require length-prefixed framing. Make sure Client.LegacyHandshake isn't set", addr),
+			}
+			close(m.done)
+			continue
+		}
+
+		wr.Timeout = 0
+		if !m.deadline.IsZero() {
+			wr.Timeout = time.Until(m.deadline)
+			if wr.Timeout <= 0 {
+				// There is no sense in sending the request, since the caller
+				// isn't waiting for the response anymore.
+				c.Stats.incExpiredRequests()
+				releaseRawRequest(m)
+				m.Error = &ClientError{
+					Timeout: true,
+					err:     fmt.Errorf("gorpc.Client: [%s]. The request deadline exceeded before sending it to the server", addr),
+				}
+				close(m.done)
+				continue
+			}
+		}
+
 		if m.done == nil {
 			wr.ID = 0
 		} else {
@@ -810,12 +1851,24 @@ func clientWriter(c *Client, w io.Writer, pendingRequests map[uint64]*AsyncResul
 				}
 				msgID++
 			}
-			pendingRequests[msgID] = m
+			// msgID must be registered before m becomes visible
+			// to clientReader, since m may be completed and released
+			// by the caller as soon as the response is read.
+			sent := m.setSent(msgID, sentCancelsChan)
+			if sent {
+				pendingRequests[msgID] = m
+			}
 			pendingRequestsLock.Unlock()
+			if !sent {
+				releaseRawRequest(m)
+				m.Error = ErrCanceled
+				close(m.done)
+				continue
+			}
 			atomic.AddUint32(&c.pendingRequestsCount, 1)
 
 			if n > 10*c.PendingRequests {
-				err = fmt.Errorf("gorpc.Client: [%s]. The server didn't return %d responses yet. Closing server connection in order to prevent client resource leaks", c.Addr, n)
+				err = fmt.Errorf("gorpc.Client: [%s]. The server didn't return %d responses yet. Closing server connection in order to prevent client resource leaks", addr, n)
 				return
 			}
 
@@ -823,62 +1876,170 @@ func clientWriter(c *Client, w io.Writer, pendingRequests map[uint64]*AsyncResul
 		}
 
 		wr.Request = m.request
+		wr.Metadata = m.metadata
 		if m.done == nil {
 			c.Stats.incRPCCalls()
 			releaseAsyncResult(m)
 		}
 
 		if err = e.Encode(wr); err != nil {
-			err = fmt.Errorf("gorpc.Client: [%s]. Cannot send request to wire: [%s]", c.Addr, err)
+			if fe, ok := err.(*frameSizeError); ok {
+				// The request hasn't been sent, so the connection
+				// remains usable.
+				err = nil
+				if rm, ok := wr.Request.(*rawMessage); ok {
+					releaseRawMessage(rm)
+				}
+				wr.Request = nil
+				wr.Metadata = nil
+				rejectOversizedRequest(c, addr, fe, m, pendingRequests, pendingRequestsLock)
+				continue
+			}
+			err = fmt.Errorf("gorpc.Client: [%s]. Cannot send request to wire: [%s]", addr, err)
 			return
 		}
+		if rm, ok := wr.Request.(*rawMessage); ok {
+			releaseRawMessage(rm)
+		}
 		wr.Request = nil
+		wr.Metadata = nil
+	}
+}
+
+func rejectOversizedRequest(c *Client, addr string, fe *frameSizeError, m *AsyncResult, pendingRequests map[uint64]*AsyncResult, pendingRequestsLock *sync.Mutex) {
+	c.Stats.incOversizedMessages()
+	err := fmt.Errorf("gorpc.Client: [%s]. The request size exceeds Server.MaxRequestSize=%d bytes", addr, fe.maxSize)
+	if fe.id == 0 {
+		// The caller doesn't wait for the response, so just log the error.
+		c.LogError("%s", err)
+		return
+	}
+
+	pendingRequestsLock.Lock()
+	delete(pendingRequests, fe.id)
+	pendingRequestsLock.Unlock()
+	atomic.AddUint32(&c.pendingRequestsCount, ^uint32(0))
+
+	// The request hasn't been sent, so there is no need in notifying
+	// the server about its cancellation.
+	m.setSent(0, nil)
+
+	m.Error = &ClientError{
+		Rejected:  true,
+		Oversized: true,
+		err:       err,
 	}
+	close(m.done)
 }
 
-func clientReader(c *Client, r io.Reader, pendingRequests map[uint64]*AsyncResult, pendingRequestsLock *sync.Mutex, done chan<- error) {
+func writeCancel(addr string, e *messageEncoder, msgID uint64) error {
+	wr := wireRequest{
+		CancelID: msgID,
+	}
+	if err := e.Encode(wr); err != nil {
+		return fmt.Errorf("gorpc.Client: [%s]. Cannot send cancellation to wire: [%s]", addr, err)
+	}
+	return nil
+}
+
+func clientReader(c *Client, addr string, r io.Reader, params *connParams, pendingRequests map[uint64]*AsyncResult, pendingRequestsLock *sync.Mutex,
+	goAwayChan chan<- struct{}, drainChan <-chan struct{}, done chan<- error) {
 	var err error
 	defer func() {
 		if r := recover(); r != nil {
 			if err == nil {
-				err = fmt.Errorf("gorpc.Client: [%s]. Panic when reading data from server: %v", c.Addr, r)
+				err = fmt.Errorf("gorpc.Client: [%s]. Panic when reading data from server: %v", addr, r)
 			}
 		}
 		done <- err
 	}()
 
-	d := newMessageDecoder(r, c.RecvBufferSize, !c.DisableCompression, &c.Stats)
+	d := newMessageDecoder(r, c.RecvBufferSize, params, &c.Stats)
 	defer d.Close()
 
 	var wr wireResponse
 	for {
 		if err = d.Decode(&wr); err != nil {
-			err = fmt.Errorf("gorpc.Client: [%s]. Cannot decode response: [%s]", c.Addr, err)
+			if fe, ok := err.(*frameSizeError); ok && fe.id != 0 {
+				// The response has been skipped, so the connection
+				// remains usable.
+				err = nil
+				rejectOversizedResponse(c, addr, fe, pendingRequests, pendingRequestsLock)
+				continue
+			}
+			err = fmt.Errorf("gorpc.Client: [%s]. Cannot decode response: [%s]", addr, err)
 			return
 		}
 
+		if wr.GoAway {
+			c.Stats.incGoAwayFrames()
+			if goAwayChan != nil {
+				close(goAwayChan)
+				goAwayChan = nil
+			}
+			wr.GoAway = false
+			continue
+		}
+
 		pendingRequestsLock.Lock()
 		m, ok := pendingRequests[wr.ID]
 		if ok {
 			delete(pendingRequests, wr.ID)
 		}
+		drained := false
+		if len(pendingRequests) == 0 {
+			select {
+			case <-drainChan:
+				drained = true
+			default:
+			}
+		}
 		pendingRequestsLock.Unlock()
 
 		if !ok {
-			err = fmt.Errorf("gorpc.Client: [%s]. Unexpected msgID=[%d] obtained from server", c.Addr, wr.ID)
+			err = fmt.Errorf("gorpc.Client: [%s]. Unexpected msgID=[%d] obtained from server", addr, wr.ID)
 			return
 		}
 
 		atomic.AddUint32(&c.pendingRequestsCount, ^uint32(0))
 
 		m.Response = wr.Response
+		m.Metadata = wr.Metadata
 
 		wr.ID = 0
 		wr.Response = nil
-		if wr.Error != "" {
+		wr.Metadata = nil
+		if wr.Canceled {
+			m.Error = ErrCanceled
+			wr.Canceled = false
+			wr.Error = ""
+		} else if wr.ShuttingDown {
+			// The server didn't process the request, so it may be safely
+			// retried on another connection.
+			m.Error = &ClientError{
+				Connection: true,
+				err:        fmt.Errorf("gorpc.Client: [%s]. Server error: [%s]", addr, wr.Error),
+			}
+			wr.ShuttingDown = false
+			wr.Error = ""
+		} else if wr.Rejected {
+			m.Error = &ClientError{
+				Rejected: true,
+				err:      fmt.Errorf("gorpc.Client: [%s]. Server error: [%s]", addr, wr.Error),
+			}
+			wr.Rejected = false
+			wr.Error = ""
+		} else if wr.Timeout {
+			m.Error = &ClientError{
+				Timeout: true,
+				err:     fmt.Errorf("gorpc.Client: [%s]. Server error: [%s]", addr, wr.Error),
+			}
+			wr.Timeout = false
+			wr.Error = ""
+		} else if wr.Error != "" {
 			m.Error = &ClientError{
 				Server: true,
-				err:    fmt.Errorf("gorpc.Client: [%s]. Server error: [%s]", c.Addr, wr.Error),
+				err:    fmt.Errorf("gorpc.Client: [%s]. Server error: [%s]", addr, wr.Error),
 			}
 			wr.Error = ""
 		}
@@ -887,5 +2048,32 @@ func clientReader(c *Client, r io.Reader, pendingRequests map[uint64]*AsyncResul
 		c.Stats.incRPCTime(uint64(time.Since(m.t).Seconds() * 1000))
 
 		close(m.done)
+
+		if drained {
+			// Responses for all the requests sent to the removed
+			// address have been obtained.
+			return
+		}
+	}
+}
+
+func rejectOversizedResponse(c *Client, addr string, fe *frameSizeError, pendingRequests map[uint64]*AsyncResult, pendingRequestsLock *sync.Mutex) {
+	c.Stats.incOversizedMessages()
+
+	pendingRequestsLock.Lock()
+	m, ok := pendingRequests[fe.id]
+	if ok {
+		delete(pendingRequests, fe.id)
+	}
+	pendingRequestsLock.Unlock()
+	if !ok {
+		return
+	}
+	atomic.AddUint32(&c.pendingRequestsCount, ^uint32(0))
+
+	m.Error = &ClientError{
+		Server: true,
+		err:    fmt.Errorf("gorpc.Client: [%s]. The response size %d bytes exceeds Client.MaxResponseSize=%d bytes", addr, fe.size, fe.maxSize),
 	}
+	close(m.done)
 }
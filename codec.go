@@ -0,0 +1,100 @@
+package gorpc
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+)
+
+// Codec encodes and decodes messages sent between Client and Server.
+//
+// The codec is chosen during the handshake: the client sends the name
+// of Client.Codec to the server and the server selects the codec
+// with the same name from Server.Codecs.
+//
+// Messages passed to Encoder.Encode are structs with exported fields,
+// while messages passed to Decoder.Decode are pointers to such structs.
+// Request and response payloads are stored in interface{} fields,
+// so the codec must be able to restore their concrete types.
+type Codec interface {
+	// Name returns the codec name, which identifies the codec
+	// during the handshake.
+	//
+	// The name must be non-empty and mustn't exceed 255 bytes.
+	Name() string
+
+	// NewEncoder returns new encoder writing messages to w.
+	NewEncoder(w io.Writer) Encoder
+
+	// NewDecoder returns new decoder reading messages from r.
+	NewDecoder(r io.Reader) Decoder
+}
+
+// Encoder writes messages to the underlying stream.
+//
+// Encoder is created via Codec.NewEncoder for every connection.
+type Encoder interface {
+	Encode(msg interface{}) error
+}
+
+// Decoder reads messages from the underlying stream.
+//
+// Decoder is created via Codec.NewDecoder for every connection.
+type Decoder interface {
+	Decode(msg interface{}) error
+}
+
+// GobCodec is the default codec based on encoding/gob.
+//
+// All the request and response types sent via GobCodec must be registered
+// via RegisterType().
+//
+// GobCodec is supported by all the servers, so there is no need
+// in adding it to Server.Codecs.
+var GobCodec Codec = &gobCodec{}
+
+type gobCodec struct{}
+
+func (c *gobCodec) Name() string {
+	return "gob"
+}
+
+func (c *gobCodec) NewEncoder(w io.Writer) Encoder {
+	return gob.NewEncoder(w)
+}
+
+func (c *gobCodec) NewDecoder(r io.Reader) Decoder {
+	return gob.NewDecoder(r)
+}
+
+func validateCodec(codec Codec) error {
+	name := codec.Name()
+	if name == "" {
+		return fmt.Errorf("codec name cannot be empty")
+	}
+	if len(name) > 255 {
+		return fmt.Errorf("too long codec name: %d bytes. It mustn't exceed 255 bytes", len(name))
+	}
+	return nil
+}
+
+// getCodec returns the codec with the given name from Server.Codecs.
+//
+// Returns nil if the server doesn't support the codec.
+func (s *Server) getCodec(name string) Codec {
+	for _, codec := range s.Codecs {
+		if codec.Name() == name {
+			return codec
+		}
+	}
+	if name == GobCodec.Name() {
+		return GobCodec
+	}
+	return nil
+}
+
+// appendCodecName appends the name of the codec sent by the client
+// during the handshake to dst.
+func appendCodecName(dst []byte, codec Codec) []byte {
+	return appendHandshakeName(dst, codec.Name())
+}
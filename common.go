@@ -26,8 +26,90 @@ const (
 
 	// DefaultBufferSize is the default size for Client and Server buffers.
 	DefaultBufferSize = 64 * 1024
+
+	// DefaultHandshakeTimeout is the default maximum duration
+	// for the handshake on Client and Server.
+	DefaultHandshakeTimeout = 10 * time.Second
+
+	// DefaultReconnectDelay is the default maximum delay between
+	// reconnects to the server. See Client.ReconnectPolicy.
+	DefaultReconnectDelay = time.Second
+
+	// DefaultMinBackoffDelay is the default minimum delay
+	// for ExponentialBackoff.
+	DefaultMinBackoffDelay = 100 * time.Millisecond
+
+	// DefaultMaxBackoffDelay is the default maximum delay
+	// for ExponentialBackoff.
+	DefaultMaxBackoffDelay = 30 * time.Second
+
+	// DefaultRetryAttempts is the default maximum number of attempts
+	// for RetryPolicy.
+	DefaultRetryAttempts = 3
+
+	// DefaultResolveInterval is the default interval between address
+	// re-resolutions for FileResolver, DNSResolver and DNSSRVResolver.
+	DefaultResolveInterval = 10 * time.Second
+
+	// DefaultCircuitWindow is the default interval for collecting call
+	// outcomes in CircuitBreaker.
+	DefaultCircuitWindow = 10 * time.Second
+
+	// DefaultCircuitMinCalls is the default minimum number of calls
+	// required for opening CircuitBreaker.
+	DefaultCircuitMinCalls = 20
+
+	// DefaultCircuitFailureRatio is the default ratio of failed calls
+	// for opening CircuitBreaker.
+	DefaultCircuitFailureRatio = 0.5
+
+	// DefaultCircuitOpenTimeout is the default duration CircuitBreaker
+	// stays open before becoming half-open.
+	DefaultCircuitOpenTimeout = 5 * time.Second
 )
 
+// ConnectionState is a client connection state passed
+// to ConnectionStateFunc.
+type ConnectionState int
+
+const (
+	// ConnectionEstablished means the connection to the server
+	// has been established.
+	ConnectionEstablished ConnectionState = iota
+
+	// ConnectionClosed means the established connection to the server
+	// has been closed.
+	ConnectionClosed
+
+	// ConnectionDialFailed means the connection to the server
+	// cannot be established.
+	ConnectionDialFailed
+)
+
+// String returns human-readable connection state.
+func (s ConnectionState) String() string {
+	switch s {
+	case ConnectionEstablished:
+		return "established"
+	case ConnectionClosed:
+		return "closed"
+	case ConnectionDialFailed:
+		return "dial failed"
+	default:
+		return fmt.Sprintf("ConnectionState(%d)", int(s))
+	}
+}
+
+// ConnectionStateFunc is a callback, which is called by Client on connection
+// state changes if assigned to Client.OnConnectionStateChange.
+//
+// addr is the server address the connection is related to.
+// err contains the reason for ConnectionDialFailed state and for
+// ConnectionClosed state if the connection has been closed due to error.
+// err is nil if the connection has been closed by the client itself,
+// for instance, by Client.Stop().
+type ConnectionStateFunc func(addr string, state ConnectionState, err error)
+
 // OnConnectFunc is a callback, which may be called by both Client and Server
 // on every connection creation if assigned
 // to Client.OnConnect / Server.OnConnect.
@@ -40,9 +122,19 @@ const (
 // rwc on every Write() call, otherwise the connection will hang forever.
 //
 // The callback may be used for authentication/authorization and/or custom
-// transport wrapping.
+// transport wrapping. Server.OnConnect may pass the client identity
+// to handlers by returning the connection implementing PeerValuer.
 type OnConnectFunc func(remoteAddr string, rwc io.ReadWriteCloser) (io.ReadWriteCloser, error)
 
+// PeerConnectFunc is a callback, which is called by Server on every client
+// connection if assigned to Server.OnPeerConnect.
+//
+// conn is the connection returned from Server.OnConnect, so the callback
+// may obtain the client identity established by OnConnect from it.
+// The callback may attach arbitrary values to peer via PeerInfo.SetValue.
+// The connection is closed if the callback returns non-nil error.
+type PeerConnectFunc func(peer *PeerInfo, conn io.ReadWriteCloser) error
+
 // LoggerFunc is an error logging function to pass to gorpc.SetErrorLogger().
 type LoggerFunc func(format string, args ...interface{})
 
@@ -0,0 +1,316 @@
+package gorpc
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+)
+
+// Compressor compresses data sent between Client and Server.
+//
+// The compressor is chosen during the handshake: the client advertises
+// names of Client.Compressors to the server and the server selects
+// the first advertised compressor with the same name from Server.Compressors.
+type Compressor interface {
+	// Name returns the compressor name, which identifies the compression
+	// algorithm during the handshake.
+	//
+	// The name must be non-empty and mustn't exceed 255 bytes.
+	Name() string
+
+	// NewWriter returns new writer compressing data written to w.
+	NewWriter(w io.Writer) CompressWriter
+
+	// NewReader returns new reader decompressing data read from r.
+	//
+	// The reader mustn't read from r until the first Read call,
+	// since the peer may send nothing on the connection.
+	NewReader(r io.Reader) io.ReadCloser
+}
+
+// CompressWriter is the writer returned from Compressor.NewWriter.
+type CompressWriter interface {
+	io.WriteCloser
+
+	// Flush must write all the buffered data to the underlying writer,
+	// so the peer could decompress it.
+	Flush() error
+}
+
+var (
+	// FlateCompressor is the default compressor based on compress/flate
+	// with flate.BestSpeed compression level.
+	FlateCompressor = NewFlateCompressor(flate.BestSpeed)
+
+	// GzipCompressor is the compressor based on compress/gzip
+	// with gzip.BestSpeed compression level.
+	GzipCompressor = NewGzipCompressor(gzip.BestSpeed)
+
+	// ZlibCompressor is the compressor based on compress/zlib
+	// with zlib.BestSpeed compression level.
+	ZlibCompressor = NewZlibCompressor(zlib.BestSpeed)
+
+	// NoCompressor disables compression.
+	//
+	// NoCompressor is supported by all the servers, so there is no need
+	// in adding it to Server.Compressors.
+	NoCompressor Compressor = &noCompressor{}
+)
+
+// NewFlateCompressor returns compressor based on compress/flate with
+// the given compression level.
+//
+// The level affects only the compressing side, so clients and servers
+// may use distinct levels.
+func NewFlateCompressor(level int) Compressor {
+	validateCompressionLevel("flate", level)
+	return &flateCompressor{
+		level: level,
+	}
+}
+
+// NewGzipCompressor returns compressor based on compress/gzip with
+// the given compression level.
+//
+// The level affects only the compressing side, so clients and servers
+// may use distinct levels.
+func NewGzipCompressor(level int) Compressor {
+	validateCompressionLevel("gzip", level)
+	return &gzipCompressor{
+		level: level,
+	}
+}
+
+// NewZlibCompressor returns compressor based on compress/zlib with
+// the given compression level.
+//
+// The level affects only the compressing side, so clients and servers
+// may use distinct levels.
+func NewZlibCompressor(level int) Compressor {
+	validateCompressionLevel("zlib", level)
+	return &zlibCompressor{
+		level: level,
+	}
+}
+
+func validateCompressionLevel(name string, level int) {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		logPanic("gorpc: invalid %s compression level: %d", name, level)
+	}
+}
+
+type flateCompressor struct {
+	level int
+}
+
+func (c *flateCompressor) Name() string {
+	return "flate"
+}
+
+func (c *flateCompressor) NewWriter(w io.Writer) CompressWriter {
+	zw, _ := flate.NewWriter(w, c.level)
+	return zw
+}
+
+func (c *flateCompressor) NewReader(r io.Reader) io.ReadCloser {
+	return flate.NewReader(r)
+}
+
+type gzipCompressor struct {
+	level int
+}
+
+func (c *gzipCompressor) Name() string {
+	return "gzip"
+}
+
+func (c *gzipCompressor) NewWriter(w io.Writer) CompressWriter {
+	zw, _ := gzip.NewWriterLevel(w, c.level)
+	return zw
+}
+
+func (c *gzipCompressor) NewReader(r io.Reader) io.ReadCloser {
+	return &lazyReader{
+		r: r,
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	}
+}
+
+type zlibCompressor struct {
+	level int
+}
+
+func (c *zlibCompressor) Name() string {
+	return "zlib"
+}
+
+func (c *zlibCompressor) NewWriter(w io.Writer) CompressWriter {
+	zw, _ := zlib.NewWriterLevel(w, c.level)
+	return zw
+}
+
+func (c *zlibCompressor) NewReader(r io.Reader) io.ReadCloser {
+	return &lazyReader{
+		r:         r,
+		newReader: zlib.NewReader,
+	}
+}
+
+type noCompressor struct{}
+
+func (c *noCompressor) Name() string {
+	return "none"
+}
+
+func (c *noCompressor) NewWriter(w io.Writer) CompressWriter {
+	return &nopCompressWriter{w}
+}
+
+func (c *noCompressor) NewReader(r io.Reader) io.ReadCloser {
+	return &nopCompressReader{r}
+}
+
+type nopCompressWriter struct {
+	io.Writer
+}
+
+func (w *nopCompressWriter) Flush() error { return nil }
+func (w *nopCompressWriter) Close() error { return nil }
+
+type nopCompressReader struct {
+	io.Reader
+}
+
+func (r *nopCompressReader) Close() error { return nil }
+
+// lazyReader postpones creating the decompressing reader until
+// the first Read call, since gzip and zlib readers read stream header
+// on creation.
+type lazyReader struct {
+	r         io.Reader
+	newReader func(r io.Reader) (io.ReadCloser, error)
+	zr        io.ReadCloser
+}
+
+func (r *lazyReader) Read(p []byte) (int, error) {
+	if r.zr == nil {
+		zr, err := r.newReader(r.r)
+		if err != nil {
+			return 0, err
+		}
+		r.zr = zr
+	}
+	return r.zr.Read(p)
+}
+
+func (r *lazyReader) Close() error {
+	if r.zr == nil {
+		return nil
+	}
+	return r.zr.Close()
+}
+
+func validateCompressors(compressors []Compressor) error {
+	if len(compressors) > maxCompressors {
+		return fmt.Errorf("too many compressors: %d. The number of compressors mustn't exceed %d", len(compressors), maxCompressors)
+	}
+	for _, c := range compressors {
+		name := c.Name()
+		if name == "" {
+			return fmt.Errorf("compressor name cannot be empty")
+		}
+		if len(name) > 255 {
+			return fmt.Errorf("too long compressor name: %d bytes. It mustn't exceed 255 bytes", len(name))
+		}
+	}
+	return nil
+}
+
+// getCompressor returns the compressor for the connection.
+//
+// names contains compressor names advertised by the client.
+// Returns the index of the selected compressor in names or noCompressorIndex
+// if the server supports none of the advertised compressors.
+func (s *Server) getCompressor(names []string) (Compressor, byte) {
+	for i, name := range names {
+		if name == NoCompressor.Name() {
+			return NoCompressor, byte(i)
+		}
+		for _, c := range s.Compressors {
+			if c.Name() == name {
+				return c, byte(i)
+			}
+		}
+	}
+	return NoCompressor, noCompressorIndex
+}
+
+// getLegacyCompressor returns the compressor for clients enabling compression
+// via handshakeCompression flag. Such clients always use flate.
+func (s *Server) getLegacyCompressor() Compressor {
+	for _, c := range s.Compressors {
+		if c.Name() == FlateCompressor.Name() {
+			return c
+		}
+	}
+	return FlateCompressor
+}
+
+// appendCompressorNames appends names of the given compressors advertised
+// by the client during the handshake to dst.
+func appendCompressorNames(dst []byte, compressors []Compressor) []byte {
+	dst = append(dst, byte(len(compressors)))
+	for _, c := range compressors {
+		dst = appendHandshakeName(dst, c.Name())
+	}
+	return dst
+}
+
+// readCompressorNames reads compressor names sent by appendCompressorNames.
+func readCompressorNames(r io.Reader) ([]string, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	if int(n[0]) > maxCompressors {
+		return nil, fmt.Errorf("too many compressors: %d. The number of compressors mustn't exceed %d", n[0], maxCompressors)
+	}
+	names := make([]string, n[0])
+	for i := range names {
+		name, err := readHandshakeName(r)
+		if err != nil {
+			return nil, err
+		}
+		names[i] = name
+	}
+	return names, nil
+}
+
+// readCompressorReply reads the compressor selected by the server.
+func readCompressorReply(r io.Reader, compressors []Compressor) (Compressor, error) {
+	var reply [1]byte
+	if _, err := io.ReadFull(r, reply[:]); err != nil {
+		return nil, fmt.Errorf("cannot read compressor handshake reply: [%s]", err)
+	}
+	if reply[0] == noCompressorIndex {
+		return NoCompressor, nil
+	}
+	if int(reply[0]) >= len(compressors) {
+		return nil, fmt.Errorf("unexpected compressor index in handshake reply: %d. Expected less than %d", reply[0], len(compressors))
+	}
+	return compressors[reply[0]], nil
+}
+
+const (
+	// maxCompressors is the maximum number of compressors the client
+	// may advertise.
+	maxCompressors = 254
+
+	// noCompressorIndex is sent by the server if it doesn't support
+	// compressors advertised by the client.
+	noCompressorIndex = 255
+)
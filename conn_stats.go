@@ -52,6 +52,54 @@ type ConnStats struct {
 	// The number of Accept() errors.
 	AcceptErrors uint64
 
+	// The number of requests dropped without processing, since their deadline
+	// has been exceeded.
+	ExpiredRequests uint64
+
+	// The number of Dial() calls made for re-establishing lost or failed
+	// connections to the server.
+	ReconnectAttempts uint64
+
+	// The number of hedged requests sent by the client.
+	HedgedCalls uint64
+
+	// The number of calls where the hedged request won.
+	HedgeWins uint64
+
+	// The number of GOAWAY control frames sent by the server
+	// or obtained by the client.
+	GoAwayFrames uint64
+
+	// The number of connections rejected by the server because of
+	// Server.MaxConns or Server.MaxConnsPerClientIP limits.
+	RejectedConns uint64
+
+	// The number of requests rejected by the server because of
+	// Server.MaxInFlightPerConn limit.
+	RejectedRequests uint64
+
+	// The number of requests abandoned by the server, since the handler
+	// didn't return response during Server.HandlerTimeout.
+	HandlerTimeouts uint64
+
+	// The number of bytes written to the underlying connections
+	// before compression.
+	//
+	// The counter covers all the connections including connections
+	// without compression, like BytesWritten does.
+	UncompressedBytesWritten uint64
+
+	// The number of bytes read from the underlying connections
+	// after decompression.
+	//
+	// The counter covers all the connections including connections
+	// without compression, like BytesRead does.
+	UncompressedBytesRead uint64
+
+	// The number of messages exceeding Client.MaxResponseSize
+	// or Server.MaxRequestSize limits.
+	OversizedMessages uint64
+
 	// lock is for 386 builds. See https://github.com/valyala/gorpc/issues/5 .
 	lock sync.Mutex
 }
@@ -80,6 +128,28 @@ func (cs *ConnStats) AvgRPCCalls() (write float64, read float64) {
 	return float64(cs.WriteCalls) / float64(cs.RPCCalls), float64(cs.ReadCalls) / float64(cs.RPCCalls)
 }
 
+// CompressionRatio returns the ratio between uncompressed and compressed
+// bytes sent / received.
+//
+// The ratio is aggregated over all the connections for Client.Stats
+// and Server.Stats. Use stats returned from Client.ConnsStats()
+// and PeerInfo.Stats() for obtaining the compression ratio
+// of a particular connection.
+// The ratio is 1 if no bytes have been sent / received yet.
+//
+// Use stats returned from ConnStats.Snapshot() on live Client and / or Server,
+// since the original stats can be updated by concurrently running goroutines.
+func (cs *ConnStats) CompressionRatio() (send float64, recv float64) {
+	return compressionRatio(cs.UncompressedBytesWritten, cs.BytesWritten), compressionRatio(cs.UncompressedBytesRead, cs.BytesRead)
+}
+
+func compressionRatio(uncompressed, compressed uint64) float64 {
+	if compressed == 0 {
+		return 1
+	}
+	return float64(uncompressed) / float64(compressed)
+}
+
 type writerCounter struct {
 	w  io.Writer
 	cs *ConnStats
@@ -123,3 +193,39 @@ func (r *readerCounter) Read(p []byte) (int, error) {
 	r.cs.addBytesRead(uint64(n))
 	return n, err
 }
+
+type uncompressedWriterCounter struct {
+	w  io.Writer
+	cs *ConnStats
+}
+
+type uncompressedReaderCounter struct {
+	r  io.Reader
+	cs *ConnStats
+}
+
+func newUncompressedWriterCounter(w io.Writer, cs *ConnStats) io.Writer {
+	return &uncompressedWriterCounter{
+		w:  w,
+		cs: cs,
+	}
+}
+
+func newUncompressedReaderCounter(r io.Reader, cs *ConnStats) io.Reader {
+	return &uncompressedReaderCounter{
+		r:  r,
+		cs: cs,
+	}
+}
+
+func (w *uncompressedWriterCounter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.cs.addUncompressedBytesWritten(uint64(n))
+	return n, err
+}
+
+func (r *uncompressedReaderCounter) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.cs.addUncompressedBytesRead(uint64(n))
+	return n, err
+}
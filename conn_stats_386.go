@@ -37,6 +37,17 @@ func (cs *ConnStats) Reset() {
 	cs.DialErrors = 0
 	cs.AcceptCalls = 0
 	cs.AcceptErrors = 0
+	cs.ExpiredRequests = 0
+	cs.ReconnectAttempts = 0
+	cs.HedgedCalls = 0
+	cs.HedgeWins = 0
+	cs.GoAwayFrames = 0
+	cs.RejectedConns = 0
+	cs.RejectedRequests = 0
+	cs.HandlerTimeouts = 0
+	cs.UncompressedBytesWritten = 0
+	cs.UncompressedBytesRead = 0
+	cs.OversizedMessages = 0
 	cs.lock.Unlock()
 }
 
@@ -111,3 +122,69 @@ func (cs *ConnStats) incAcceptErrors() {
 	cs.AcceptErrors++
 	cs.lock.Unlock()
 }
+
+func (cs *ConnStats) incExpiredRequests() {
+	cs.lock.Lock()
+	cs.ExpiredRequests++
+	cs.lock.Unlock()
+}
+
+func (cs *ConnStats) incReconnectAttempts() {
+	cs.lock.Lock()
+	cs.ReconnectAttempts++
+	cs.lock.Unlock()
+}
+
+func (cs *ConnStats) incHedgedCalls() {
+	cs.lock.Lock()
+	cs.HedgedCalls++
+	cs.lock.Unlock()
+}
+
+func (cs *ConnStats) incHedgeWins() {
+	cs.lock.Lock()
+	cs.HedgeWins++
+	cs.lock.Unlock()
+}
+
+func (cs *ConnStats) incGoAwayFrames() {
+	cs.lock.Lock()
+	cs.GoAwayFrames++
+	cs.lock.Unlock()
+}
+
+func (cs *ConnStats) incRejectedConns() {
+	cs.lock.Lock()
+	cs.RejectedConns++
+	cs.lock.Unlock()
+}
+
+func (cs *ConnStats) incRejectedRequests() {
+	cs.lock.Lock()
+	cs.RejectedRequests++
+	cs.lock.Unlock()
+}
+
+func (cs *ConnStats) incHandlerTimeouts() {
+	cs.lock.Lock()
+	cs.HandlerTimeouts++
+	cs.lock.Unlock()
+}
+
+func (cs *ConnStats) addUncompressedBytesWritten(n uint64) {
+	cs.lock.Lock()
+	cs.UncompressedBytesWritten += n
+	cs.lock.Unlock()
+}
+
+func (cs *ConnStats) addUncompressedBytesRead(n uint64) {
+	cs.lock.Lock()
+	cs.UncompressedBytesRead += n
+	cs.lock.Unlock()
+}
+
+func (cs *ConnStats) incOversizedMessages() {
+	cs.lock.Lock()
+	cs.OversizedMessages++
+	cs.lock.Unlock()
+}
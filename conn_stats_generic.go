@@ -12,18 +12,29 @@ import (
 // since the original stats can be updated by concurrently running goroutines.
 func (cs *ConnStats) Snapshot() *ConnStats {
 	return &ConnStats{
-		RPCCalls:     atomic.LoadUint64(&cs.RPCCalls),
-		RPCTime:      atomic.LoadUint64(&cs.RPCTime),
-		BytesWritten: atomic.LoadUint64(&cs.BytesWritten),
-		BytesRead:    atomic.LoadUint64(&cs.BytesRead),
-		ReadCalls:    atomic.LoadUint64(&cs.ReadCalls),
-		ReadErrors:   atomic.LoadUint64(&cs.ReadErrors),
-		WriteCalls:   atomic.LoadUint64(&cs.WriteCalls),
-		WriteErrors:  atomic.LoadUint64(&cs.WriteErrors),
-		DialCalls:    atomic.LoadUint64(&cs.DialCalls),
-		DialErrors:   atomic.LoadUint64(&cs.DialErrors),
-		AcceptCalls:  atomic.LoadUint64(&cs.AcceptCalls),
-		AcceptErrors: atomic.LoadUint64(&cs.AcceptErrors),
+		RPCCalls:                 atomic.LoadUint64(&cs.RPCCalls),
+		RPCTime:                  atomic.LoadUint64(&cs.RPCTime),
+		BytesWritten:             atomic.LoadUint64(&cs.BytesWritten),
+		BytesRead:                atomic.LoadUint64(&cs.BytesRead),
+		ReadCalls:                atomic.LoadUint64(&cs.ReadCalls),
+		ReadErrors:               atomic.LoadUint64(&cs.ReadErrors),
+		WriteCalls:               atomic.LoadUint64(&cs.WriteCalls),
+		WriteErrors:              atomic.LoadUint64(&cs.WriteErrors),
+		DialCalls:                atomic.LoadUint64(&cs.DialCalls),
+		DialErrors:               atomic.LoadUint64(&cs.DialErrors),
+		AcceptCalls:              atomic.LoadUint64(&cs.AcceptCalls),
+		AcceptErrors:             atomic.LoadUint64(&cs.AcceptErrors),
+		ExpiredRequests:          atomic.LoadUint64(&cs.ExpiredRequests),
+		ReconnectAttempts:        atomic.LoadUint64(&cs.ReconnectAttempts),
+		HedgedCalls:              atomic.LoadUint64(&cs.HedgedCalls),
+		HedgeWins:                atomic.LoadUint64(&cs.HedgeWins),
+		GoAwayFrames:             atomic.LoadUint64(&cs.GoAwayFrames),
+		RejectedConns:            atomic.LoadUint64(&cs.RejectedConns),
+		RejectedRequests:         atomic.LoadUint64(&cs.RejectedRequests),
+		HandlerTimeouts:          atomic.LoadUint64(&cs.HandlerTimeouts),
+		UncompressedBytesWritten: atomic.LoadUint64(&cs.UncompressedBytesWritten),
+		UncompressedBytesRead:    atomic.LoadUint64(&cs.UncompressedBytesRead),
+		OversizedMessages:        atomic.LoadUint64(&cs.OversizedMessages),
 	}
 }
 
@@ -41,6 +52,17 @@ func (cs *ConnStats) Reset() {
 	atomic.StoreUint64(&cs.DialErrors, 0)
 	atomic.StoreUint64(&cs.AcceptCalls, 0)
 	atomic.StoreUint64(&cs.AcceptErrors, 0)
+	atomic.StoreUint64(&cs.ExpiredRequests, 0)
+	atomic.StoreUint64(&cs.ReconnectAttempts, 0)
+	atomic.StoreUint64(&cs.HedgedCalls, 0)
+	atomic.StoreUint64(&cs.HedgeWins, 0)
+	atomic.StoreUint64(&cs.GoAwayFrames, 0)
+	atomic.StoreUint64(&cs.RejectedConns, 0)
+	atomic.StoreUint64(&cs.RejectedRequests, 0)
+	atomic.StoreUint64(&cs.HandlerTimeouts, 0)
+	atomic.StoreUint64(&cs.UncompressedBytesWritten, 0)
+	atomic.StoreUint64(&cs.UncompressedBytesRead, 0)
+	atomic.StoreUint64(&cs.OversizedMessages, 0)
 }
 
 func (cs *ConnStats) incRPCCalls() {
@@ -90,3 +112,47 @@ func (cs *ConnStats) incAcceptCalls() {
 func (cs *ConnStats) incAcceptErrors() {
 	atomic.AddUint64(&cs.AcceptErrors, 1)
 }
+
+func (cs *ConnStats) incExpiredRequests() {
+	atomic.AddUint64(&cs.ExpiredRequests, 1)
+}
+
+func (cs *ConnStats) incReconnectAttempts() {
+	atomic.AddUint64(&cs.ReconnectAttempts, 1)
+}
+
+func (cs *ConnStats) incHedgedCalls() {
+	atomic.AddUint64(&cs.HedgedCalls, 1)
+}
+
+func (cs *ConnStats) incHedgeWins() {
+	atomic.AddUint64(&cs.HedgeWins, 1)
+}
+
+func (cs *ConnStats) incGoAwayFrames() {
+	atomic.AddUint64(&cs.GoAwayFrames, 1)
+}
+
+func (cs *ConnStats) incRejectedConns() {
+	atomic.AddUint64(&cs.RejectedConns, 1)
+}
+
+func (cs *ConnStats) incRejectedRequests() {
+	atomic.AddUint64(&cs.RejectedRequests, 1)
+}
+
+func (cs *ConnStats) incHandlerTimeouts() {
+	atomic.AddUint64(&cs.HandlerTimeouts, 1)
+}
+
+func (cs *ConnStats) addUncompressedBytesWritten(n uint64) {
+	atomic.AddUint64(&cs.UncompressedBytesWritten, n)
+}
+
+func (cs *ConnStats) addUncompressedBytesRead(n uint64) {
+	atomic.AddUint64(&cs.UncompressedBytesRead, n)
+}
+
+func (cs *ConnStats) incOversizedMessages() {
+	atomic.AddUint64(&cs.OversizedMessages, 1)
+}
@@ -1,11 +1,13 @@
 package gorpc
 
 import (
+	"context"
 	"encoding"
 	"encoding/gob"
 	"errors"
 	"fmt"
 	"reflect"
+	"runtime"
 	"strings"
 	"sync"
 	"time"
@@ -22,7 +24,8 @@ import (
 //
 // See examples for details.
 type Dispatcher struct {
-	serviceMap map[string]*serviceData
+	serviceMap   map[string]*serviceData
+	interceptors []ServerInterceptor
 }
 
 type serviceData struct {
@@ -31,9 +34,13 @@ type serviceData struct {
 }
 
 type funcData struct {
-	inNum int
-	reqt  reflect.Type
-	fv    reflect.Value
+	inNum   int
+	hasCtx  bool
+	hasPeer bool
+	reqt    reflect.Type
+	respt   reflect.Type
+	fv      reflect.Value
+	timeout time.Duration
 }
 
 // NewDispatcher returns new dispatcher.
@@ -48,6 +55,13 @@ func NewDispatcher() *Dispatcher {
 // The function must accept zero, one or two input arguments.
 // If the function has two arguments, then the first argument must have
 // string type - the server will pass client address in this parameter.
+// Additionally the function may accept context.Context as the first
+// argument - the server will pass request context in this parameter
+// if the handler is constructed via NewHandlerFuncCtx().
+// The first argument of two-argument function may have *PeerInfo type
+// instead of string - the server will pass information about the client
+// connection in this parameter. Such functions require the handler
+// constructed via NewHandlerFuncCtx().
 //
 // The function must return zero, one or two values.
 //   * If the function has two return values, then the second value must have
@@ -75,13 +89,61 @@ func (d *Dispatcher) AddFunc(funcName string, f interface{}) {
 	fd := &funcData{
 		fv: reflect.Indirect(reflect.ValueOf(f)),
 	}
-	var err error
-	if fd.inNum, fd.reqt, err = validateFunc(funcName, fd.fv, false); err != nil {
+	if err := validateFunc(funcName, fd, false); err != nil {
 		logPanic("gorpc.Dispatcher: %s", err)
 	}
 	sd.funcMap[funcName] = fd
 }
 
+// SetHandlerTimeout overrides Server.HandlerTimeout for the given function.
+//
+// funcName must be either the name of the function registered via AddFunc()
+// or serviceName.methodName for the method of the service registered
+// via AddService().
+//
+// The timeout may be either shorter or longer than Server.HandlerTimeout.
+// It is applied even if Server.HandlerTimeout isn't set. The function
+// is abandoned after the timeout and the caller obtains timeout error.
+// The server doesn't start new handlers in place of the abandoned one
+// until it returns, so Server.Concurrency isn't exceeded. This isn't
+// guaranteed for handlers obtained via NewHandlerFunc(), since they
+// don't obtain request context from the server.
+//
+// The function must be called before NewHandlerFunc()
+// or NewHandlerFuncCtx().
+func (d *Dispatcher) SetHandlerTimeout(funcName string, timeout time.Duration) {
+	serviceName := ""
+	if n := strings.IndexByte(funcName, '.'); n >= 0 {
+		if _, ok := d.serviceMap[funcName[:n]]; ok {
+			serviceName, funcName = funcName[:n], funcName[n+1:]
+		}
+	}
+
+	sd, ok := d.serviceMap[serviceName]
+	if !ok {
+		logPanic("gorpc.Dispatcher: cannot set handler timeout for unknown service [%s]", serviceName)
+	}
+	fd, ok := sd.funcMap[funcName]
+	if !ok {
+		logPanic("gorpc.Dispatcher: cannot set handler timeout for unknown function [%s]", funcName)
+	}
+	fd.timeout = timeout
+}
+
+// Use registers the given interceptors for all the functions and service
+// methods served by the dispatcher.
+//
+// Interceptors are called in the order they are registered after
+// the request is resolved to the function or the service method.
+// Interceptors see the request passed to the function and the response
+// and the error returned from the function.
+//
+// The function must be called before NewHandlerFunc()
+// and NewHandlerFuncCtx().
+func (d *Dispatcher) Use(interceptors ...ServerInterceptor) {
+	d.interceptors = append(d.interceptors, interceptors...)
+}
+
 // AddService registers public methods of the given service under
 // the given name serviceName.
 //
@@ -116,8 +178,7 @@ func (d *Dispatcher) AddService(serviceName string, service interface{}) {
 		fd := &funcData{
 			fv: mv.Func,
 		}
-		var err error
-		if fd.inNum, fd.reqt, err = validateFunc(funcName, fd.fv, true); err != nil {
+		if err := validateFunc(funcName, fd, true); err != nil {
 			logPanic("gorpc.Dispatcher: %s", err)
 		}
 		funcMap[mv.Name] = fd
@@ -133,29 +194,35 @@ func (d *Dispatcher) AddService(serviceName string, service interface{}) {
 	}
 }
 
-func validateFunc(funcName string, fv reflect.Value, isMethod bool) (inNum int, reqt reflect.Type, err error) {
+func validateFunc(funcName string, fd *funcData, isMethod bool) (err error) {
 	if funcName == "" {
 		err = fmt.Errorf("funcName cannot be empty")
 		return
 	}
 
-	ft := fv.Type()
+	ft := fd.fv.Type()
 	if ft.Kind() != reflect.Func {
 		err = fmt.Errorf("function [%s] must be a function instead of %s", funcName, ft)
 		return
 	}
 
-	inNum = ft.NumIn()
+	inNum := ft.NumIn()
 	outNum := ft.NumOut()
 
 	dt := 0
 	if isMethod {
 		dt = 1
 	}
+	if inNum > dt && ft.In(dt) == contextType {
+		fd.hasCtx = true
+		dt++
+	}
 
 	if inNum == 2+dt {
-		if ft.In(dt).Kind() != reflect.String {
-			err = fmt.Errorf("unexpected type for the first argument of the function [%s]: [%s]. Expected string", funcName, ft.In(dt))
+		if ft.In(dt) == peerInfoType {
+			fd.hasPeer = true
+		} else if ft.In(dt).Kind() != reflect.String {
+			err = fmt.Errorf("unexpected type for the first argument of the function [%s]: [%s]. Expected string or %s", funcName, ft.In(dt), peerInfoType)
 			return
 		}
 	} else if inNum > 2+dt {
@@ -174,8 +241,8 @@ func validateFunc(funcName string, fv reflect.Value, isMethod bool) (inNum int,
 	}
 
 	if inNum > dt {
-		reqt = ft.In(inNum - 1)
-		if err = registerType("request", funcName, reqt); err != nil {
+		fd.reqt = ft.In(inNum - 1)
+		if err = registerType("request", funcName, fd.reqt); err != nil {
 			return
 		}
 	}
@@ -183,12 +250,14 @@ func validateFunc(funcName string, fv reflect.Value, isMethod bool) (inNum int,
 	if outNum > 0 {
 		respt := ft.Out(0)
 		if !isErrorType(respt) {
-			if err = registerType("response", funcName, ft.Out(0)); err != nil {
+			if err = registerType("response", funcName, respt); err != nil {
 				return
 			}
+			fd.respt = respt
 		}
 	}
 
+	fd.inNum = inNum
 	return
 }
 
@@ -307,46 +376,91 @@ func init() {
 //
 // The returned HandlerFunc must be assigned to Server.Handler or
 // passed to New*Server().
+//
+// Use NewHandlerFuncCtx() if functions accepting *PeerInfo are registered.
 func (d *Dispatcher) NewHandlerFunc() HandlerFunc {
 	if len(d.serviceMap) == 0 {
 		logPanic("gorpc.Dispatcher: register at least one service before calling HandlerFunc()")
 	}
+	for serviceName, sd := range d.serviceMap {
+		for funcName, fd := range sd.funcMap {
+			if fd.hasPeer {
+				// HandlerFunc doesn't obtain information about the client
+				// connection from the server.
+				if serviceName != "" {
+					funcName = serviceName + "." + funcName
+				}
+				logPanic("gorpc.Dispatcher: function [%s] accepts *PeerInfo, so it may be served only via NewHandlerFuncCtx()", funcName)
+			}
+		}
+	}
 
 	serviceMap := copyServiceMap(d.serviceMap)
+	interceptors := append([]ServerInterceptor(nil), d.interceptors...)
 
 	return func(clientAddr string, request interface{}) interface{} {
 		req, ok := request.(*dispatcherRequest)
 		if !ok {
 			logPanic("gorpc.Dispatcher: unsupported request type received from the client: %T", request)
 		}
-		return dispatchRequest(serviceMap, clientAddr, req)
+		return dispatchRequest(serviceMap, interceptors, context.Background(), clientAddr, req)
+	}
+}
+
+// NewHandlerFuncCtx returns HandlerFuncCtx serving all the functions and/or
+// services registered via AddFunc() and AddService().
+//
+// Request context is passed to functions and methods accepting
+// context.Context as the first argument.
+//
+// The returned HandlerFuncCtx must be assigned to Server.HandlerCtx.
+func (d *Dispatcher) NewHandlerFuncCtx() HandlerFuncCtx {
+	if len(d.serviceMap) == 0 {
+		logPanic("gorpc.Dispatcher: register at least one service before calling HandlerFuncCtx()")
+	}
+
+	serviceMap := copyServiceMap(d.serviceMap)
+	interceptors := append([]ServerInterceptor(nil), d.interceptors...)
+
+	return func(ctx context.Context, clientAddr string, request interface{}) interface{} {
+		req, ok := request.(*dispatcherRequest)
+		if !ok {
+			logPanic("gorpc.Dispatcher: unsupported request type received from the client: %T", request)
+		}
+		return dispatchRequest(serviceMap, interceptors, ctx, clientAddr, req)
 	}
 }
 
 func copyServiceMap(sm map[string]*serviceData) map[string]*serviceData {
 	serviceMap := make(map[string]*serviceData)
 	for sk, sv := range sm {
-		funcMap := make(map[string]*funcData)
-		for fk, fv := range sv.funcMap {
-			funcMap[fk] = fv
-		}
 		serviceMap[sk] = &serviceData{
 			sv:      sv.sv,
-			funcMap: funcMap,
+			funcMap: copyFuncMap(sv.funcMap),
 		}
 	}
 	return serviceMap
 }
 
-func dispatchRequest(serviceMap map[string]*serviceData, clientAddr string, req *dispatcherRequest) *dispatcherResponse {
-	callName := strings.SplitN(req.Name, ".", 2)
-	if len(callName) != 2 {
+func copyFuncMap(fm map[string]*funcData) map[string]*funcData {
+	funcMap := make(map[string]*funcData)
+	for fk, fv := range fm {
+		// Copy funcData, so SetHandlerTimeout() calls don't affect
+		// already created handlers.
+		fd := *fv
+		funcMap[fk] = &fd
+	}
+	return funcMap
+}
+
+func dispatchRequest(serviceMap map[string]*serviceData, interceptors []ServerInterceptor, ctx context.Context, clientAddr string, req *dispatcherRequest) *dispatcherResponse {
+	serviceName, funcName, ok := splitCallName(req.Name)
+	if !ok {
 		return &dispatcherResponse{
 			Error: fmt.Sprintf("gorpc.Dispatcher: cannot split call name into service name and method name [%s]", req.Name),
 		}
 	}
 
-	serviceName, funcName := callName[0], callName[1]
 	s, ok := serviceMap[serviceName]
 	if !ok {
 		return &dispatcherResponse{
@@ -361,25 +475,102 @@ func dispatchRequest(serviceMap map[string]*serviceData, clientAddr string, req
 		}
 	}
 
+	request, err := decodeJSONPayload(req.Request, fd.reqt)
+	if err != nil {
+		return &dispatcherResponse{
+			Error: fmt.Sprintf("gorpc.Dispatcher: cannot decode request for method [%s]: %s", req.Name, err),
+		}
+	}
+
+	if len(interceptors) == 0 {
+		return newDispatcherResponse(callFuncTimeout(s, fd, ctx, clientAddr, req.Name, request))
+	}
+
+	info := &ServerCallInfo{
+		ClientAddr: clientAddr,
+		Peer:       PeerFromContext(ctx),
+		Service:    serviceName,
+		Method:     funcName,
+		StartTime:  time.Now(),
+	}
+	invoker := func(ctx context.Context, request interface{}) (interface{}, error) {
+		return callFuncTimeout(s, fd, ctx, clientAddr, req.Name, request)
+	}
+	return newDispatcherResponse(chainServerInterceptors(interceptors, info, invoker)(ctx, request))
+}
+
+// callFuncTimeout calls the function with the timeout set via
+// Dispatcher.SetHandlerTimeout.
+//
+// The timeout is applied by the server if it limits the handler duration
+// via Server.HandlerTimeout. Otherwise the function is called in a separate
+// goroutine and abandoned after the timeout.
+func callFuncTimeout(s *serviceData, fd *funcData, ctx context.Context, clientAddr, name string, request interface{}) (interface{}, error) {
+	if fd.timeout <= 0 || setHandlerTimeout(ctx, fd.timeout) {
+		return callFunc(s, fd, ctx, clientAddr, name, request)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type funcResult struct {
+		response interface{}
+		err      error
+	}
+	resultCh := make(chan funcResult, 1)
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		var r funcResult
+		defer func() {
+			if x := recover(); x != nil {
+				stackTrace := make([]byte, 1<<20)
+				n := runtime.Stack(stackTrace, false)
+				r.err = fmt.Errorf("gorpc.Dispatcher: panic occured in method [%s]: %v\nStack trace: %s", name, x, stackTrace[:n])
+			}
+			resultCh <- r
+		}()
+		r.response, r.err = callFunc(s, fd, ctx, clientAddr, name, request)
+	}()
+
+	t := acquireTimer(fd.timeout)
+	defer releaseTimer(t)
+	select {
+	case r := <-resultCh:
+		return r.response, r.err
+	case <-t.C:
+		// Let the server hold the worker slot until the function returns.
+		abandonHandler(ctx, doneCh)
+		return nil, fmt.Errorf("gorpc.Dispatcher: method [%s] didn't return response during timeout=%s", name, fd.timeout)
+	}
+}
+
+func callFunc(s *serviceData, fd *funcData, ctx context.Context, clientAddr, name string, request interface{}) (response interface{}, err error) {
 	var inArgs []reflect.Value
 	if fd.inNum > 0 {
 		inArgs = make([]reflect.Value, fd.inNum)
 
 		dt := 0
-		if serviceName != "" {
+		if s.sv.IsValid() {
 			dt = 1
 			inArgs[0] = s.sv
 		}
+		if fd.hasCtx {
+			inArgs[dt] = reflect.ValueOf(&ctx).Elem()
+			dt++
+		}
 		if fd.inNum == 2+dt {
-			inArgs[dt] = reflect.ValueOf(clientAddr)
+			if fd.hasPeer {
+				inArgs[dt] = reflect.ValueOf(PeerFromContext(ctx))
+			} else {
+				inArgs[dt] = reflect.ValueOf(clientAddr)
+			}
 		}
 		if fd.inNum > dt {
-			reqv := reflect.ValueOf(req.Request)
-			reqt := reflect.TypeOf(req.Request)
+			reqv := reflect.ValueOf(request)
+			reqt := reflect.TypeOf(request)
 			if reqt != fd.reqt {
-				return &dispatcherResponse{
-					Error: fmt.Sprintf("gorpc.Dispatcher: unexpected request type for method [%s]: %s. Expected %s", req.Name, reqt, fd.reqt),
-				}
+				return nil, fmt.Errorf("gorpc.Dispatcher: unexpected request type for method [%s]: %s. Expected %s", name, reqt, fd.reqt)
 			}
 			inArgs[len(inArgs)-1] = reqv
 		}
@@ -387,25 +578,37 @@ func dispatchRequest(serviceMap map[string]*serviceData, clientAddr string, req
 
 	outArgs := fd.fv.Call(inArgs)
 
-	resp := &dispatcherResponse{}
-
 	if len(outArgs) == 1 {
 		if isErrorType(outArgs[0].Type()) {
-			resp.Error = getErrorString(outArgs[0])
+			err = getError(outArgs[0])
 		} else {
-			resp.Response = outArgs[0].Interface()
+			response = outArgs[0].Interface()
 		}
 	} else if len(outArgs) == 2 {
-		resp.Error = getErrorString(outArgs[1])
-		if resp.Error == "" {
-			resp.Response = outArgs[0].Interface()
+		err = getError(outArgs[1])
+		if err == nil {
+			response = outArgs[0].Interface()
 		}
 	}
 
-	return resp
+	return response, err
 }
 
-var errt = reflect.TypeOf((*error)(nil)).Elem()
+func newDispatcherResponse(response interface{}, err error) *dispatcherResponse {
+	if err != nil {
+		return &dispatcherResponse{
+			Error: err.Error(),
+		}
+	}
+	return &dispatcherResponse{
+		Response: response,
+	}
+}
+
+var (
+	errt        = reflect.TypeOf((*error)(nil)).Elem()
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
 
 func isErrorType(t reflect.Type) bool {
 	return t.Implements(errt)
@@ -432,18 +635,22 @@ func supportsGob(t reflect.Type) bool {
 	return false
 }
 
-func getErrorString(v reflect.Value) string {
+func getError(v reflect.Value) error {
 	if v.IsNil() {
-		return ""
+		return nil
 	}
-	return v.Interface().(error).Error()
+	return v.Interface().(error)
 }
 
 // DispatcherClient is a Client wrapper suitable for calling registered
 // functions and/or for calling methods of the registered services.
 type DispatcherClient struct {
-	c           *Client
-	serviceName string
+	c             *Client
+	serviceName   string
+	funcMap       map[string]*funcData
+	retryPolicies map[string]*RetryPolicy
+	hedgePolicies map[string]*HedgePolicy
+	priorities    map[string]Priority
 }
 
 // NewFuncClient returns a client suitable for calling functions registered
@@ -454,7 +661,8 @@ func (d *Dispatcher) NewFuncClient(c *Client) *DispatcherClient {
 	}
 
 	return &DispatcherClient{
-		c: c,
+		c:       c,
+		funcMap: copyFuncMap(d.serviceMap[""].funcMap),
 	}
 }
 
@@ -470,7 +678,61 @@ func (d *Dispatcher) NewServiceClient(serviceName string, c *Client) *Dispatcher
 	return &DispatcherClient{
 		c:           c,
 		serviceName: serviceName,
+		funcMap:     copyFuncMap(d.serviceMap[serviceName].funcMap),
+	}
+}
+
+// SetRetryPolicy sets retry policy for the given function.
+//
+// The policy overrides Client.RetryPolicy for Call, CallTimeout
+// and CallContext calls to the given function. Pass
+// &RetryPolicy{MaxAttempts: 1} for disabling retries for the function.
+//
+// Enable retries only for idempotent functions, since the server may
+// process the same request multiple times.
+//
+// The function must be called before issuing calls via DispatcherClient.
+func (dc *DispatcherClient) SetRetryPolicy(funcName string, p *RetryPolicy) {
+	if dc.retryPolicies == nil {
+		dc.retryPolicies = make(map[string]*RetryPolicy)
 	}
+	dc.retryPolicies[funcName] = p
+}
+
+// SetHedgePolicy sets hedge policy for the given function.
+//
+// Enable hedging only for idempotent (for instance, read-only) functions,
+// since the server may process the same request twice.
+//
+// Hedge policy passed via WithHedgePolicy to DispatcherClient.CallContext
+// overrides the policy set via this function.
+//
+// The function must be called before issuing calls via DispatcherClient.
+func (dc *DispatcherClient) SetHedgePolicy(funcName string, p *HedgePolicy) {
+	if dc.hedgePolicies == nil {
+		dc.hedgePolicies = make(map[string]*HedgePolicy)
+	}
+	dc.hedgePolicies[funcName] = p
+}
+
+// SetPriority sets request priority for the given function.
+//
+// Priority passed via WithPriority to DispatcherClient.CallContext
+// overrides the priority set via this function.
+//
+// The function must be called before issuing calls via DispatcherClient.
+func (dc *DispatcherClient) SetPriority(funcName string, p Priority) {
+	if dc.priorities == nil {
+		dc.priorities = make(map[string]Priority)
+	}
+	dc.priorities[funcName] = p
+}
+
+func (dc *DispatcherClient) getRetryPolicy(funcName string) *RetryPolicy {
+	if p, ok := dc.retryPolicies[funcName]; ok {
+		return p
+	}
+	return dc.c.RetryPolicy
 }
 
 // Call calls the given function with the given request.
@@ -487,8 +749,51 @@ func (dc *DispatcherClient) Call(funcName string, request interface{}) (response
 // via RegisterType() before the first call to this function.
 func (dc *DispatcherClient) CallTimeout(funcName string, request interface{}, timeout time.Duration) (response interface{}, err error) {
 	req := dc.getRequest(funcName, request)
-	resp, err := dc.c.CallTimeout(req, timeout)
-	return getResponse(resp, err)
+	priority := dc.priorities[funcName]
+	hp := dc.hedgePolicies[funcName]
+	p := dc.getRetryPolicy(funcName)
+	if p == nil {
+		resp, err := dc.c.callTimeout(req, timeout, priority, hp)
+		return dc.getResponse(funcName, resp, err)
+	}
+	return p.call(timeout, nil, func(timeout time.Duration) (interface{}, error) {
+		resp, err := dc.c.callTimeout(req, timeout, priority, hp)
+		return dc.getResponse(funcName, resp, err)
+	})
+}
+
+// CallContext calls the given function and waits for response until
+// the given ctx is done.
+//
+// Client.RequestTimeout is used if the ctx has no deadline.
+// The call is canceled on the server if the ctx is done before
+// the response is obtained.
+//
+// All the non-internal request and response types must be registered
+// via RegisterType() before the first call to this function.
+func (dc *DispatcherClient) CallContext(ctx context.Context, funcName string, request interface{}) (response interface{}, err error) {
+	ctx, cancel := dc.c.withRequestTimeout(ctx)
+	defer cancel()
+
+	if hp, ok := dc.hedgePolicies[funcName]; ok && ctx.Value(hedgePolicyKey{}) == nil {
+		ctx = WithHedgePolicy(ctx, hp)
+	}
+	if priority, ok := dc.priorities[funcName]; ok {
+		if _, ok = priorityFromContext(ctx); !ok {
+			ctx = WithPriority(ctx, priority)
+		}
+	}
+
+	req := dc.getRequest(funcName, request)
+	p := dc.getRetryPolicy(funcName)
+	if p == nil {
+		resp, err := dc.c.callContext(ctx, req)
+		return dc.getResponse(funcName, resp, err)
+	}
+	return p.callContext(ctx, func(ctx context.Context) (interface{}, error) {
+		resp, err := dc.c.callContext(ctx, req)
+		return dc.getResponse(funcName, resp, err)
+	})
 }
 
 // Send sends the given request to the given function and doesn't
@@ -498,7 +803,7 @@ func (dc *DispatcherClient) CallTimeout(funcName string, request interface{}, ti
 // before the first call to this function.
 func (dc *DispatcherClient) Send(funcName string, request interface{}) error {
 	req := dc.getRequest(funcName, request)
-	return dc.c.Send(req)
+	return dc.c.send(req, dc.priorities[funcName])
 }
 
 // CallAsync calls the given function asynchronously.
@@ -508,7 +813,7 @@ func (dc *DispatcherClient) Send(funcName string, request interface{}) error {
 func (dc *DispatcherClient) CallAsync(funcName string, request interface{}) (*AsyncResult, error) {
 	req := dc.getRequest(funcName, request)
 
-	innerAr, err := dc.c.CallAsync(req)
+	innerAr, err := dc.c.callAsyncPriority(req, dc.priorities[funcName])
 	if err != nil {
 		return nil, err
 	}
@@ -520,7 +825,8 @@ func (dc *DispatcherClient) CallAsync(funcName string, request interface{}) (*As
 
 	go func() {
 		<-innerAr.Done
-		ar.Response, ar.Error = getResponse(innerAr.Response, innerAr.Error)
+		ar.Response, ar.Error = dc.getResponse(funcName, innerAr.Response, innerAr.Error)
+		ar.Metadata = innerAr.Metadata
 		close(ch)
 	}()
 
@@ -587,8 +893,9 @@ func (b *DispatcherBatch) add(funcName string, request interface{}, skipResponse
 	b.lock.Lock()
 	if !skipResponse {
 		br = &BatchResult{
-			ctx:  b.b.Add(req),
-			done: make(chan struct{}),
+			request: funcName,
+			ctx:     b.b.Add(req),
+			done:    make(chan struct{}),
 		}
 		br.Done = br.done
 		b.ops = append(b.ops, br)
@@ -639,7 +946,7 @@ func (b *DispatcherBatch) CallTimeout(timeout time.Duration) error {
 
 	for _, op := range ops {
 		br := op.ctx.(*BatchResult)
-		op.Response, op.Error = getResponse(br.Response, br.Error)
+		op.Response, op.Error = b.c.getResponse(op.request.(string), br.Response, br.Error)
 		close(op.done)
 	}
 
@@ -653,6 +960,29 @@ func (dc *DispatcherClient) getRequest(funcName string, request interface{}) *di
 	}
 }
 
+// getResponse extracts the response of the given function from respv.
+//
+// Responses received via JSONCodec are decoded into the function
+// result type.
+func (dc *DispatcherClient) getResponse(funcName string, respv interface{}, err error) (interface{}, error) {
+	resp, err := getResponse(respv, err)
+	if err != nil {
+		return nil, err
+	}
+	var respt reflect.Type
+	if fd, ok := dc.funcMap[funcName]; ok {
+		respt = fd.respt
+	}
+	if resp, err = decodeJSONPayload(resp, respt); err != nil {
+		// The server returned the response successfully, while
+		// the client cannot convert it to the function result type.
+		return nil, &ClientError{
+			err: fmt.Errorf("gorpc.DispatcherClient: cannot decode response for [%s]: %s", dc.serviceName+"."+funcName, err),
+		}
+	}
+	return resp, nil
+}
+
 func getResponse(respv interface{}, err error) (interface{}, error) {
 	if err != nil {
 		return nil, err
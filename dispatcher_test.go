@@ -2,9 +2,13 @@ package gorpc
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -920,6 +924,669 @@ func TestDispatcherCallAsync(t *testing.T) {
 	})
 }
 
+func TestDispatcherCallContext(t *testing.T) {
+	d := NewDispatcher()
+
+	d.AddFunc("aaa", func(x int) int { return x })
+	d.AddFunc("slow", func(x int) int {
+		time.Sleep(time.Second)
+		return x
+	})
+
+	testDispatcherFunc(t, d, func(dc *DispatcherClient) {
+		res, err := dc.CallContext(context.Background(), "aaa", 42)
+		if err != nil {
+			t.Fatalf("Unexpected error: [%s]", err)
+		}
+		if res.(int) != 42 {
+			t.Fatalf("Unexpected response: [%v]. Expected [42]", res)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		res, err = dc.CallContext(ctx, "slow", 42)
+		if err == nil {
+			t.Fatalf("Timeout error expected")
+		}
+		if !err.(*ClientError).Timeout {
+			t.Fatalf("Unexpected error: [%s]", err)
+		}
+		if res != nil {
+			t.Fatalf("Unexpected response: [%v]. Expected nil", res)
+		}
+	})
+}
+
+func TestDispatcherHandlerFuncCtx(t *testing.T) {
+	d := NewDispatcher()
+
+	d.AddFunc("Ctx", func(ctx context.Context, x int) (int, error) {
+		if ctx == nil {
+			return 0, fmt.Errorf("nil context")
+		}
+		return x + 1, nil
+	})
+	d.AddFunc("CtxAddr", func(ctx context.Context, clientAddr string, x int) (int, error) {
+		if ctx == nil {
+			return 0, fmt.Errorf("nil context")
+		}
+		if clientAddr == "" {
+			return 0, fmt.Errorf("empty clientAddr")
+		}
+		return x + 2, nil
+	})
+
+	addr := "./dispatcher-ctx-test.sock"
+	s := NewUnixServer(addr, nil)
+	s.HandlerCtx = d.NewHandlerFuncCtx()
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error when starting server: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := NewUnixClient(addr)
+	c.Start()
+	defer c.Stop()
+
+	dc := d.NewFuncClient(c)
+	res, err := dc.Call("Ctx", 10)
+	if err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	if res.(int) != 11 {
+		t.Fatalf("Unexpected response: [%v]. Expected [11]", res)
+	}
+	res, err = dc.Call("CtxAddr", 10)
+	if err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	if res.(int) != 12 {
+		t.Fatalf("Unexpected response: [%v]. Expected [12]", res)
+	}
+}
+
+func TestDispatcherHandlerTimeout(t *testing.T) {
+	d := NewDispatcher()
+
+	sleep := func(ctx context.Context, d time.Duration) error {
+		select {
+		case <-time.After(d):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	d.AddFunc("Extended", func(ctx context.Context, x int) (int, error) {
+		return x, sleep(ctx, 200*time.Millisecond)
+	})
+	d.AddFunc("Shortened", func(ctx context.Context, x int) (int, error) {
+		return x, sleep(ctx, 200*time.Millisecond)
+	})
+	d.SetHandlerTimeout("Extended", time.Second)
+	d.SetHandlerTimeout("Shortened", 10*time.Millisecond)
+
+	service := &testService{}
+	d.AddService("foo", service)
+	d.SetHandlerTimeout("foo.Get", time.Second)
+
+	testPanic(t, func() { d.SetHandlerTimeout("Unknown", time.Second) })
+	testPanic(t, func() { d.SetHandlerTimeout("foo.Unknown", time.Second) })
+
+	addr := "./dispatcher-timeout-test.sock"
+	s := NewUnixServer(addr, nil)
+	s.HandlerCtx = d.NewHandlerFuncCtx()
+	s.HandlerTimeout = 100 * time.Millisecond
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error when starting server: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := NewUnixClient(addr)
+	c.Start()
+	defer c.Stop()
+
+	dc := d.NewFuncClient(c)
+	res, err := dc.Call("Extended", 10)
+	if err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	if res.(int) != 10 {
+		t.Fatalf("Unexpected response: [%v]. Expected [10]", res)
+	}
+	_, err = dc.Call("Shortened", 10)
+	if err == nil || !err.(*ClientError).Timeout {
+		t.Fatalf("Expecting timeout error. Got [%v]", err)
+	}
+
+	dcs := d.NewServiceClient("foo", c)
+	if _, err = dcs.Call("Get", nil); err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+}
+
+func TestDispatcherInterceptors(t *testing.T) {
+	d := NewDispatcher()
+
+	d.AddFunc("Inc", func(x int) (int, error) {
+		if x < 0 {
+			return 0, fmt.Errorf("negative x")
+		}
+		return x + 1, nil
+	})
+	service := &testService{}
+	d.AddService("foo", service)
+
+	var infos []ServerCallInfo
+	var infosLock sync.Mutex
+	d.Use(func(ctx context.Context, info *ServerCallInfo, request interface{}, next ServerInvoker) (interface{}, error) {
+		infosLock.Lock()
+		infos = append(infos, *info)
+		infosLock.Unlock()
+
+		if info.Method == "Inc" {
+			// Rewrite the request and the response.
+			resp, err := next(ctx, request.(int)*10)
+			if err != nil {
+				return nil, fmt.Errorf("intercepted: %s", err)
+			}
+			return resp.(int) * 10, nil
+		}
+		if info.Service == "foo" && info.Method == "Get" {
+			// Short-circuit the call.
+			return 42, nil
+		}
+		return next(ctx, request)
+	})
+
+	var serverRequests []interface{}
+	s := NewUnixServer("./dispatcher-interceptors-test.sock", d.NewHandlerFunc())
+	s.Use(func(ctx context.Context, info *ServerCallInfo, request interface{}, next ServerInvoker) (interface{}, error) {
+		infosLock.Lock()
+		serverRequests = append(serverRequests, request)
+		infosLock.Unlock()
+		return next(ctx, request)
+	})
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error when starting server: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := NewUnixClient(s.Addr)
+	c.Start()
+	defer c.Stop()
+
+	dc := d.NewFuncClient(c)
+	res, err := dc.Call("Inc", 2)
+	if err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	if res.(int) != 210 {
+		t.Fatalf("Unexpected response: [%v]. Expected [210]", res)
+	}
+	_, err = dc.Call("Inc", -1)
+	if err == nil || err.Error() != "intercepted: negative x" {
+		t.Fatalf("Unexpected error: [%v]. Expected [intercepted: negative x]", err)
+	}
+
+	dcs := d.NewServiceClient("foo", c)
+	if _, err = dcs.Call("Add", 5); err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	if res, err = dcs.Call("Get", nil); err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	if res.(int) != 42 {
+		t.Fatalf("Unexpected response: [%v]. Expected [42]", res)
+	}
+	if service.state != 5 {
+		t.Fatalf("Unexpected service state: %d. Expected 5", service.state)
+	}
+
+	infosLock.Lock()
+	defer infosLock.Unlock()
+	expectedNames := []string{".Inc", ".Inc", "foo.Add", "foo.Get"}
+	if len(infos) != len(expectedNames) {
+		t.Fatalf("Unexpected number of intercepted calls: %d. Expected %d", len(infos), len(expectedNames))
+	}
+	for i, info := range infos {
+		if name := info.Service + "." + info.Method; name != expectedNames[i] {
+			t.Fatalf("Unexpected name for call #%d: [%s]. Expected [%s]", i, name, expectedNames[i])
+		}
+		if info.ClientAddr == "" || info.StartTime.IsZero() {
+			t.Fatalf("Unexpected info for call #%d: %+v", i, info)
+		}
+	}
+	expectedRequests := []interface{}{2, -1, 5, nil}
+	if !reflect.DeepEqual(serverRequests, expectedRequests) {
+		t.Fatalf("Unexpected server requests: %v. Expected %v", serverRequests, expectedRequests)
+	}
+}
+
+func TestDispatcherClientInterceptors(t *testing.T) {
+	d := NewDispatcher()
+
+	d.AddFunc("Inc", func(x int) (int, error) {
+		if x < 0 {
+			return 0, fmt.Errorf("negative x")
+		}
+		return x + 1, nil
+	})
+	service := &testService{}
+	d.AddService("foo", service)
+
+	addr := "./dispatcher-client-interceptors-test.sock"
+	s := NewUnixServer(addr, d.NewHandlerFunc())
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error when starting server: [%s]", err)
+	}
+	defer s.Stop()
+
+	var names []string
+	var namesLock sync.Mutex
+	c := NewUnixClient(addr)
+	c.Use(func(ctx context.Context, info *ClientCallInfo, request interface{}, next ClientInvoker) (interface{}, error) {
+		namesLock.Lock()
+		names = append(names, info.Service+"."+info.Method)
+		namesLock.Unlock()
+
+		if info.Service != "" || info.Method != "Inc" {
+			return next(ctx, request)
+		}
+		resp, err := next(ctx, request.(int)*10)
+		if err != nil {
+			return nil, fmt.Errorf("intercepted: %s", err)
+		}
+		if info.Async {
+			// The response is delivered via AsyncResult.
+			return nil, nil
+		}
+		return resp.(int) * 10, nil
+	})
+	c.Start()
+	defer c.Stop()
+
+	dc := d.NewFuncClient(c)
+	res, err := dc.Call("Inc", 2)
+	if err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	if res.(int) != 210 {
+		t.Fatalf("Unexpected response: [%v]. Expected [210]", res)
+	}
+	_, err = dc.Call("Inc", -1)
+	if err == nil || err.Error() != "intercepted: negative x" {
+		t.Fatalf("Unexpected error: [%v]. Expected [intercepted: negative x]", err)
+	}
+
+	ar, err := dc.CallAsync("Inc", 3)
+	if err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	<-ar.Done
+	if ar.Error != nil {
+		t.Fatalf("Unexpected error: [%s]", ar.Error)
+	}
+	if ar.Response.(int) != 31 {
+		t.Fatalf("Unexpected response: [%v]. Expected [31]", ar.Response)
+	}
+
+	dcs := d.NewServiceClient("foo", c)
+	b := dcs.NewBatch()
+	br := b.Add("Add", 5)
+	if err = b.Call(); err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	if br.Error != nil {
+		t.Fatalf("Unexpected error: [%s]", br.Error)
+	}
+	if res, err = dcs.Call("Get", nil); err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	if res.(int) != 5 {
+		t.Fatalf("Unexpected response: [%v]. Expected [5]", res)
+	}
+
+	namesLock.Lock()
+	defer namesLock.Unlock()
+	sort.Strings(names)
+	expectedNames := []string{".Inc", ".Inc", ".Inc", "foo.Add", "foo.Get"}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Fatalf("Unexpected intercepted calls: %v. Expected %v", names, expectedNames)
+	}
+}
+
+func TestDispatcherMetadata(t *testing.T) {
+	d := NewDispatcher()
+
+	d.AddFunc("Tenant", func(ctx context.Context) string {
+		SetResponseMetadata(ctx, "served-by", "Tenant")
+		return RequestMetadata(ctx)["tenant"]
+	})
+
+	addr := "./dispatcher-metadata-test.sock"
+	s := NewUnixServer(addr, nil)
+	s.HandlerCtx = d.NewHandlerFuncCtx()
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error when starting server: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := NewUnixClient(addr)
+	c.Start()
+	defer c.Stop()
+
+	dc := d.NewFuncClient(c)
+
+	var respMD Metadata
+	ctx := WithMetadata(context.Background(), Metadata{"tenant": "foo"})
+	ctx = WithResponseMetadata(ctx, &respMD)
+	res, err := dc.CallContext(ctx, "Tenant", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	if res.(string) != "foo" {
+		t.Fatalf("Unexpected response: [%v]. Expected [foo]", res)
+	}
+	if respMD["served-by"] != "Tenant" {
+		t.Fatalf("Unexpected response metadata: %v", respMD)
+	}
+
+	ar, err := dc.CallAsync("Tenant", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	<-ar.Done
+	if ar.Error != nil {
+		t.Fatalf("Unexpected error: [%s]", ar.Error)
+	}
+	if ar.Response.(string) != "" {
+		t.Fatalf("Unexpected response: [%v]. Expected empty response", ar.Response)
+	}
+	if ar.Metadata["served-by"] != "Tenant" {
+		t.Fatalf("Unexpected response metadata: %v", ar.Metadata)
+	}
+}
+
+func TestDispatcherPeerInfo(t *testing.T) {
+	d := NewDispatcher()
+
+	d.AddFunc("User", func(peer *PeerInfo, x int) (string, error) {
+		if peer == nil {
+			return "", fmt.Errorf("nil peer")
+		}
+		return fmt.Sprintf("%s-%d", peer.Value("user"), x), nil
+	})
+	d.AddFunc("CtxUser", func(ctx context.Context, peer *PeerInfo, x int) (string, error) {
+		if peer != PeerFromContext(ctx) {
+			return "", fmt.Errorf("unexpected peer")
+		}
+		return fmt.Sprintf("%s-%d", peer.Value("user"), x), nil
+	})
+
+	// Functions accepting *PeerInfo cannot be served without request context.
+	testPanic(t, func() { d.NewHandlerFunc() })
+
+	addr := "./dispatcher-peer-test.sock"
+	s := NewUnixServer(addr, nil)
+	s.HandlerCtx = d.NewHandlerFuncCtx()
+	s.OnPeerConnect = func(peer *PeerInfo, conn io.ReadWriteCloser) error {
+		peer.SetValue("user", "foo")
+		return nil
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error when starting server: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := NewUnixClient(addr)
+	c.Start()
+	defer c.Stop()
+
+	dc := d.NewFuncClient(c)
+	res, err := dc.Call("User", 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	if res.(string) != "foo-1" {
+		t.Fatalf("Unexpected response: [%v]. Expected [foo-1]", res)
+	}
+	res, err = dc.Call("CtxUser", 2)
+	if err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	if res.(string) != "foo-2" {
+		t.Fatalf("Unexpected response: [%v]. Expected [foo-2]", res)
+	}
+}
+
+type testJSONRequest struct {
+	Name  string
+	Items []int
+}
+
+type testJSONResponse struct {
+	Greeting string
+	Sum      int
+}
+
+func TestDispatcherJSONCodec(t *testing.T) {
+	d := NewDispatcher()
+
+	d.AddFunc("Greet", func(req *testJSONRequest) (*testJSONResponse, error) {
+		if req.Name == "" {
+			return nil, fmt.Errorf("empty name")
+		}
+		resp := &testJSONResponse{
+			Greeting: "hello, " + req.Name,
+		}
+		for _, n := range req.Items {
+			resp.Sum += n
+		}
+		return resp, nil
+	})
+	d.AddFunc("Double", func(x int) int { return 2 * x })
+	d.AddService("test", &testService{})
+
+	addr := getRandomAddr()
+	s := NewTCPServer(addr, d.NewHandlerFunc())
+	s.Codecs = []Codec{JSONCodec}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error when starting server: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := NewTCPClient(addr)
+	c.Codec = JSONCodec
+	c.Start()
+	defer c.Stop()
+
+	dc := d.NewFuncClient(c)
+	res, err := dc.Call("Greet", &testJSONRequest{Name: "foo", Items: []int{1, 2, 3}})
+	if err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	resp, ok := res.(*testJSONResponse)
+	if !ok {
+		t.Fatalf("Unexpected response type: %T. Expected *testJSONResponse", res)
+	}
+	if resp.Greeting != "hello, foo" || resp.Sum != 6 {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+
+	_, err = dc.Call("Greet", &testJSONRequest{})
+	if err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	if !strings.Contains(err.Error(), "empty name") {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+
+	ar, err := dc.CallAsync("Double", 21)
+	if err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	<-ar.Done
+	if ar.Error != nil {
+		t.Fatalf("Unexpected error: [%s]", ar.Error)
+	}
+	if ar.Response.(int) != 42 {
+		t.Fatalf("Unexpected response: [%v]. Expected [42]", ar.Response)
+	}
+
+	sc := d.NewServiceClient("test", c)
+	if _, err = sc.Call("Add", 5); err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	b := sc.NewBatch()
+	r := b.Add("Get", nil)
+	if err = b.Call(); err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	if r.Error != nil {
+		t.Fatalf("Unexpected error: [%s]", r.Error)
+	}
+	if r.Response.(int) != 5 {
+		t.Fatalf("Unexpected response: [%v]. Expected [5]", r.Response)
+	}
+
+	// The response, which cannot be decoded into the result type
+	// expected by the client, must result in client-side error.
+	cd := NewDispatcher()
+	cd.AddFunc("Double", func(x int) string { return "" })
+	_, err = cd.NewFuncClient(c).Call("Double", 21)
+	if err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	if ce := err.(*ClientError); ce.Server || !strings.Contains(ce.Error(), "cannot decode response") {
+		t.Fatalf("Unexpected error: [%s]. Expecting client-side error", err)
+	}
+}
+
+func TestDispatcherHandlerTimeoutNoServerTimeout(t *testing.T) {
+	d := NewDispatcher()
+
+	releaseChan := make(chan struct{})
+	d.AddFunc("Slow", func(x int) int {
+		<-releaseChan
+		return x
+	})
+	d.AddFunc("Fast", func(x int) int { return x })
+	d.SetHandlerTimeout("Slow", 50*time.Millisecond)
+
+	addr := "./dispatcher-timeout-noserver-test.sock"
+	s := NewUnixServer(addr, nil)
+	s.HandlerCtx = d.NewHandlerFuncCtx()
+	s.Concurrency = 1
+	s.LogError = func(format string, args ...interface{}) {}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error when starting server: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := NewUnixClient(addr)
+	c.Start()
+	defer c.Stop()
+
+	dc := d.NewFuncClient(c)
+	_, err := dc.Call("Slow", 10)
+	if err == nil || !err.(*ClientError).Timeout {
+		t.Fatalf("Expecting timeout error. Got [%v]", err)
+	}
+	if n := s.Stats.Snapshot().HandlerTimeouts; n != 1 {
+		t.Fatalf("Unexpected HandlerTimeouts: %d. Expected 1", n)
+	}
+
+	// The Concurrency slot must be held until the abandoned function returns.
+	_, err = dc.CallTimeout("Fast", 10, 100*time.Millisecond)
+	if err == nil || !err.(*ClientError).Timeout {
+		t.Fatalf("Expecting timeout error. Got [%v]", err)
+	}
+	close(releaseChan)
+	res, err := dc.Call("Fast", 10)
+	if err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	if res.(int) != 10 {
+		t.Fatalf("Unexpected response: [%v]. Expected [10]", res)
+	}
+}
+
+func TestDispatcherHandlerTimeoutHandlerFunc(t *testing.T) {
+	d := NewDispatcher()
+
+	releaseChan := make(chan struct{})
+	defer close(releaseChan)
+	d.AddFunc("Slow", func(x int) int {
+		<-releaseChan
+		return x
+	})
+	d.SetHandlerTimeout("Slow", 50*time.Millisecond)
+
+	addr := "./dispatcher-timeout-handlerfunc-test.sock"
+	s := NewUnixServer(addr, d.NewHandlerFunc())
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error when starting server: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := NewUnixClient(addr)
+	c.Start()
+	defer c.Stop()
+
+	// The timeout must be applied to handlers without request context.
+	dc := d.NewFuncClient(c)
+	_, err := dc.CallTimeout("Slow", 10, time.Second)
+	if err == nil || err.(*ClientError).Timeout {
+		t.Fatalf("Expecting non-timeout error. Got [%v]", err)
+	}
+	if !strings.Contains(err.Error(), "timeout=50ms") {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+}
+
+func TestDispatcherRetryPolicy(t *testing.T) {
+	d := NewDispatcher()
+
+	var flakyCalls, otherCalls uint32
+	d.AddFunc("Flaky", func(x int) (int, error) {
+		if atomic.AddUint32(&flakyCalls, 1) <= 2 {
+			return 0, fmt.Errorf("flaky error")
+		}
+		return x, nil
+	})
+	d.AddFunc("Other", func(x int) (int, error) {
+		atomic.AddUint32(&otherCalls, 1)
+		return 0, fmt.Errorf("other error")
+	})
+
+	testDispatcherFunc(t, d, func(dc *DispatcherClient) {
+		dc.SetRetryPolicy("Flaky", &RetryPolicy{
+			Backoff: ConstantBackoff(time.Millisecond),
+			Retryable: func(err *ClientError) bool {
+				return err.Server
+			},
+		})
+
+		res, err := dc.Call("Flaky", 42)
+		if err != nil {
+			t.Fatalf("Unexpected error: [%s]", err)
+		}
+		if res.(int) != 42 {
+			t.Fatalf("Unexpected response: [%v]. Expected [42]", res)
+		}
+		if n := atomic.LoadUint32(&flakyCalls); n != 3 {
+			t.Fatalf("Unexpected number of attempts: %d. Expected 3", n)
+		}
+
+		if _, err = dc.Call("Other", 42); err == nil {
+			t.Fatalf("Expecting non-nil error")
+		}
+		if n := atomic.LoadUint32(&otherCalls); n != 1 {
+			t.Fatalf("Unexpected number of attempts: %d. Expected 1", n)
+		}
+	})
+}
+
 type testService struct{ state int }
 
 func (s *testService) Inc()         { s.state++ }
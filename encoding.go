@@ -2,9 +2,9 @@ package gorpc
 
 import (
 	"bufio"
-	"compress/flate"
 	"encoding/gob"
 	"io"
+	"time"
 )
 
 // RegisterType registers the given type to send via rpc.
@@ -24,19 +24,66 @@ func RegisterType(x interface{}) {
 type wireRequest struct {
 	ID      uint64
 	Request interface{}
+
+	// CancelID is set to the ID of the previously sent request
+	// the client isn't interested in anymore.
+	// Request is ignored in this case.
+	// It is sent only if capCancel is negotiated during the handshake.
+	CancelID uint64
+
+	// Timeout is the time left until the caller's deadline at the moment
+	// the request has been written. Zero means no deadline.
+	//
+	// Relative timeout is used instead of absolute deadline in order
+	// to be resistant to clock skew between the client and the server.
+	Timeout time.Duration
+
+	// Metadata is optional request metadata set by the client.
+	Metadata Metadata
 }
 
 type wireResponse struct {
 	ID       uint64
 	Response interface{}
 	Error    string
+
+	// Canceled is set if the request has been canceled by the client
+	// before the server started processing it.
+	Canceled bool
+
+	// Timeout is set if the request deadline has been exceeded
+	// on the server.
+	Timeout bool
+
+	// ShuttingDown is set if the request has been rejected, since
+	// the server is shutting down.
+	ShuttingDown bool
+
+	// Rejected is set if the request has been rejected because
+	// of server limits.
+	Rejected bool
+
+	// GoAway is set in the control frame with zero ID, which is sent
+	// by the server to clients supporting control frames.
+	// It means the server doesn't accept new requests on the connection.
+	// Responses for the requests sent before GoAway are still delivered.
+	GoAway bool
+
+	// Metadata is optional response metadata set by the handler.
+	Metadata Metadata
 }
 
 type messageEncoder struct {
-	e  *gob.Encoder
+	e  Encoder
 	bw *bufio.Writer
-	zw *flate.Writer
+	zw CompressWriter
 	ww *bufio.Writer
+
+	// The following fields are set only on framed connections.
+	codec Codec
+	frame *frameBuffer
+	fw    io.Writer
+	reset bool
 }
 
 func (e *messageEncoder) Close() error {
@@ -48,8 +95,10 @@ func (e *messageEncoder) Close() error {
 
 func (e *messageEncoder) Flush() error {
 	if e.zw != nil {
-		if err := e.ww.Flush(); err != nil {
-			return err
+		if e.ww != nil {
+			if err := e.ww.Flush(); err != nil {
+				return err
+			}
 		}
 		if err := e.zw.Flush(); err != nil {
 			return err
@@ -61,32 +110,64 @@ func (e *messageEncoder) Flush() error {
 	return nil
 }
 
+// Encode writes msg to the connection.
+//
+// Returns *frameSizeError if msg exceeds the frame size limit. The connection
+// remains usable in this case.
 func (e *messageEncoder) Encode(msg interface{}) error {
+	if e.frame != nil {
+		return e.encodeFrame(msg)
+	}
 	return e.e.Encode(msg)
 }
 
-func newMessageEncoder(w io.Writer, bufferSize int, enableCompression bool, s *ConnStats) *messageEncoder {
-	w = newWriterCounter(w, s)
+func newMessageEncoder(w io.Writer, bufferSize int, p *connParams, s *ConnStats) *messageEncoder {
+	w = newWriterCounter(newWriterCounter(w, p.stats), s)
 	bw := bufio.NewWriterSize(w, bufferSize)
 
-	ww := bw
-	var zw *flate.Writer
-	if enableCompression {
-		zw, _ = flate.NewWriter(bw, flate.BestSpeed)
-		ww = bufio.NewWriterSize(zw, bufferSize)
+	var zw CompressWriter
+	if p.compressor.Name() != NoCompressor.Name() {
+		zw = p.compressor.NewWriter(bw)
 	}
 
-	return &messageEncoder{
-		e:  gob.NewEncoder(ww),
+	e := &messageEncoder{
 		bw: bw,
 		zw: zw,
-		ww: ww,
 	}
+	if p.framed {
+		// The frame buffer collects the whole message, so frames
+		// are written to the compressor without additional buffering.
+		var fw io.Writer = bw
+		if zw != nil {
+			fw = zw
+		}
+		e.codec = p.codec
+		e.frame = &frameBuffer{
+			maxSize: p.maxSendSize,
+		}
+		e.fw = newUncompressedWriterCounter(newUncompressedWriterCounter(fw, p.stats), s)
+		e.e = p.codec.NewEncoder(e.frame)
+	} else {
+		ww := bw
+		if zw != nil {
+			ww = bufio.NewWriterSize(zw, bufferSize)
+		}
+		e.ww = ww
+		e.e = p.codec.NewEncoder(newUncompressedWriterCounter(newUncompressedWriterCounter(ww, p.stats), s))
+	}
+	return e
 }
 
 type messageDecoder struct {
-	d  *gob.Decoder
+	d  Decoder
 	zr io.ReadCloser
+
+	// The following fields are set only on framed connections.
+	codec        Codec
+	frame        *frameReader
+	maxFrameSize uint32
+	stats        *ConnStats
+	connStats    *ConnStats
 }
 
 func (d *messageDecoder) Close() error {
@@ -96,23 +177,42 @@ func (d *messageDecoder) Close() error {
 	return nil
 }
 
+// Decode reads the next message from the connection into msg.
+//
+// Returns *frameSizeError if the message exceeds the frame size limit.
+// The message is skipped and the connection remains usable in this case.
 func (d *messageDecoder) Decode(msg interface{}) error {
+	if d.frame != nil {
+		return d.decodeFrame(msg)
+	}
 	return d.d.Decode(msg)
 }
 
-func newMessageDecoder(r io.Reader, bufferSize int, enableCompression bool, s *ConnStats) *messageDecoder {
-	r = newReaderCounter(r, s)
+func newMessageDecoder(r io.Reader, bufferSize int, p *connParams, s *ConnStats) *messageDecoder {
+	r = newReaderCounter(newReaderCounter(r, p.stats), s)
 	br := bufio.NewReaderSize(r, bufferSize)
 
 	rr := br
 	var zr io.ReadCloser
-	if enableCompression {
-		zr = flate.NewReader(br)
+	if p.compressor.Name() != NoCompressor.Name() {
+		zr = p.compressor.NewReader(br)
 		rr = bufio.NewReaderSize(zr, bufferSize)
 	}
 
-	return &messageDecoder{
-		d:  gob.NewDecoder(rr),
+	d := &messageDecoder{
 		zr: zr,
 	}
+	if p.framed {
+		d.codec = p.codec
+		d.frame = &frameReader{
+			r: rr,
+		}
+		d.maxFrameSize = p.maxRecvSize
+		d.stats = s
+		d.connStats = p.stats
+		d.d = p.codec.NewDecoder(d.frame)
+	} else {
+		d.d = p.codec.NewDecoder(newUncompressedReaderCounter(newUncompressedReaderCounter(rr, p.stats), s))
+	}
+	return d
 }
@@ -0,0 +1,365 @@
+package gorpc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sync"
+	"time"
+)
+
+// Messages on connections negotiating capFraming during the handshake
+// are sent in length-prefixed frames:
+//
+//     flags byte | id uint64 | size uint32 | payload
+//
+// where id is the request ID the message relates to (zero for control
+// messages and requests without response) and payload
+// contains the message encoded by the connection codec.
+//
+// Frames allow the receiver skipping messages exceeding the size limit
+// without decoding them, while the request ID allows notifying
+// the caller about the skipped message.
+//
+// Frames with frameRaw flag contain raw bytes sent via Client.CallBytes
+// and returned from Server.BytesHandler instead of codec-encoded messages.
+// The payload of raw request frame starts with the request timeout
+// in nanoseconds as uint64.
+
+const frameHeaderSize = 1 + 8 + 4
+
+// Frame flags.
+const (
+	// frameCodecReset is set if the sender created new codec encoder
+	// before encoding the frame payload, so the receiver must create
+	// new codec decoder before decoding it.
+	frameCodecReset = 1 << 0
+
+	// frameRaw is set if the frame payload contains raw bytes.
+	frameRaw = 1 << 1
+
+	// knownFrameFlags contains all the frame flags known to this package.
+	knownFrameFlags = frameCodecReset | frameRaw
+)
+
+// rawMessage is the request sent via Client.CallBytes or the response
+// returned from Server.BytesHandler.
+//
+// rawMessage is passed through the client and the server instead of
+// the request or the response value, so it is written to the frame
+// without encoding.
+type rawMessage struct {
+	B []byte
+}
+
+var rawMessagePool sync.Pool
+
+func acquireRawMessage() *rawMessage {
+	v := rawMessagePool.Get()
+	if v == nil {
+		return &rawMessage{}
+	}
+	return v.(*rawMessage)
+}
+
+func releaseRawMessage(rm *rawMessage) {
+	if cap(rm.B) > maxRetainedFrameSize {
+		return
+	}
+	rm.B = rm.B[:0]
+	rawMessagePool.Put(rm)
+}
+
+// releaseRawRequest releases the raw request of the call, which
+// isn't going to be sent to the server.
+func releaseRawRequest(m *AsyncResult) {
+	if rm, ok := m.request.(*rawMessage); ok {
+		m.request = nil
+		releaseRawMessage(rm)
+	}
+}
+
+// maxRetainedFrameSize is the maximum size of frame buffer retained
+// between messages.
+const maxRetainedFrameSize = 1024 * 1024
+
+// frameSizeError is returned when the message exceeds the frame size limit.
+type frameSizeError struct {
+	// id is the request ID the message relates to.
+	id uint64
+
+	// size is the message size. It is zero if the message has been
+	// rejected before encoding it completely.
+	size    uint32
+	maxSize uint32
+}
+
+func (e *frameSizeError) Error() string {
+	if e.size == 0 {
+		return fmt.Sprintf("the message size exceeds %d bytes", e.maxSize)
+	}
+	return fmt.Sprintf("the message size %d bytes exceeds %d bytes", e.size, e.maxSize)
+}
+
+// frameSizeLimit converts the size limit from Client or Server config
+// to the size limit for frames.
+func frameSizeLimit(n int) uint32 {
+	if n <= 0 || uint64(n) > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(n)
+}
+
+// frameID returns the request ID the message relates to.
+func frameID(msg interface{}) uint64 {
+	switch m := msg.(type) {
+	case wireRequest:
+		return m.ID
+	case *wireRequest:
+		return m.ID
+	case wireResponse:
+		return m.ID
+	case *wireResponse:
+		return m.ID
+	default:
+		return 0
+	}
+}
+
+var errFrameBufferOverflow = errors.New("frame buffer overflow")
+
+// frameBuffer collects the frame payload from the codec encoder.
+//
+// It stops accepting data after the size limit is reached, so oversized
+// messages don't occupy memory.
+type frameBuffer struct {
+	buf      []byte
+	maxSize  uint32
+	overflow bool
+}
+
+func (b *frameBuffer) Write(p []byte) (int, error) {
+	if uint64(len(b.buf)-frameHeaderSize)+uint64(len(p)) > uint64(b.maxSize) {
+		b.overflow = true
+		return 0, errFrameBufferOverflow
+	}
+	b.buf = append(b.buf, p...)
+	return len(p), nil
+}
+
+func (b *frameBuffer) reset() {
+	if cap(b.buf) > maxRetainedFrameSize {
+		b.buf = nil
+	}
+	var hdr [frameHeaderSize]byte
+	b.buf = append(b.buf[:0], hdr[:]...)
+	b.overflow = false
+}
+
+func (e *messageEncoder) encodeFrame(msg interface{}) error {
+	switch m := msg.(type) {
+	case wireRequest:
+		if rm, ok := m.Request.(*rawMessage); ok {
+			return e.encodeRawFrame(m.ID, rm.B, true, m.Timeout)
+		}
+	case wireResponse:
+		if rm, ok := m.Response.(*rawMessage); ok {
+			return e.encodeRawFrame(m.ID, rm.B, false, 0)
+		}
+	}
+
+	id := frameID(msg)
+	fb := e.frame
+	fb.reset()
+	if err := e.e.Encode(msg); err != nil {
+		if !fb.overflow {
+			return err
+		}
+		// The codec encoder may be left in inconsistent state after
+		// the failed Encode call, so start new encoder and notify
+		// the receiver about this in the next frame.
+		e.e = e.codec.NewEncoder(fb)
+		e.reset = true
+		return &frameSizeError{
+			id:      id,
+			maxSize: fb.maxSize,
+		}
+	}
+
+	var flags byte
+	if e.reset {
+		flags |= frameCodecReset
+		e.reset = false
+	}
+	buf := fb.buf
+	buf[0] = flags
+	binary.BigEndian.PutUint64(buf[1:], id)
+	binary.BigEndian.PutUint32(buf[9:], uint32(len(buf)-frameHeaderSize))
+	_, err := e.fw.Write(buf)
+	return err
+}
+
+// encodeRawFrame writes raw bytes directly to the connection buffer
+// without copying them to the frame buffer.
+func (e *messageEncoder) encodeRawFrame(id uint64, b []byte, isRequest bool, timeout time.Duration) error {
+	size := uint64(len(b))
+	if isRequest {
+		size += 8
+	}
+	if size > uint64(e.frame.maxSize) {
+		return &frameSizeError{
+			id:      id,
+			maxSize: e.frame.maxSize,
+		}
+	}
+
+	var hdr [frameHeaderSize + 8]byte
+	hdr[0] = frameRaw
+	binary.BigEndian.PutUint64(hdr[1:], id)
+	binary.BigEndian.PutUint32(hdr[9:], uint32(size))
+	n := frameHeaderSize
+	if isRequest {
+		binary.BigEndian.PutUint64(hdr[n:], uint64(timeout))
+		n += 8
+	}
+	if _, err := e.fw.Write(hdr[:n]); err != nil {
+		return err
+	}
+	_, err := e.fw.Write(b)
+	return err
+}
+
+// frameReader reads the payload of the current frame.
+//
+// It implements io.ByteReader, so codec decoders such as gob don't
+// read past the frame.
+type frameReader struct {
+	r *bufio.Reader
+	n uint32
+
+	// hdr holds the frame header, so it isn't allocated per frame.
+	hdr [frameHeaderSize]byte
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, io.EOF
+	}
+	if uint64(len(p)) > uint64(r.n) {
+		p = p[:r.n]
+	}
+	n, err := r.r.Read(p)
+	r.n -= uint32(n)
+	return n, err
+}
+
+func (r *frameReader) ReadByte() (byte, error) {
+	if r.n == 0 {
+		return 0, io.EOF
+	}
+	c, err := r.r.ReadByte()
+	if err == nil {
+		r.n--
+	}
+	return c, err
+}
+
+// skip discards the unread part of the frame.
+func (r *frameReader) skip() error {
+	if r.n == 0 {
+		return nil
+	}
+	_, err := io.CopyN(ioutil.Discard, r.r, int64(r.n))
+	r.n = 0
+	return err
+}
+
+func (d *messageDecoder) decodeFrame(msg interface{}) error {
+	fr := d.frame
+	hdr := fr.hdr[:]
+	if _, err := io.ReadFull(fr.r, hdr); err != nil {
+		return err
+	}
+	flags := hdr[0]
+	id := binary.BigEndian.Uint64(hdr[1:])
+	size := binary.BigEndian.Uint32(hdr[9:])
+	if flags&^knownFrameFlags != 0 {
+		return fmt.Errorf("unknown frame flags 0x%02x", flags)
+	}
+	fr.n = size
+	n := uint64(frameHeaderSize) + uint64(size)
+	d.stats.addUncompressedBytesRead(n)
+	d.connStats.addUncompressedBytesRead(n)
+
+	if flags&frameCodecReset != 0 {
+		d.d = d.codec.NewDecoder(fr)
+	}
+	if size > d.maxFrameSize {
+		if err := fr.skip(); err != nil {
+			return err
+		}
+		return &frameSizeError{
+			id:      id,
+			size:    size,
+			maxSize: d.maxFrameSize,
+		}
+	}
+
+	if flags&frameRaw != 0 {
+		return d.decodeRawFrame(msg, id)
+	}
+	if err := d.d.Decode(msg); err != nil {
+		return err
+	}
+	return fr.skip()
+}
+
+func (d *messageDecoder) decodeRawFrame(msg interface{}, id uint64) error {
+	fr := d.frame
+	switch m := msg.(type) {
+	case *wireRequest:
+		var buf [8]byte
+		if _, err := io.ReadFull(fr, buf[:]); err != nil {
+			return fmt.Errorf("cannot read raw request timeout: [%s]", err)
+		}
+		rm, err := readRawMessage(fr)
+		if err != nil {
+			return err
+		}
+		*m = wireRequest{
+			ID:      id,
+			Request: rm,
+			Timeout: time.Duration(binary.BigEndian.Uint64(buf[:])),
+		}
+		return nil
+	case *wireResponse:
+		rm, err := readRawMessage(fr)
+		if err != nil {
+			return err
+		}
+		*m = wireResponse{
+			ID:       id,
+			Response: rm,
+		}
+		return nil
+	default:
+		return fmt.Errorf("unexpected raw frame for %T", msg)
+	}
+}
+
+func readRawMessage(fr *frameReader) (*rawMessage, error) {
+	rm := acquireRawMessage()
+	n := int(fr.n)
+	if cap(rm.B) < n {
+		rm.B = make([]byte, n)
+	}
+	rm.B = rm.B[:n]
+	if _, err := io.ReadFull(fr, rm.B); err != nil {
+		return nil, fmt.Errorf("cannot read raw frame payload: [%s]", err)
+	}
+	return rm, nil
+}
@@ -0,0 +1,395 @@
+package gorpc
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaxRequestSize(t *testing.T) {
+	s := &Server{
+		Addr:           getRandomAddr(),
+		Handler:        echoHandler,
+		Codecs:         []Codec{JSONCodec},
+		MaxRequestSize: 1024,
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	for _, codec := range []Codec{GobCodec, JSONCodec} {
+		for _, disableCompression := range []bool{false, true} {
+			c := &Client{
+				Addr:               s.Addr,
+				Codec:              codec,
+				DisableCompression: disableCompression,
+			}
+			c.Start()
+			testMaxRequestSize(t, c)
+			c.Stop()
+		}
+	}
+}
+
+func testMaxRequestSize(t *testing.T, c *Client) {
+	// The oversized request goes first, so the codec must be reset
+	// after dropping type information sent with it.
+	_, err := c.Call(strings.Repeat("x", 2048))
+	if err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	if !err.(*ClientError).Rejected {
+		t.Fatalf("unexpected error: [%s]. Expecting rejected error", err)
+	}
+	if !strings.Contains(err.Error(), "Server.MaxRequestSize=1024") {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+
+	// The connection must remain usable.
+	for i := 0; i < 3; i++ {
+		if _, err = c.Call("foobar"); err != nil {
+			t.Fatalf("unexpected error: [%s]", err)
+		}
+	}
+	if n := c.Stats.Snapshot().OversizedMessages; n != 1 {
+		t.Fatalf("unexpected OversizedMessages: %d. Expected 1", n)
+	}
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	s := &Server{
+		Addr: getRandomAddr(),
+		Handler: func(clientAddr string, request interface{}) interface{} {
+			return strings.Repeat("x", request.(int))
+		},
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := &Client{
+		Addr:            s.Addr,
+		MaxResponseSize: 1024,
+	}
+	c.Start()
+	defer c.Stop()
+
+	_, err := c.Call(2048)
+	if err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	if !err.(*ClientError).Server {
+		t.Fatalf("unexpected error: [%s]. Expecting server error", err)
+	}
+	if !strings.Contains(err.Error(), "Client.MaxResponseSize=1024") {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+
+	// The connection must remain usable.
+	for i := 0; i < 3; i++ {
+		resp, err := c.Call(10)
+		if err != nil {
+			t.Fatalf("unexpected error: [%s]", err)
+		}
+		if resp.(string) != strings.Repeat("x", 10) {
+			t.Fatalf("unexpected response: %q", resp)
+		}
+	}
+	if n := s.Stats.Snapshot().OversizedMessages; n != 1 {
+		t.Fatalf("unexpected OversizedMessages: %d. Expected 1", n)
+	}
+}
+
+func TestMaxRequestSizeMisbehavingClient(t *testing.T) {
+	s := &Server{
+		Addr:           getRandomAddr(),
+		Handler:        echoHandler,
+		MaxRequestSize: 1024,
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	conn, err := net.DialTimeout("tcp", s.Addr, time.Second)
+	if err != nil {
+		t.Fatalf("cannot establish connection to [%s]: [%s]", s.Addr, err)
+	}
+	defer conn.Close()
+
+	c := &Client{
+		Codec:              GobCodec,
+		DisableCompression: true,
+	}
+	p, err := clientHandshake(c, conn, false)
+	if err != nil {
+		t.Fatalf("unexpected handshake error: [%s]", err)
+	}
+	if !p.framed || p.maxSendSize != 1024 {
+		t.Fatalf("unexpected connection params: framed=%v, maxSendSize=%d", p.framed, p.maxSendSize)
+	}
+
+	// Send the oversized request ignoring the server limit. Type information
+	// is sent with the first request, so the server must be able to decode
+	// requests after skipping the oversized one.
+	p.maxSendSize = frameSizeLimit(0)
+	p.stats = &ConnStats{}
+	var stats ConnStats
+	e := newMessageEncoder(conn, DefaultBufferSize, p, &stats)
+	for i, request := range []string{"foo", strings.Repeat("x", 2048), "bar"} {
+		if err := e.Encode(wireRequest{ID: uint64(i + 1), Request: request}); err != nil {
+			t.Fatalf("cannot send request: [%s]", err)
+		}
+	}
+	if err := e.Flush(); err != nil {
+		t.Fatalf("cannot flush requests: [%s]", err)
+	}
+
+	responses := make(map[uint64]wireResponse)
+	d := newMessageDecoder(conn, DefaultBufferSize, p, &stats)
+	for i := 0; i < 3; i++ {
+		var wr wireResponse
+		if err := d.Decode(&wr); err != nil {
+			t.Fatalf("cannot decode response: [%s]", err)
+		}
+		responses[wr.ID] = wr
+	}
+	if wr := responses[1]; wr.Error != "" || wr.Response != "foo" {
+		t.Fatalf("unexpected response: %+v", wr)
+	}
+	if wr := responses[2]; !wr.Rejected || !strings.Contains(wr.Error, "Server.MaxRequestSize=1024") {
+		t.Fatalf("unexpected response: %+v", wr)
+	}
+	if wr := responses[3]; wr.Error != "" || wr.Response != "bar" {
+		t.Fatalf("unexpected response: %+v", wr)
+	}
+	if n := s.Stats.Snapshot().OversizedMessages; n != 1 {
+		t.Fatalf("unexpected OversizedMessages: %d. Expected 1", n)
+	}
+}
+
+func TestMaxRequestSizeLegacyHandshake(t *testing.T) {
+	s := &Server{
+		Addr:           getRandomAddr(),
+		Handler:        echoHandler,
+		MaxRequestSize: 1024,
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	// The limit isn't enforced for legacy clients without framing.
+	c := &Client{
+		Addr:            s.Addr,
+		LegacyHandshake: true,
+	}
+	c.Start()
+	defer c.Stop()
+
+	request := strings.Repeat("x", 2048)
+	resp, err := c.Call(request)
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	if resp.(string) != request {
+		t.Fatalf("unexpected response")
+	}
+}
+
+func TestCallBytes(t *testing.T) {
+	s := &Server{
+		Addr:    getRandomAddr(),
+		Handler: echoHandler,
+		BytesHandler: func(clientAddr string, request, dst []byte) []byte {
+			dst = append(dst, "response:"...)
+			return append(dst, request...)
+		},
+		Codecs: []Codec{JSONCodec},
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	for _, codec := range []Codec{GobCodec, JSONCodec} {
+		for _, disableCompression := range []bool{false, true} {
+			c := &Client{
+				Addr:               s.Addr,
+				Codec:              codec,
+				DisableCompression: disableCompression,
+			}
+			c.Start()
+			testCallBytes(t, c)
+			c.Stop()
+		}
+	}
+}
+
+func testCallBytes(t *testing.T, c *Client) {
+	var dst []byte
+	for i := 0; i < 10; i++ {
+		request := []byte(fmt.Sprintf("request %d", i))
+		response, err := c.CallBytes(dst[:0], request)
+		if err != nil {
+			t.Fatalf("unexpected error: [%s]", err)
+		}
+		if string(response) != "response:"+string(request) {
+			t.Fatalf("unexpected response: %q. Expected %q", response, "response:"+string(request))
+		}
+		dst = response
+
+		// Raw calls may be mixed with usual calls on the same connection.
+		resp, err := c.Call(i)
+		if err != nil {
+			t.Fatalf("unexpected error: [%s]", err)
+		}
+		if _, ok := resp.(int); !ok && c.Codec == GobCodec {
+			t.Fatalf("unexpected response: %v", resp)
+		}
+	}
+
+	// The response must be appended to dst.
+	response, err := c.CallBytes([]byte("prefix:"), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	if string(response) != "prefix:response:" {
+		t.Fatalf("unexpected response: %q. Expected %q", response, "prefix:response:")
+	}
+}
+
+func TestCallBytesNoBytesHandler(t *testing.T) {
+	s := &Server{
+		Addr:    getRandomAddr(),
+		Handler: echoHandler,
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := &Client{
+		Addr: s.Addr,
+	}
+	c.Start()
+	defer c.Stop()
+
+	_, err := c.CallBytes(nil, []byte("foobar"))
+	if err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	if !err.(*ClientError).Server || !strings.Contains(err.Error(), "Server.BytesHandler") {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+}
+
+func TestCallBytesPanic(t *testing.T) {
+	s := &Server{
+		Addr:    getRandomAddr(),
+		Handler: echoHandler,
+		BytesHandler: func(clientAddr string, request, dst []byte) []byte {
+			if string(request) == "panic" {
+				panic("foobar")
+			}
+			return append(dst, request...)
+		},
+		LogError: func(format string, args ...interface{}) {},
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := &Client{
+		Addr: s.Addr,
+	}
+	c.Start()
+	defer c.Stop()
+
+	if _, err := c.CallBytes(nil, []byte("panic")); err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	response, err := c.CallBytes(nil, []byte("foobar"))
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	if string(response) != "foobar" {
+		t.Fatalf("unexpected response: %q. Expected %q", response, "foobar")
+	}
+}
+
+func TestCallBytesMaxSize(t *testing.T) {
+	s := &Server{
+		Addr:           getRandomAddr(),
+		Handler:        echoHandler,
+		BytesHandler:   echoBytesHandler,
+		MaxRequestSize: 1024,
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := &Client{
+		Addr:            s.Addr,
+		MaxResponseSize: 512,
+	}
+	c.Start()
+	defer c.Stop()
+
+	_, err := c.CallBytes(nil, make([]byte, 2048))
+	if err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	if !err.(*ClientError).Rejected {
+		t.Fatalf("unexpected error: [%s]. Expecting rejected error", err)
+	}
+
+	_, err = c.CallBytes(nil, make([]byte, 768))
+	if err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	if !strings.Contains(err.Error(), "Client.MaxResponseSize=512") {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+
+	response, err := c.CallBytes(nil, []byte("foobar"))
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	if string(response) != "foobar" {
+		t.Fatalf("unexpected response: %q. Expected %q", response, "foobar")
+	}
+}
+
+func TestCallBytesLegacyHandshake(t *testing.T) {
+	s := &Server{
+		Addr:         getRandomAddr(),
+		Handler:      echoHandler,
+		BytesHandler: echoBytesHandler,
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := &Client{
+		Addr:            s.Addr,
+		LegacyHandshake: true,
+	}
+	c.Start()
+	defer c.Stop()
+
+	_, err := c.CallBytes(nil, []byte("foobar"))
+	if err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	if !strings.Contains(err.Error(), "Client.LegacyHandshake") {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+}
@@ -0,0 +1,511 @@
+package gorpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// The client starts the versioned handshake with handshakeMagic followed
+// by the protocol version, the capability bitmap and the capability payload:
+//
+//     magic [5]byte | version byte | caps uint64 | payloadLen uint32 | payload
+//
+// The payload contains data for the capabilities set in the bitmap
+// in the increasing order of capability bits. The server stops parsing
+// the payload at the first capability it doesn't know, so new capabilities
+// may be added without breaking deployed servers.
+//
+// The server replies with:
+//
+//     magic [5]byte | version byte | caps uint64 | data for caps
+//
+// where version is the protocol version chosen by the server and caps
+// contains capabilities supported by both the client and the server.
+// The data for caps is written in the increasing order of capability bits.
+//
+// The server rejects the handshake by replying with zero version followed
+// by the error message:
+//
+//     magic [5]byte | 0 | messageLen uint16 | message
+//
+// Clients using the legacy handshake send a single byte with
+// handshakeCompression and handshakeControlFrames flags instead.
+// The server doesn't reply to the legacy handshake.
+
+// handshakeMagic starts the versioned handshake.
+//
+// The first byte of the magic differs from all the valid legacy
+// handshake bytes, so the server may distinguish between the legacy
+// and the versioned handshake.
+const handshakeMagic = "gorpc"
+
+const (
+	// protocolVersion is the latest protocol version supported
+	// by Client and Server.
+	protocolVersion = 1
+
+	// minProtocolVersion is the oldest protocol version supported
+	// by Client and Server.
+	minProtocolVersion = 1
+)
+
+// Capabilities negotiated during the versioned handshake.
+const (
+	// capControlFrames is set if the client understands control frames
+	// such as GOAWAY sent by the server.
+	capControlFrames = 1 << 0
+
+	// capCodec is set if the client uses codec other than GobCodec.
+	// The payload contains the codec name. See appendCodecName.
+	capCodec = 1 << 1
+
+	// capCompressors is set if the client advertises compressors.
+	// The payload contains compressor names. See appendCompressorNames.
+	// The reply contains the index of the compressor chosen by the server.
+	capCompressors = 1 << 2
+
+	// capFraming is set if the client sends and accepts messages
+	// in length-prefixed frames. See framing.go.
+	// The payload contains Client.MaxResponseSize as uint32.
+	// The reply contains Server.MaxRequestSize as uint32.
+	// Zero size means no limit.
+	capFraming = 1 << 3
+
+	// capCancel is set if the client sends cancellation notifications
+	// for requests canceled via AsyncResult.Cancel. See wireRequest.CancelID.
+	// Old servers treat such notifications as usual requests,
+	// so the client sends them only if the server acknowledges capCancel.
+	capCancel = 1 << 4
+
+	// knownCaps contains all the capabilities known to this package.
+	knownCaps = capControlFrames | capCodec | capCompressors | capFraming | capCancel
+)
+
+// Flags sent by the client in the legacy one-byte handshake.
+const (
+	// handshakeCompression is set if the client enables flate compression.
+	handshakeCompression = 1 << 0
+
+	// handshakeControlFrames is set if the client understands control
+	// frames such as GOAWAY sent by the server.
+	handshakeControlFrames = 1 << 1
+)
+
+// maxHandshakePayloadSize is the maximum size of the capability payload
+// accepted by the server.
+const maxHandshakePayloadSize = 1 << 17
+
+const legacyServerHint = "The server may not support versioned handshake. Set Client.LegacyHandshake for connecting to such servers"
+
+// legacyServerError is returned from the versioned handshake if the server
+// closed the connection or replied with unexpected data, so it may be
+// an old server, which doesn't support the versioned handshake.
+type legacyServerError struct {
+	err error
+}
+
+func (e *legacyServerError) Error() string {
+	return e.err.Error()
+}
+
+// isConnReset returns true if err means the connection has been reset
+// by the peer, i.e. the peer closed the connection without reading
+// all the data sent to it.
+func isConnReset(err error) bool {
+	if oe, ok := err.(*net.OpError); ok {
+		err = oe.Err
+	}
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+	return err == syscall.ECONNRESET
+}
+
+// connParams contains connection parameters negotiated during the handshake.
+type connParams struct {
+	codec      Codec
+	compressor Compressor
+
+	// framed is set if messages are sent in length-prefixed frames.
+	framed bool
+
+	// maxSendSize and maxRecvSize are the maximum sizes of frames
+	// sent and received over the connection.
+	maxSendSize uint32
+	maxRecvSize uint32
+
+	// cancel is set if the server accepts cancellation notifications.
+	cancel bool
+
+	// stats contains statistics of the connection. It is set
+	// after the handshake.
+	stats *ConnStats
+}
+
+// clientHandshakeTimeout performs the handshake with the server at addr.
+//
+// The legacy handshake is used if Client.LegacyHandshake is set or
+// if the server at addr looks like an old server. See Client.LegacyHandshake.
+//
+// Returns parameters for the connection.
+func clientHandshakeTimeout(c *Client, addr string, conn io.ReadWriteCloser, stopChan <-chan struct{}) (*connParams, error) {
+	type handshakeResult struct {
+		p   *connParams
+		err error
+	}
+	legacy := c.LegacyHandshake || c.isLegacyServer(addr)
+	ch := make(chan handshakeResult, 1)
+	go func() {
+		p, err := clientHandshake(c, conn, legacy)
+		ch <- handshakeResult{p, err}
+	}()
+
+	t := acquireTimer(c.HandshakeTimeout)
+	defer releaseTimer(t)
+	select {
+	case r := <-ch:
+		if _, ok := r.err.(*legacyServerError); ok {
+			if c.Codec.Name() != GobCodec.Name() {
+				return nil, fmt.Errorf("%s. The server may not support versioned handshake required by Client.Codec %q", r.err, c.Codec.Name())
+			}
+			c.setLegacyServer(addr, true)
+			return nil, fmt.Errorf("%s. The server may not support versioned handshake, so the legacy handshake will be used for the next connection", r.err)
+		}
+		return r.p, r.err
+	case <-stopChan:
+		conn.Close()
+		<-ch
+		return nil, errors.New("the client has been stopped during the handshake")
+	case <-t.C:
+		conn.Close()
+		<-ch
+		return nil, fmt.Errorf("the server didn't reply to the handshake during %s. %s", c.HandshakeTimeout, legacyServerHint)
+	}
+}
+
+func clientHandshake(c *Client, conn io.ReadWriter, legacy bool) (*connParams, error) {
+	if legacy {
+		// Old servers enable compression if the handshake byte is non-zero,
+		// so control frames' support is advertised only together
+		// with compression.
+		var buf [1]byte
+		p := &connParams{
+			codec:      GobCodec,
+			compressor: NoCompressor,
+		}
+		if !c.DisableCompression {
+			buf[0] = handshakeCompression | handshakeControlFrames
+			p.compressor = FlateCompressor
+		}
+		if _, err := conn.Write(buf[:]); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+
+	compressors := c.Compressors
+	if compressors == nil {
+		compressors = []Compressor{FlateCompressor}
+	}
+
+	caps := uint64(capControlFrames)
+	var payload []byte
+	if c.Codec.Name() != GobCodec.Name() {
+		caps |= capCodec
+		payload = appendCodecName(payload, c.Codec)
+	}
+	if !c.DisableCompression {
+		caps |= capCompressors
+		payload = appendCompressorNames(payload, compressors)
+	}
+	caps |= capFraming
+	payload = appendUint32(payload, frameSizeLimit(c.MaxResponseSize))
+	caps |= capCancel
+
+	buf := make([]byte, 0, len(handshakeMagic)+1+8+4+len(payload))
+	buf = append(buf, handshakeMagic...)
+	buf = append(buf, protocolVersion)
+	buf = appendUint64(buf, caps)
+	buf = appendUint32(buf, uint32(len(payload)))
+	buf = append(buf, payload...)
+	if _, err := conn.Write(buf); err != nil {
+		return nil, err
+	}
+
+	return readServerHandshake(c, conn, caps, compressors)
+}
+
+func readServerHandshake(c *Client, r io.Reader, caps uint64, compressors []Compressor) (*connParams, error) {
+	var hdr [len(handshakeMagic) + 1]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF || isConnReset(err) {
+			// Old servers close the connection after failing to decode
+			// the versioned handshake as a request.
+			return nil, &legacyServerError{fmt.Errorf("cannot read handshake reply: [%s]", err)}
+		}
+		return nil, fmt.Errorf("cannot read handshake reply: [%s]", err)
+	}
+	if string(hdr[:len(handshakeMagic)]) != handshakeMagic {
+		return nil, &legacyServerError{fmt.Errorf("unexpected handshake reply %q", hdr[:])}
+	}
+
+	version := hdr[len(handshakeMagic)]
+	if version == 0 {
+		msg, err := readHandshakeMessage(r)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read handshake rejection message: [%s]", err)
+		}
+		return nil, fmt.Errorf("the server rejected the handshake: [%s]", msg)
+	}
+	if version < minProtocolVersion || version > protocolVersion {
+		return nil, fmt.Errorf("the server chose unsupported protocol version %d. Supported versions: %d-%d", version, minProtocolVersion, protocolVersion)
+	}
+
+	var capsBuf [8]byte
+	if _, err := io.ReadFull(r, capsBuf[:]); err != nil {
+		return nil, fmt.Errorf("cannot read capabilities from handshake reply: [%s]", err)
+	}
+	serverCaps := binary.BigEndian.Uint64(capsBuf[:])
+	if serverCaps&^caps != 0 {
+		return nil, fmt.Errorf("the server replied with unexpected capabilities 0x%x. Expected a subset of 0x%x", serverCaps, caps)
+	}
+	if caps&capCodec != 0 && serverCaps&capCodec == 0 {
+		return nil, fmt.Errorf("the server doesn't support codec %q", c.Codec.Name())
+	}
+
+	p := &connParams{
+		codec:       c.Codec,
+		compressor:  NoCompressor,
+		maxSendSize: frameSizeLimit(0),
+		maxRecvSize: frameSizeLimit(c.MaxResponseSize),
+	}
+	if serverCaps&capCompressors != 0 {
+		var err error
+		if p.compressor, err = readCompressorReply(r, compressors); err != nil {
+			return nil, err
+		}
+	}
+	if serverCaps&capFraming != 0 {
+		var buf [4]byte
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return nil, fmt.Errorf("cannot read the maximum request size from handshake reply: [%s]", err)
+		}
+		p.framed = true
+		if n := binary.BigEndian.Uint32(buf[:]); n != 0 {
+			p.maxSendSize = n
+		}
+	}
+	p.cancel = (serverCaps&capCancel != 0)
+	return p, nil
+}
+
+// serverHandshake contains the handshake obtained from the client.
+type serverHandshake struct {
+	// legacy is set for the legacy one-byte handshake.
+	legacy            bool
+	legacyCompression bool
+
+	// version is the protocol version sent by the client and then
+	// the protocol version chosen by the server.
+	// It is zero for the legacy handshake.
+	version byte
+
+	caps            uint64
+	codecName       string
+	compressorNames []string
+	maxResponseSize uint32
+}
+
+// readClientHandshake reads the legacy or versioned handshake
+// sent by the client.
+func readClientHandshake(r io.Reader) (*serverHandshake, error) {
+	var buf [1]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return nil, err
+	}
+
+	if buf[0] != handshakeMagic[0] {
+		if buf[0]&^(handshakeCompression|handshakeControlFrames) != 0 {
+			return nil, fmt.Errorf("unknown legacy handshake byte 0x%02x", buf[0])
+		}
+		hs := &serverHandshake{
+			legacy:            true,
+			legacyCompression: (buf[0]&handshakeCompression != 0),
+		}
+		if buf[0]&handshakeControlFrames != 0 {
+			hs.caps |= capControlFrames
+		}
+		return hs, nil
+	}
+
+	var hdr [len(handshakeMagic) - 1 + 1 + 8 + 4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := len(handshakeMagic) - 1
+	if string(hdr[:n]) != handshakeMagic[1:] {
+		return nil, fmt.Errorf("invalid handshake magic %q. Expected %q", append(buf[:], hdr[:n]...), handshakeMagic)
+	}
+	hs := &serverHandshake{
+		version: hdr[n],
+		caps:    binary.BigEndian.Uint64(hdr[n+1:]),
+	}
+	payloadSize := binary.BigEndian.Uint32(hdr[n+9:])
+	if payloadSize > maxHandshakePayloadSize {
+		return nil, fmt.Errorf("too big handshake payload: %d bytes. It mustn't exceed %d bytes", payloadSize, maxHandshakePayloadSize)
+	}
+	payload := make([]byte, payloadSize)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	// Parse the payload for known capabilities only. The first unknown
+	// capability and all the capabilities after it are dropped, so they
+	// aren't acknowledged to the client.
+	pr := bytes.NewReader(payload)
+	for bit := uint(0); bit < 64; bit++ {
+		c := uint64(1) << bit
+		if hs.caps&c == 0 {
+			continue
+		}
+		if knownCaps&c == 0 {
+			hs.caps &= c - 1
+			break
+		}
+		var err error
+		switch c {
+		case capCodec:
+			hs.codecName, err = readHandshakeName(pr)
+		case capCompressors:
+			hs.compressorNames, err = readCompressorNames(pr)
+		case capFraming:
+			var buf [4]byte
+			if _, err = io.ReadFull(pr, buf[:]); err == nil {
+				hs.maxResponseSize = binary.BigEndian.Uint32(buf[:])
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse handshake payload: [%s]", err)
+		}
+	}
+	return hs, nil
+}
+
+// acceptHandshake selects parameters for the connection according
+// to the handshake obtained from the client and sends the reply
+// to the client.
+func (s *Server) acceptHandshake(w io.Writer, hs *serverHandshake) (*connParams, error) {
+	p := &connParams{
+		codec:       GobCodec,
+		compressor:  NoCompressor,
+		maxSendSize: frameSizeLimit(0),
+		maxRecvSize: frameSizeLimit(s.MaxRequestSize),
+	}
+	if hs.legacy {
+		if hs.legacyCompression {
+			p.compressor = s.getLegacyCompressor()
+		}
+		return p, nil
+	}
+
+	if hs.version < minProtocolVersion {
+		err := fmt.Errorf("unsupported protocol version %d. Supported versions: %d-%d", hs.version, minProtocolVersion, protocolVersion)
+		writeHandshakeRejection(w, err.Error())
+		return nil, err
+	}
+	if hs.version > protocolVersion {
+		hs.version = protocolVersion
+	}
+
+	if hs.caps&capCodec != 0 {
+		if p.codec = s.getCodec(hs.codecName); p.codec == nil {
+			err := fmt.Errorf("unsupported codec %q", hs.codecName)
+			writeHandshakeRejection(w, err.Error())
+			return nil, err
+		}
+	}
+
+	buf := make([]byte, 0, len(handshakeMagic)+1+8+1+4)
+	buf = append(buf, handshakeMagic...)
+	buf = append(buf, hs.version)
+	buf = appendUint64(buf, hs.caps)
+
+	if hs.caps&capCompressors != 0 {
+		var n byte
+		p.compressor, n = s.getCompressor(hs.compressorNames)
+		buf = append(buf, n)
+	}
+	if hs.caps&capFraming != 0 {
+		p.framed = true
+		if hs.maxResponseSize != 0 {
+			p.maxSendSize = hs.maxResponseSize
+		}
+		buf = appendUint32(buf, p.maxRecvSize)
+	}
+	p.cancel = (hs.caps&capCancel != 0)
+
+	if _, err := w.Write(buf); err != nil {
+		return nil, fmt.Errorf("cannot send handshake reply: [%s]", err)
+	}
+	return p, nil
+}
+
+func writeHandshakeRejection(w io.Writer, msg string) {
+	if len(msg) > 0xffff {
+		msg = msg[:0xffff]
+	}
+	buf := make([]byte, 0, len(handshakeMagic)+1+2+len(msg))
+	buf = append(buf, handshakeMagic...)
+	buf = append(buf, 0)
+	buf = append(buf, byte(len(msg)>>8), byte(len(msg)))
+	buf = append(buf, msg...)
+	w.Write(buf)
+}
+
+func readHandshakeMessage(r io.Reader) (string, error) {
+	var n [2]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return "", err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return "", err
+	}
+	return string(msg), nil
+}
+
+func appendHandshakeName(dst []byte, name string) []byte {
+	dst = append(dst, byte(len(name)))
+	return append(dst, name...)
+}
+
+// readHandshakeName reads the name sent by appendHandshakeName.
+func readHandshakeName(r io.Reader) (string, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return "", err
+	}
+	name := make([]byte, n[0])
+	if _, err := io.ReadFull(r, name); err != nil {
+		return "", err
+	}
+	return string(name), nil
+}
+
+func appendUint64(dst []byte, n uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], n)
+	return append(dst, buf[:]...)
+}
+
+func appendUint32(dst []byte, n uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], n)
+	return append(dst, buf[:]...)
+}
@@ -0,0 +1,263 @@
+package gorpc
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func startProtocolVersionServer(t *testing.T) *Server {
+	return startTestServer(t, &Server{
+		HandlerCtx: func(ctx context.Context, clientAddr string, request interface{}) interface{} {
+			return PeerFromContext(ctx).ProtocolVersion
+		},
+	})
+}
+
+func TestHandshakeVersioned(t *testing.T) {
+	s := startProtocolVersionServer(t)
+	defer s.Stop()
+
+	for _, disableCompression := range []bool{false, true} {
+		c := &Client{
+			Addr:               s.Addr,
+			DisableCompression: disableCompression,
+		}
+		c.Start()
+		resp, err := c.Call(0)
+		c.Stop()
+		if err != nil {
+			t.Fatalf("Unexpected error: [%s]", err)
+		}
+		if resp.(int) != protocolVersion {
+			t.Fatalf("Unexpected protocol version: %d. Expected %d", resp, protocolVersion)
+		}
+	}
+}
+
+func TestHandshakeLegacy(t *testing.T) {
+	s := startProtocolVersionServer(t)
+	defer s.Stop()
+
+	for _, disableCompression := range []bool{false, true} {
+		c := &Client{
+			Addr:               s.Addr,
+			DisableCompression: disableCompression,
+			LegacyHandshake:    true,
+		}
+		c.Start()
+		resp, err := c.Call(0)
+		c.Stop()
+		if err != nil {
+			t.Fatalf("Unexpected error: [%s]", err)
+		}
+		if resp.(int) != 0 {
+			t.Fatalf("Unexpected protocol version: %d. Expected 0", resp)
+		}
+	}
+}
+
+func TestHandshakeCancel(t *testing.T) {
+	s := startProtocolVersionServer(t)
+	defer s.Stop()
+
+	for _, legacy := range []bool{false, true} {
+		conn, err := net.DialTimeout("tcp", s.Addr, time.Second)
+		if err != nil {
+			t.Fatalf("cannot establish connection to [%s]: [%s]", s.Addr, err)
+		}
+		c := &Client{
+			Codec:           GobCodec,
+			LegacyHandshake: legacy,
+		}
+		p, err := clientHandshake(c, conn, legacy)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("Unexpected handshake error: [%s]", err)
+		}
+
+		// Cancellation notifications mustn't be sent to servers,
+		// which didn't acknowledge capCancel.
+		if p.cancel == legacy {
+			t.Fatalf("Unexpected cancel=%v for legacy=%v", p.cancel, legacy)
+		}
+	}
+}
+
+func TestHandshakeUnsupportedVersion(t *testing.T) {
+	s := startProtocolVersionServer(t)
+	defer s.Stop()
+
+	conn := dialHandshake(t, s.Addr, handshakeMagic+"\x00"+"\x00\x00\x00\x00\x00\x00\x00\x01"+"\x00\x00\x00\x00")
+	defer conn.Close()
+
+	c := &Client{}
+	_, err := readServerHandshake(c, conn, capControlFrames, nil)
+	if err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	if !strings.Contains(err.Error(), "unsupported protocol version 0") {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+}
+
+func TestHandshakeNewerClient(t *testing.T) {
+	s := startProtocolVersionServer(t)
+	defer s.Stop()
+
+	// The client from the future with unknown capability 1<<63
+	// and the payload for it.
+	conn := dialHandshake(t, s.Addr, handshakeMagic+"\x07"+"\x80\x00\x00\x00\x00\x00\x00\x05"+"\x00\x00\x00\x0a"+"\x01\x05flate"+"foo")
+	defer conn.Close()
+
+	var reply [len(handshakeMagic) + 1 + 8 + 1]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		t.Fatalf("cannot read handshake reply: [%s]", err)
+	}
+	expectedReply := handshakeMagic + "\x01" + "\x00\x00\x00\x00\x00\x00\x00\x05" + "\x00"
+	if string(reply[:]) != expectedReply {
+		t.Fatalf("Unexpected handshake reply: %q. Expected %q", reply[:], expectedReply)
+	}
+}
+
+func TestHandshakeInvalidMagic(t *testing.T) {
+	s := startProtocolVersionServer(t)
+	defer s.Stop()
+
+	conn := dialHandshake(t, s.Addr, "gopher"+"\x00\x00\x00\x00\x00\x00\x00\x00"+"\x00\x00\x00\x00")
+	defer conn.Close()
+
+	// The server must close the connection.
+	var buf [1]byte
+	if _, err := conn.Read(buf[:]); err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+}
+
+func TestHandshakeLegacyServer(t *testing.T) {
+	addr := getRandomAddr()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("cannot listen on [%s]: [%s]", addr, err)
+	}
+	defer ln.Close()
+
+	// Legacy servers close the connection after obtaining
+	// unexpected data.
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			var buf [1]byte
+			conn.Read(buf[:])
+			conn.Close()
+		}
+	}()
+
+	c := &Client{
+		Addr: addr,
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("cannot establish connection to [%s]: [%s]", addr, err)
+	}
+	defer conn.Close()
+
+	c.Codec = GobCodec
+	c.HandshakeTimeout = time.Second
+	_, err = clientHandshakeTimeout(c, addr, conn, nil)
+	if err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	if !strings.Contains(err.Error(), "legacy handshake") {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	if !c.isLegacyServer(addr) {
+		t.Fatalf("the legacy handshake must be used for the next connection")
+	}
+}
+
+func TestHandshakeLegacyFallback(t *testing.T) {
+	s := startProtocolVersionServer(t)
+	defer s.Stop()
+
+	addr := getRandomAddr()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("cannot listen on [%s]: [%s]", addr, err)
+	}
+	defer ln.Close()
+
+	// Emulate old server by closing connections with the versioned
+	// handshake and proxying connections with the legacy handshake
+	// to the server, which supports both.
+	var versionedConns, legacyConns uint32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			var buf [1]byte
+			if _, err = io.ReadFull(conn, buf[:]); err != nil || buf[0] == handshakeMagic[0] {
+				atomic.AddUint32(&versionedConns, 1)
+				conn.Close()
+				continue
+			}
+			atomic.AddUint32(&legacyConns, 1)
+			sconn, err := net.Dial("tcp", s.Addr)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			sconn.Write(buf[:])
+			go func() {
+				io.Copy(sconn, conn)
+				sconn.Close()
+			}()
+			go func() {
+				io.Copy(conn, sconn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	c := &Client{
+		Addr:            addr,
+		ReconnectPolicy: ConstantBackoff(10 * time.Millisecond),
+		LogError:        func(format string, args ...interface{}) {},
+	}
+	c.Start()
+	defer c.Stop()
+
+	resp, err := c.CallTimeout("foo", time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	if resp.(int) != 0 {
+		t.Fatalf("Unexpected protocol version: %d. Expected 0", resp)
+	}
+	if n := atomic.LoadUint32(&versionedConns); n != 1 {
+		t.Fatalf("Unexpected number of versioned handshakes: %d. Expected 1", n)
+	}
+	if n := atomic.LoadUint32(&legacyConns); n != 1 {
+		t.Fatalf("Unexpected number of legacy handshakes: %d. Expected 1", n)
+	}
+}
+
+func dialHandshake(t *testing.T, addr, handshake string) net.Conn {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatalf("cannot establish connection to [%s]: [%s]", addr, err)
+	}
+	if _, err = conn.Write([]byte(handshake)); err != nil {
+		t.Fatalf("cannot write handshake: [%s]", err)
+	}
+	return conn
+}
@@ -0,0 +1,136 @@
+package gorpc
+
+import (
+	"context"
+	"time"
+)
+
+// HedgePolicy determines when to send a duplicate (hedged) request
+// for cutting tail latency.
+//
+// If the response isn't obtained during Delay, the same request is sent
+// to the server again. The first successful response wins and the other
+// request is canceled via AsyncResult.Cancel.
+//
+// Hedging must be enabled only for idempotent (for instance, read-only)
+// calls, since the server may process the same request twice.
+//
+// Hedge policy may be set per call via WithHedgePolicy and per function
+// via DispatcherClient.SetHedgePolicy.
+//
+// ConnStats.HedgedCalls and ConnStats.HedgeWins show how often hedged
+// requests are sent and how often they win.
+type HedgePolicy struct {
+	// Delay before sending the hedged request.
+	//
+	// Usually it is set to the observed 95th percentile of the call
+	// duration, so only slowest 5% of calls are hedged.
+	Delay time.Duration
+}
+
+type hedgePolicyKey struct{}
+
+// WithHedgePolicy returns a copy of ctx with the given hedge policy.
+//
+// The hedge policy is applied to calls made via Client.CallContext
+// and DispatcherClient.CallContext with the returned ctx.
+// Nil p disables hedging for the calls.
+func WithHedgePolicy(ctx context.Context, p *HedgePolicy) context.Context {
+	return context.WithValue(ctx, hedgePolicyKey{}, p)
+}
+
+func hedgePolicyFromContext(ctx context.Context) *HedgePolicy {
+	p, _ := ctx.Value(hedgePolicyKey{}).(*HedgePolicy)
+	return p
+}
+
+// callHedged sends the request and sends a hedged request if the response
+// isn't obtained during p.Delay.
+//
+// Returns false if timeoutCh fires or doneCh is closed before
+// the response is obtained.
+func (c *Client) callHedged(request interface{}, md Metadata, respMD *Metadata, deadline time.Time, priority Priority, p *HedgePolicy,
+	timeoutCh <-chan time.Time, doneCh <-chan struct{}) (response interface{}, ok bool, err error) {
+	m, err := c.callAsync(request, md, deadline, priority, false, true)
+	if err != nil {
+		return nil, true, err
+	}
+
+	t := acquireTimer(p.Delay)
+	defer releaseTimer(t)
+
+	select {
+	case <-m.Done:
+		response, err = m.Response, m.Error
+		setResponseMetadata(respMD, m.Metadata)
+		releaseAsyncResult(m)
+		return response, true, err
+	case <-t.C:
+	case <-timeoutCh:
+		m.Cancel()
+		return nil, false, nil
+	case <-doneCh:
+		m.Cancel()
+		return nil, false, nil
+	}
+
+	hm, herr := c.callAsync(request, md, deadline, priority, false, true)
+	if herr != nil {
+		// Continue waiting for the original request.
+		hm = nil
+	} else {
+		c.Stats.incHedgedCalls()
+	}
+
+	// Wait for the first successful response.
+	pending := 2
+	if hm == nil {
+		pending = 1
+	}
+	for pending > 0 {
+		var mDone, hmDone <-chan struct{}
+		if m != nil {
+			mDone = m.Done
+		}
+		if hm != nil {
+			hmDone = hm.Done
+		}
+
+		select {
+		case <-mDone:
+			response, err = m.Response, m.Error
+			setResponseMetadata(respMD, m.Metadata)
+			releaseAsyncResult(m)
+			m = nil
+		case <-hmDone:
+			response, err = hm.Response, hm.Error
+			setResponseMetadata(respMD, hm.Metadata)
+			releaseAsyncResult(hm)
+			hm = nil
+			if err == nil {
+				c.Stats.incHedgeWins()
+			}
+		case <-timeoutCh:
+			cancelAsyncResults(m, hm)
+			return nil, false, nil
+		case <-doneCh:
+			cancelAsyncResults(m, hm)
+			return nil, false, nil
+		}
+		pending--
+
+		if err == nil {
+			cancelAsyncResults(m, hm)
+			return response, true, nil
+		}
+	}
+	return response, true, err
+}
+
+func cancelAsyncResults(ms ...*AsyncResult) {
+	for _, m := range ms {
+		if m != nil {
+			m.Cancel()
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package gorpc
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newSlowFirstServer returns a server, which processes only the first
+// request slowly.
+func newSlowFirstServer(t *testing.T, calls *uint32) *Server {
+	return startTestServer(t, &Server{
+		Handler: func(clientAddr string, request interface{}) interface{} {
+			if atomic.AddUint32(calls, 1) == 1 {
+				time.Sleep(500 * time.Millisecond)
+				return "slow"
+			}
+			return "fast"
+		},
+	})
+}
+
+func TestHedgePolicyContext(t *testing.T) {
+	var calls uint32
+	s := newSlowFirstServer(t, &calls)
+	defer s.Stop()
+
+	c := &Client{
+		Addr: s.Addr,
+	}
+	c.Start()
+	defer c.Stop()
+
+	ctx := WithHedgePolicy(context.Background(), &HedgePolicy{
+		Delay: 20 * time.Millisecond,
+	})
+	startTime := time.Now()
+	resp, err := c.CallContext(ctx, 123)
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	if resp.(string) != "fast" {
+		t.Fatalf("unexpected response: %v. Expected %q", resp, "fast")
+	}
+	if time.Since(startTime) > 300*time.Millisecond {
+		t.Fatalf("too long hedged call: %s", time.Since(startTime))
+	}
+
+	stats := c.Stats.Snapshot()
+	if stats.HedgedCalls != 1 {
+		t.Fatalf("unexpected HedgedCalls: %d. Expected 1", stats.HedgedCalls)
+	}
+	if stats.HedgeWins != 1 {
+		t.Fatalf("unexpected HedgeWins: %d. Expected 1", stats.HedgeWins)
+	}
+
+	// Fast calls mustn't be hedged.
+	for i := 0; i < 10; i++ {
+		if _, err = c.CallContext(ctx, i); err != nil {
+			t.Fatalf("unexpected error: [%s]", err)
+		}
+	}
+	stats = c.Stats.Snapshot()
+	if stats.HedgedCalls != 1 {
+		t.Fatalf("unexpected HedgedCalls: %d. Expected 1", stats.HedgedCalls)
+	}
+}
+
+func TestHedgePolicyTimeout(t *testing.T) {
+	s := &Server{
+		Addr: getRandomAddr(),
+		Handler: func(clientAddr string, request interface{}) interface{} {
+			time.Sleep(300 * time.Millisecond)
+			return request
+		},
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := &Client{
+		Addr: s.Addr,
+	}
+	c.Start()
+	defer c.Stop()
+
+	hp := &HedgePolicy{
+		Delay: 10 * time.Millisecond,
+	}
+	_, err := c.callTimeout(123, 50*time.Millisecond, PriorityNormal, hp)
+	if err == nil || !err.(*ClientError).Timeout {
+		t.Fatalf("expecting timeout error. Got [%v]", err)
+	}
+	if n := c.Stats.Snapshot().HedgedCalls; n != 1 {
+		t.Fatalf("unexpected HedgedCalls: %d. Expected 1", n)
+	}
+}
+
+func TestDispatcherHedgePolicy(t *testing.T) {
+	d := NewDispatcher()
+
+	var calls uint32
+	d.AddFunc("Slow", func() string {
+		if atomic.AddUint32(&calls, 1) == 1 {
+			time.Sleep(500 * time.Millisecond)
+			return "slow"
+		}
+		return "fast"
+	})
+
+	testDispatcherFunc(t, d, func(dc *DispatcherClient) {
+		dc.SetHedgePolicy("Slow", &HedgePolicy{
+			Delay: 20 * time.Millisecond,
+		})
+
+		res, err := dc.Call("Slow", nil)
+		if err != nil {
+			t.Fatalf("Unexpected error: [%s]", err)
+		}
+		if res.(string) != "fast" {
+			t.Fatalf("Unexpected response: [%v]. Expected [fast]", res)
+		}
+		if n := dc.c.Stats.Snapshot().HedgeWins; n != 1 {
+			t.Fatalf("Unexpected HedgeWins: %d. Expected 1", n)
+		}
+	})
+}
@@ -0,0 +1,270 @@
+package gorpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// ServerCallInfo contains information about the request passed
+// to ServerInterceptor.
+type ServerCallInfo struct {
+	// ClientAddr is the client address returned by Listener.Accept().
+	ClientAddr string
+
+	// Peer contains information about the client connection.
+	Peer *PeerInfo
+
+	// Service is the name of the service the request is dispatched to.
+	//
+	// Service is empty for functions registered via Dispatcher.AddFunc()
+	// and for requests, which aren't sent via DispatcherClient.
+	Service string
+
+	// Method is the name of the function or the service method
+	// the request is dispatched to.
+	//
+	// Method is empty for requests, which aren't sent via DispatcherClient.
+	Method string
+
+	// StartTime is the time the server started processing the request.
+	StartTime time.Time
+}
+
+// ServerInvoker processes the request intercepted by ServerInterceptor.
+type ServerInvoker func(ctx context.Context, request interface{}) (response interface{}, err error)
+
+// ServerInterceptor intercepts requests processed by the server.
+//
+// The interceptor must call next for passing the request to the next
+// interceptor in the chain or to the handler itself. The interceptor
+// may short-circuit the chain by returning without calling next.
+// The interceptor may rewrite the request passed to next and
+// the response and error returned from next.
+//
+// The error returned from the interceptor is sent to the client.
+//
+// Interceptors may be registered via Server.Use() and Dispatcher.Use().
+type ServerInterceptor func(ctx context.Context, info *ServerCallInfo, request interface{}, next ServerInvoker) (response interface{}, err error)
+
+// chainServerInterceptors returns invoker calling the given interceptors
+// in the order they are passed before calling the given invoker.
+func chainServerInterceptors(interceptors []ServerInterceptor, info *ServerCallInfo, invoker ServerInvoker) ServerInvoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor := interceptors[i]
+		next := invoker
+		invoker = func(ctx context.Context, request interface{}) (interface{}, error) {
+			return interceptor(ctx, info, request, next)
+		}
+	}
+	return invoker
+}
+
+// splitCallName splits the name of the request sent via DispatcherClient
+// into service name and function name.
+func splitCallName(name string) (serviceName, funcName string, ok bool) {
+	n := strings.IndexByte(name, '.')
+	if n < 0 {
+		return "", "", false
+	}
+	return name[:n], name[n+1:], true
+}
+
+// callInterceptedHandler calls the server handler via interceptors
+// registered with Server.Use().
+//
+// Requests sent via DispatcherClient are unwrapped before passing them
+// to interceptors, so interceptors see the original request and response.
+func callInterceptedHandler(s *Server, ctx context.Context, clientAddr string, request interface{}) (response interface{}, errStr string) {
+	defer func() {
+		if x := recover(); x != nil {
+			stackTrace := make([]byte, 1<<20)
+			n := runtime.Stack(stackTrace, false)
+			errStr = fmt.Sprintf("Panic occured in interceptor: %v\nStack trace: %s", x, stackTrace[:n])
+			s.LogError("gorpc.Server: [%s]->[%s]. %s", clientAddr, s.Addr, errStr)
+		}
+	}()
+
+	info := &ServerCallInfo{
+		ClientAddr: clientAddr,
+		Peer:       PeerFromContext(ctx),
+		StartTime:  time.Now(),
+	}
+
+	dreq, isDispatcherRequest := request.(*dispatcherRequest)
+	if isDispatcherRequest {
+		info.Service, info.Method, _ = splitCallName(dreq.Name)
+		request = dreq.Request
+	}
+
+	invoker := func(ctx context.Context, request interface{}) (interface{}, error) {
+		if isDispatcherRequest {
+			request = &dispatcherRequest{
+				Name:    dreq.Name,
+				Request: request,
+			}
+		}
+		response, errStr := callHandlerWithRecover(s.LogError, s.handler, ctx, clientAddr, s.Addr, request)
+		if errStr != "" {
+			return nil, errors.New(errStr)
+		}
+		if isDispatcherRequest {
+			if dresp, ok := response.(*dispatcherResponse); ok {
+				if dresp.Error != "" {
+					return nil, errors.New(dresp.Error)
+				}
+				return dresp.Response, nil
+			}
+		}
+		return response, nil
+	}
+
+	response, err := chainServerInterceptors(s.interceptors, info, invoker)(ctx, request)
+	if isDispatcherRequest {
+		return newDispatcherResponse(response, err), ""
+	}
+	if err != nil {
+		return nil, err.Error()
+	}
+	return response, ""
+}
+
+// ClientCallInfo contains information about the call passed
+// to ClientInterceptor.
+type ClientCallInfo struct {
+	// Addr is the server address from Client.Addr.
+	Addr string
+
+	// Service is the name of the service called via DispatcherClient.
+	//
+	// Service is empty for functions called via DispatcherClient
+	// created by Dispatcher.NewFuncClient() and for calls, which aren't
+	// made via DispatcherClient.
+	Service string
+
+	// Method is the name of the function or the service method called
+	// via DispatcherClient.
+	//
+	// Method is empty for calls, which aren't made via DispatcherClient.
+	Method string
+
+	// SkipResponse is set for calls, which don't wait for response,
+	// i.e. Send and Batch.AddSkipResponse calls.
+	SkipResponse bool
+
+	// Async is set for CallAsync and Batch calls.
+	//
+	// Interceptors are called synchronously until the request is queued
+	// for sending, so next returns nil response for async calls,
+	// while the response is delivered via AsyncResult or BatchResult.
+	// The response returned from the interceptor is used only if next
+	// hasn't been called.
+	Async bool
+}
+
+// ClientInvoker performs the call intercepted by ClientInterceptor.
+type ClientInvoker func(ctx context.Context, request interface{}) (response interface{}, err error)
+
+// ClientInterceptor intercepts calls made by the client.
+//
+// The interceptor must call next for sending the request to the next
+// interceptor in the chain or to the server. The interceptor may
+// short-circuit the chain by returning without calling next.
+// The interceptor may rewrite the request passed to next and
+// the response and error returned from next.
+//
+// ctx is the context passed to CallContext. Calls, which don't accept
+// context, obtain context.Background().
+//
+// Interceptors may be registered via Client.Use().
+type ClientInterceptor func(ctx context.Context, info *ClientCallInfo, request interface{}, next ClientInvoker) (response interface{}, err error)
+
+// chainClientInterceptors returns invoker calling the given interceptors
+// in the order they are passed before calling the given invoker.
+func chainClientInterceptors(interceptors []ClientInterceptor, info *ClientCallInfo, invoker ClientInvoker) ClientInvoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor := interceptors[i]
+		next := invoker
+		invoker = func(ctx context.Context, request interface{}) (interface{}, error) {
+			return interceptor(ctx, info, request, next)
+		}
+	}
+	return invoker
+}
+
+// intercept performs the call via interceptors registered with Client.Use().
+//
+// Requests sent via DispatcherClient are unwrapped before passing them
+// to interceptors, so interceptors see the original request and response.
+func (c *Client) intercept(ctx context.Context, request interface{}, skipResponse, async bool, call ClientInvoker) (interface{}, error) {
+	info := &ClientCallInfo{
+		Addr:         c.Addr,
+		SkipResponse: skipResponse,
+		Async:        async,
+	}
+
+	invoker := call
+	dreq, isDispatcherRequest := request.(*dispatcherRequest)
+	if isDispatcherRequest {
+		info.Service, info.Method, _ = splitCallName(dreq.Name)
+		request = dreq.Request
+		invoker = func(ctx context.Context, request interface{}) (interface{}, error) {
+			response, err := call(ctx, &dispatcherRequest{
+				Name:    dreq.Name,
+				Request: request,
+			})
+			if skipResponse || async {
+				return nil, err
+			}
+			return getResponse(response, err)
+		}
+	}
+
+	response, err := chainClientInterceptors(c.interceptors, info, invoker)(ctx, request)
+	if isDispatcherRequest && err == nil && !skipResponse {
+		response = &dispatcherResponse{
+			Response: response,
+		}
+	}
+	return response, err
+}
+
+// interceptAsync performs the async call via interceptors registered
+// with Client.Use().
+//
+// Interceptors are called synchronously until call queues the request,
+// so errors such as queue overflow or open circuit are returned directly
+// to the caller.
+//
+// The returned AsyncResult is nil for skipResponse requests if
+// the interceptor returned without calling next.
+func (c *Client) interceptAsync(request interface{}, skipResponse bool, call func(request interface{}, md Metadata) (*AsyncResult, error)) (*AsyncResult, error) {
+	var m *AsyncResult
+	response, err := c.intercept(context.Background(), request, skipResponse, true, func(ctx context.Context, request interface{}) (interface{}, error) {
+		md, _ := metadataFromContext(ctx)
+		var err error
+		m, err = call(request, md)
+		return nil, err
+	})
+	if err != nil {
+		if m != nil && !skipResponse {
+			// The interceptor rejected the queued request.
+			m.Cancel()
+		}
+		return nil, err
+	}
+	if m == nil && !skipResponse {
+		// The interceptor returned the response without calling next.
+		done := make(chan struct{})
+		close(done)
+		m = &AsyncResult{
+			Response: response,
+			Done:     done,
+			done:     done,
+		}
+	}
+	return m, nil
+}
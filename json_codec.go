@@ -0,0 +1,239 @@
+package gorpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+)
+
+// JSONCodec is the codec based on encoding/json.
+//
+// The codec may be used for talking to gorpc servers from other languages
+// and for debugging, since messages on the wire are human-readable.
+// Add JSONCodec to Server.Codecs and set Client.Codec to JSONCodec
+// for using it.
+//
+// Messages are sent as newline-delimited JSON objects (compression must
+// be disabled via Client.DisableCompression in order to see plain JSON
+// on the wire). Each object is prefixed with the frame header if
+// length-prefixed framing is negotiated during the handshake (see framing.go).
+// Requests look like:
+//
+//     {"id":1,"method":"Service.Method","request":{...},"timeout":1000000000,"metadata":{"k":"v"}}
+//
+// where method is set only for requests sent via DispatcherClient,
+// timeout is in nanoseconds and cancel_id is set instead of request
+// when the client cancels the previously sent request.
+//
+// Responses look like:
+//
+//     {"id":1,"response":{...},"error":"..."}
+//
+// Responses for requests with method additionally contain "dispatcher":true
+// and "dispatcher_error" with the error returned from the function.
+// Responses may contain canceled, timeout, shutting_down, rejected, goaway
+// and metadata fields. See wireResponse for details.
+//
+// Request and response payloads are decoded into json.RawMessage,
+// so Server.Handler obtains json.RawMessage requests and Client obtains
+// json.RawMessage responses. Dispatcher and DispatcherClient decode
+// payloads into the types of the registered functions' arguments
+// and results, so there is no need in RegisterType() for JSONCodec.
+var JSONCodec Codec = &jsonCodec{}
+
+type jsonCodec struct{}
+
+func (c *jsonCodec) Name() string {
+	return "json"
+}
+
+func (c *jsonCodec) NewEncoder(w io.Writer) Encoder {
+	return &jsonEncoder{
+		e: json.NewEncoder(w),
+	}
+}
+
+func (c *jsonCodec) NewDecoder(r io.Reader) Decoder {
+	return &jsonDecoder{
+		d: json.NewDecoder(r),
+	}
+}
+
+type jsonRequest struct {
+	ID       uint64          `json:"id"`
+	Method   string          `json:"method,omitempty"`
+	Request  json.RawMessage `json:"request,omitempty"`
+	CancelID uint64          `json:"cancel_id,omitempty"`
+	Timeout  time.Duration   `json:"timeout,omitempty"`
+	Metadata Metadata        `json:"metadata,omitempty"`
+}
+
+type jsonResponse struct {
+	ID              uint64          `json:"id"`
+	Response        json.RawMessage `json:"response,omitempty"`
+	Error           string          `json:"error,omitempty"`
+	Dispatcher      bool            `json:"dispatcher,omitempty"`
+	DispatcherError string          `json:"dispatcher_error,omitempty"`
+	Canceled        bool            `json:"canceled,omitempty"`
+	Timeout         bool            `json:"timeout,omitempty"`
+	ShuttingDown    bool            `json:"shutting_down,omitempty"`
+	Rejected        bool            `json:"rejected,omitempty"`
+	GoAway          bool            `json:"goaway,omitempty"`
+	Metadata        Metadata        `json:"metadata,omitempty"`
+}
+
+type jsonEncoder struct {
+	e *json.Encoder
+}
+
+func (e *jsonEncoder) Encode(msg interface{}) error {
+	switch m := msg.(type) {
+	case wireRequest:
+		return e.encodeRequest(&m)
+	case *wireRequest:
+		return e.encodeRequest(m)
+	case wireResponse:
+		return e.encodeResponse(&m)
+	case *wireResponse:
+		return e.encodeResponse(m)
+	default:
+		return e.e.Encode(msg)
+	}
+}
+
+func (e *jsonEncoder) encodeRequest(m *wireRequest) error {
+	jr := jsonRequest{
+		ID:       m.ID,
+		CancelID: m.CancelID,
+		Timeout:  m.Timeout,
+		Metadata: m.Metadata,
+	}
+	request := m.Request
+	if dreq, ok := request.(*dispatcherRequest); ok {
+		jr.Method = dreq.Name
+		request = dreq.Request
+	}
+	var err error
+	if jr.Request, err = marshalJSONPayload(request); err != nil {
+		return fmt.Errorf("cannot encode request: [%s]", err)
+	}
+	return e.e.Encode(&jr)
+}
+
+func (e *jsonEncoder) encodeResponse(m *wireResponse) error {
+	jr := jsonResponse{
+		ID:           m.ID,
+		Error:        m.Error,
+		Canceled:     m.Canceled,
+		Timeout:      m.Timeout,
+		ShuttingDown: m.ShuttingDown,
+		Rejected:     m.Rejected,
+		GoAway:       m.GoAway,
+		Metadata:     m.Metadata,
+	}
+	response := m.Response
+	if dresp, ok := response.(*dispatcherResponse); ok {
+		jr.Dispatcher = true
+		jr.DispatcherError = dresp.Error
+		response = dresp.Response
+	}
+	var err error
+	if jr.Response, err = marshalJSONPayload(response); err != nil {
+		return fmt.Errorf("cannot encode response: [%s]", err)
+	}
+	return e.e.Encode(&jr)
+}
+
+type jsonDecoder struct {
+	d *json.Decoder
+}
+
+func (d *jsonDecoder) Decode(msg interface{}) error {
+	switch m := msg.(type) {
+	case *wireRequest:
+		return d.decodeRequest(m)
+	case *wireResponse:
+		return d.decodeResponse(m)
+	default:
+		return d.d.Decode(msg)
+	}
+}
+
+func (d *jsonDecoder) decodeRequest(m *wireRequest) error {
+	var jr jsonRequest
+	if err := d.d.Decode(&jr); err != nil {
+		return err
+	}
+	*m = wireRequest{
+		ID:       jr.ID,
+		Request:  unmarshalJSONPayload(jr.Request),
+		CancelID: jr.CancelID,
+		Timeout:  jr.Timeout,
+		Metadata: jr.Metadata,
+	}
+	if jr.Method != "" {
+		m.Request = &dispatcherRequest{
+			Name:    jr.Method,
+			Request: m.Request,
+		}
+	}
+	return nil
+}
+
+func (d *jsonDecoder) decodeResponse(m *wireResponse) error {
+	var jr jsonResponse
+	if err := d.d.Decode(&jr); err != nil {
+		return err
+	}
+	*m = wireResponse{
+		ID:           jr.ID,
+		Response:     unmarshalJSONPayload(jr.Response),
+		Error:        jr.Error,
+		Canceled:     jr.Canceled,
+		Timeout:      jr.Timeout,
+		ShuttingDown: jr.ShuttingDown,
+		Rejected:     jr.Rejected,
+		GoAway:       jr.GoAway,
+		Metadata:     jr.Metadata,
+	}
+	if jr.Dispatcher {
+		m.Response = &dispatcherResponse{
+			Response: m.Response,
+			Error:    jr.DispatcherError,
+		}
+	}
+	return nil
+}
+
+func marshalJSONPayload(v interface{}) (json.RawMessage, error) {
+	if v == nil {
+		return nil, nil
+	}
+	return json.Marshal(v)
+}
+
+func unmarshalJSONPayload(data json.RawMessage) interface{} {
+	if len(data) == 0 || string(data) == "null" {
+		return nil
+	}
+	return data
+}
+
+// decodeJSONPayload decodes payload received via JSONCodec into the value
+// of the given type.
+//
+// v is returned as is if it isn't a json.RawMessage, i.e. if it has been
+// received via other codec.
+func decodeJSONPayload(v interface{}, t reflect.Type) (interface{}, error) {
+	data, ok := v.(json.RawMessage)
+	if !ok || t == nil {
+		return v, nil
+	}
+	pv := reflect.New(t)
+	if err := json.Unmarshal(data, pv.Interface()); err != nil {
+		return nil, err
+	}
+	return pv.Elem().Interface(), nil
+}
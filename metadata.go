@@ -0,0 +1,126 @@
+package gorpc
+
+import (
+	"context"
+	"sync"
+)
+
+// Metadata contains key-value pairs sent along with requests and responses.
+//
+// Metadata may be used for passing trace ids, auth tokens, tenant ids,
+// server load hints, etc.
+type Metadata map[string]string
+
+type metadataKey struct{}
+
+type responseMetadataKey struct{}
+
+// WithMetadata returns a copy of ctx with the given request metadata.
+//
+// The metadata is sent to the server along with requests made
+// via Client.CallContext and DispatcherClient.CallContext with
+// the returned ctx. The metadata is merged with the metadata already
+// stored in the ctx.
+//
+// Client interceptors may set request metadata for all the calls
+// by passing ctx returned from WithMetadata to ClientInvoker.
+func WithMetadata(ctx context.Context, md Metadata) context.Context {
+	if prevMD, ok := ctx.Value(metadataKey{}).(Metadata); ok {
+		mdCopy := make(Metadata, len(prevMD)+len(md))
+		for k, v := range prevMD {
+			mdCopy[k] = v
+		}
+		for k, v := range md {
+			mdCopy[k] = v
+		}
+		md = mdCopy
+	}
+	return context.WithValue(ctx, metadataKey{}, md)
+}
+
+// WithResponseMetadata returns a copy of ctx, which stores response metadata
+// obtained from the server into md.
+//
+// The response metadata is stored for calls made via Client.CallContext
+// and DispatcherClient.CallContext with the returned ctx.
+//
+// Client interceptors may obtain response metadata for all the calls
+// by passing ctx returned from WithResponseMetadata to ClientInvoker.
+// Response metadata for Client.CallAsync calls is also available
+// via AsyncResult.Metadata.
+func WithResponseMetadata(ctx context.Context, md *Metadata) context.Context {
+	return context.WithValue(ctx, responseMetadataKey{}, md)
+}
+
+func metadataFromContext(ctx context.Context) (md Metadata, respMD *Metadata) {
+	md, _ = ctx.Value(metadataKey{}).(Metadata)
+	respMD, _ = ctx.Value(responseMetadataKey{}).(*Metadata)
+	return md, respMD
+}
+
+func setResponseMetadata(respMD *Metadata, md Metadata) {
+	if respMD != nil {
+		*respMD = md
+	}
+}
+
+// serverMetadata holds request and response metadata for the request
+// processed by the server.
+type serverMetadata struct {
+	request Metadata
+
+	lock     sync.Mutex
+	response Metadata
+}
+
+type serverMetadataKey struct{}
+
+// RequestMetadata returns request metadata sent by the client.
+//
+// ctx must be the context passed to Server.HandlerCtx, to ServerInterceptor
+// or to the function registered in Dispatcher. Nil is returned if the client
+// didn't send metadata.
+//
+// The returned metadata mustn't be modified.
+func RequestMetadata(ctx context.Context) Metadata {
+	if smd, ok := ctx.Value(serverMetadataKey{}).(*serverMetadata); ok {
+		return smd.request
+	}
+	return nil
+}
+
+// SetResponseMetadata sets response metadata value for the given key.
+// The response metadata is sent to the client along with the response.
+//
+// ctx must be the context passed to Server.HandlerCtx, to ServerInterceptor
+// or to the function registered in Dispatcher.
+//
+// It is safe calling this function from concurrently running goroutines.
+func SetResponseMetadata(ctx context.Context, key, value string) {
+	smd, ok := ctx.Value(serverMetadataKey{}).(*serverMetadata)
+	if !ok {
+		return
+	}
+	smd.lock.Lock()
+	if smd.response == nil {
+		smd.response = make(Metadata)
+	}
+	smd.response[key] = value
+	smd.lock.Unlock()
+}
+
+func (smd *serverMetadata) getResponse() Metadata {
+	smd.lock.Lock()
+	defer smd.lock.Unlock()
+
+	if len(smd.response) == 0 {
+		return nil
+	}
+
+	// Copy the metadata, since abandoned handlers may still modify it.
+	md := make(Metadata, len(smd.response))
+	for k, v := range smd.response {
+		md[k] = v
+	}
+	return md
+}
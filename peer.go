@@ -0,0 +1,163 @@
+package gorpc
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+)
+
+// PeerInfo contains information about the client connection.
+//
+// PeerInfo may be obtained via PeerFromContext() in Server.HandlerCtx
+// and in ServerInterceptor. Functions registered in Dispatcher may accept
+// *PeerInfo instead of clientAddr string argument.
+type PeerInfo struct {
+	// ConnID is the connection id, which is unique for the server.
+	ConnID uint64
+
+	// RemoteAddr is the client address returned by Listener.Accept().
+	RemoteAddr string
+
+	// LocalAddr is the server address of the connection.
+	//
+	// LocalAddr is empty if the connection returned by Listener.Accept()
+	// doesn't expose its local address.
+	LocalAddr string
+
+	// TLS contains TLS connection state for TLS connections.
+	//
+	// TLS is nil for non-TLS connections.
+	TLS *tls.ConnectionState
+
+	// UnixCred contains peer credentials for unix socket connections.
+	//
+	// UnixCred is set only on platforms supporting SO_PEERCRED.
+	UnixCred *UnixCred
+
+	// ProtocolVersion is the protocol version negotiated with the client
+	// during the handshake.
+	//
+	// ProtocolVersion is zero for clients using the legacy handshake.
+	// See Client.LegacyHandshake.
+	ProtocolVersion int
+
+	stats *ConnStats
+
+	lock   sync.Mutex
+	values map[string]interface{}
+}
+
+// UnixCred contains peer credentials for unix socket connections.
+type UnixCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// PeerValuer may be implemented by the connection returned
+// from Server.OnConnect for attaching values to PeerInfo.
+//
+// For instance, OnConnect authenticating the client may return
+// the connection wrapper, which passes the client identity to handlers
+// via PeerValues. Values returned from PeerValues are attached
+// to PeerInfo before calling Server.OnPeerConnect.
+type PeerValuer interface {
+	PeerValues() map[string]interface{}
+}
+
+// Stats returns stats' snapshot of the connection.
+//
+// Connection stats contain only counters related to reading and writing
+// such as BytesWritten and UncompressedBytesWritten, so
+// ConnStats.CompressionRatio() may be used for obtaining the compression
+// ratio of the connection. Server.Stats contains aggregate stats
+// for all the connections.
+func (p *PeerInfo) Stats() *ConnStats {
+	if p.stats == nil {
+		return &ConnStats{}
+	}
+	return p.stats.Snapshot()
+}
+
+// SetValue attaches the given value to the connection under the given key.
+//
+// Values may be attached in Server.OnPeerConnect, for instance,
+// for passing the client identity established during authentication
+// to handlers. See also PeerValuer.
+//
+// It is safe calling this function from concurrently running goroutines.
+func (p *PeerInfo) SetValue(key string, value interface{}) {
+	p.lock.Lock()
+	if p.values == nil {
+		p.values = make(map[string]interface{})
+	}
+	p.values[key] = value
+	p.lock.Unlock()
+}
+
+// Value returns the value attached to the connection via SetValue.
+//
+// Nil is returned if there is no value for the given key.
+func (p *PeerInfo) Value(key string) interface{} {
+	p.lock.Lock()
+	v := p.values[key]
+	p.lock.Unlock()
+	return v
+}
+
+type peerInfoKey struct{}
+
+// PeerFromContext returns information about the client connection.
+//
+// ctx must be the context passed to Server.HandlerCtx, to ServerInterceptor
+// or to the function registered in Dispatcher. Nil is returned for other
+// contexts.
+func PeerFromContext(ctx context.Context) *PeerInfo {
+	p, _ := ctx.Value(peerInfoKey{}).(*PeerInfo)
+	return p
+}
+
+var peerInfoType = reflect.TypeOf((*PeerInfo)(nil))
+
+// newPeerInfo returns information about the connection accepted
+// via Listener.Accept().
+//
+// conn is the connection returned from OnConnect.
+func newPeerInfo(connID uint64, clientAddr string, acceptedConn, conn io.ReadWriteCloser) *PeerInfo {
+	p := &PeerInfo{
+		ConnID:     connID,
+		RemoteAddr: clientAddr,
+	}
+
+	if c, ok := acceptedConn.(interface {
+		LocalAddr() net.Addr
+	}); ok {
+		p.LocalAddr = c.LocalAddr().String()
+	}
+
+	// OnConnect may wrap the accepted connection into TLS.
+	for _, c := range []io.ReadWriteCloser{conn, acceptedConn} {
+		if tc, ok := c.(interface {
+			ConnectionState() tls.ConnectionState
+		}); ok {
+			state := tc.ConnectionState()
+			p.TLS = &state
+			break
+		}
+	}
+
+	if uc, ok := acceptedConn.(*net.UnixConn); ok {
+		p.UnixCred = getUnixCred(uc)
+	}
+
+	if pv, ok := conn.(PeerValuer); ok {
+		for k, v := range pv.PeerValues() {
+			p.SetValue(k, v)
+		}
+	}
+
+	return p
+}
@@ -0,0 +1,30 @@
+// +build linux
+
+package gorpc
+
+import (
+	"net"
+	"syscall"
+)
+
+func getUnixCred(conn *net.UnixConn) *UnixCred {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = rc.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		return nil
+	}
+
+	return &UnixCred{
+		PID: cred.Pid,
+		UID: cred.Uid,
+		GID: cred.Gid,
+	}
+}
@@ -0,0 +1,11 @@
+// +build !linux
+
+package gorpc
+
+import (
+	"net"
+)
+
+func getUnixCred(conn *net.UnixConn) *UnixCred {
+	return nil
+}
@@ -0,0 +1,69 @@
+package gorpc
+
+import (
+	"context"
+	"fmt"
+)
+
+// Priority is the priority of the client request.
+//
+// Client sends requests with higher priority first. Requests with
+// lower priority are evicted first on requests' queue overflow.
+//
+// Priority may be set per call via WithPriority and per function
+// via DispatcherClient.SetPriority.
+type Priority int
+
+const (
+	// PriorityBackground is for bulk work, which may be delayed
+	// or dropped under overload.
+	PriorityBackground Priority = -1
+
+	// PriorityNormal is the default priority.
+	PriorityNormal Priority = 0
+
+	// PriorityHigh is for critical calls such as health checks
+	// and control-plane calls, which mustn't starve behind bulk traffic.
+	PriorityHigh Priority = 1
+)
+
+// String returns human-readable priority.
+func (p Priority) String() string {
+	switch p {
+	case PriorityBackground:
+		return "background"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	default:
+		return fmt.Sprintf("Priority(%d)", int(p))
+	}
+}
+
+// lane returns the normalized priority, which may be used
+// for selecting requests' queue.
+func (p Priority) lane() Priority {
+	if p < PriorityNormal {
+		return PriorityBackground
+	}
+	if p > PriorityNormal {
+		return PriorityHigh
+	}
+	return PriorityNormal
+}
+
+type priorityKey struct{}
+
+// WithPriority returns a copy of ctx with the given request priority.
+//
+// The priority is applied to calls made via Client.CallContext
+// and DispatcherClient.CallContext with the returned ctx.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+func priorityFromContext(ctx context.Context) (Priority, bool) {
+	p, ok := ctx.Value(priorityKey{}).(Priority)
+	return p, ok
+}
@@ -0,0 +1,221 @@
+package gorpc
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClientNextRequestPriority(t *testing.T) {
+	c := &Client{
+		Addr: getRandomAddr(),
+	}
+	c.Start()
+	defer c.Stop()
+
+	priorities := []Priority{PriorityBackground, PriorityNormal, PriorityHigh, PriorityNormal, PriorityBackground, PriorityHigh}
+	for i, p := range priorities {
+		if _, err := c.callAsyncPriority(i, p); err != nil {
+			t.Fatalf("unexpected error: [%s]", err)
+		}
+	}
+	if n := c.PendingRequestsCount(); n != len(priorities) {
+		t.Fatalf("unexpected number of pending requests: %d. Expected %d", n, len(priorities))
+	}
+
+	expectedRequests := []int{2, 5, 1, 3, 0, 4}
+	for _, expectedRequest := range expectedRequests {
+		m := c.nextRequest()
+		if m == nil {
+			t.Fatalf("cannot obtain request %d", expectedRequest)
+		}
+		if m.request.(int) != expectedRequest {
+			t.Fatalf("unexpected request: %v. Expected %d", m.request, expectedRequest)
+		}
+	}
+	if m := c.nextRequest(); m != nil {
+		t.Fatalf("unexpected request: %v. Expected no requests", m.request)
+	}
+}
+
+func TestClientPriorityOverflow(t *testing.T) {
+	c := &Client{
+		Addr:            getRandomAddr(),
+		PendingRequests: 2,
+	}
+	c.Start()
+	defer c.Stop()
+
+	bg1, err := c.callAsyncPriority("bg1", PriorityBackground)
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	bg2, err := c.callAsyncPriority("bg2", PriorityBackground)
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+
+	// High priority request must evict the oldest background request.
+	high, err := c.callAsyncPriority("high", PriorityHigh)
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	expectOverflow(t, bg1)
+
+	// Normal priority request must evict the remaining background request.
+	normal, err := c.callAsyncPriority("normal", PriorityNormal)
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	expectOverflow(t, bg2)
+
+	// Background request mustn't evict requests with higher priority.
+	if _, err = c.callAsyncPriority("bg3", PriorityBackground); err == nil || !err.(*ClientError).Overflow {
+		t.Fatalf("expecting overflow error. Got [%v]", err)
+	}
+
+	// Normal request may evict only the oldest normal request.
+	if _, err = c.callAsyncPriority("normal2", PriorityNormal); err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	expectOverflow(t, normal)
+
+	select {
+	case <-high.Done:
+		t.Fatalf("high priority request mustn't be evicted")
+	default:
+	}
+}
+
+func TestClientPriorityConcurrentOverflow(t *testing.T) {
+	c := &Client{
+		Addr:            getRandomAddr(),
+		PendingRequests: 10,
+		LogError:        func(format string, args ...interface{}) {},
+	}
+	c.Start()
+	defer c.Stop()
+
+	// Concurrent callers with distinct priorities mustn't overflow
+	// the PendingRequests limit.
+	var wg sync.WaitGroup
+	for _, p := range []Priority{PriorityBackground, PriorityNormal, PriorityHigh} {
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(p Priority) {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					c.callAsyncPriority(j, p)
+				}
+			}(p)
+		}
+	}
+	wg.Wait()
+
+	n := len(c.highRequestsChan) + len(c.requestsChan) + len(c.backgroundRequestsChan)
+	if n > c.PendingRequests {
+		t.Fatalf("too many queued requests: %d. Expected no more than %d", n, c.PendingRequests)
+	}
+	if n != c.queuedRequestsCount() {
+		t.Fatalf("unexpected number of queued requests: %d. Expected %d", c.queuedRequestsCount(), n)
+	}
+}
+
+func TestClientPriorityConcurrentEviction(t *testing.T) {
+	c := &Client{
+		Addr:            getRandomAddr(),
+		PendingRequests: 20,
+		LogError:        func(format string, args ...interface{}) {},
+	}
+	c.Start()
+	defer c.Stop()
+
+	for i := 0; i < 10; i++ {
+		var bgResults []*AsyncResult
+		for j := 0; j < c.PendingRequests; j++ {
+			m, err := c.callAsyncPriority(j, PriorityBackground)
+			if err != nil {
+				t.Fatalf("unexpected error: [%s]", err)
+			}
+			bgResults = append(bgResults, m)
+		}
+
+		// Every caller must obtain the slot of the evicted background
+		// request, since there are enough background requests for all
+		// the callers.
+		var wg sync.WaitGroup
+		var lock sync.Mutex
+		var results []*AsyncResult
+		for j := 0; j < c.PendingRequests; j++ {
+			p := PriorityHigh
+			if j%2 == 0 {
+				p = PriorityNormal
+			}
+			wg.Add(1)
+			go func(p Priority) {
+				defer wg.Done()
+				m, err := c.callAsyncPriority("foobar", p)
+				if err != nil {
+					t.Errorf("unexpected error: [%s]", err)
+					return
+				}
+				lock.Lock()
+				results = append(results, m)
+				lock.Unlock()
+			}(p)
+		}
+		wg.Wait()
+
+		for _, m := range bgResults {
+			expectOverflow(t, m)
+		}
+		if n := c.queuedRequestsCount(); n != c.PendingRequests {
+			t.Fatalf("unexpected number of queued requests: %d. Expected %d", n, c.PendingRequests)
+		}
+		for range results {
+			if c.nextRequest() == nil {
+				t.Fatalf("cannot obtain queued request")
+			}
+		}
+	}
+}
+
+func expectOverflow(t *testing.T, m *AsyncResult) {
+	select {
+	case <-m.Done:
+	case <-time.After(time.Second):
+		t.Fatalf("request %v hasn't been evicted", m.request)
+	}
+	if m.Error == nil || !m.Error.(*ClientError).Overflow {
+		t.Fatalf("expecting overflow error for request %v. Got [%v]", m.request, m.Error)
+	}
+}
+
+func TestClientCallContextPriority(t *testing.T) {
+	s := &Server{
+		Addr:    getRandomAddr(),
+		Handler: func(clientAddr string, request interface{}) interface{} { return request },
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := &Client{
+		Addr: s.Addr,
+	}
+	c.Start()
+	defer c.Stop()
+
+	for _, p := range []Priority{PriorityBackground, PriorityNormal, PriorityHigh} {
+		ctx := WithPriority(context.Background(), p)
+		resp, err := c.CallContext(ctx, p.String())
+		if err != nil {
+			t.Fatalf("unexpected error: [%s]", err)
+		}
+		if resp.(string) != p.String() {
+			t.Fatalf("unexpected response: %v. Expected %q", resp, p.String())
+		}
+	}
+}
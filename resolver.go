@@ -0,0 +1,270 @@
+package gorpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resolver discovers server addresses for Client and BalancingClient.
+//
+// See StaticResolver, FileResolver, DNSResolver and DNSSRVResolver
+// for built-in resolvers.
+type Resolver interface {
+	// Resolve must send the current set of server addresses to updates
+	// and then send a new set of addresses each time it changes.
+	//
+	// Resolve must return after stopChan is closed.
+	//
+	// The same address set may be sent multiple times - duplicate sets
+	// are ignored by the caller.
+	Resolve(updates chan<- []string, stopChan <-chan struct{})
+}
+
+// StaticResolver is a Resolver returning the fixed set of addresses.
+type StaticResolver []string
+
+// Resolve sends the static address set to updates.
+func (r StaticResolver) Resolve(updates chan<- []string, stopChan <-chan struct{}) {
+	select {
+	case updates <- []string(r):
+	case <-stopChan:
+		return
+	}
+	<-stopChan
+}
+
+// FileResolver is a Resolver reading server addresses from the file.
+//
+// The file may contain either JSON array of addresses or an address
+// per line. Empty lines and lines starting with # are ignored.
+//
+// The file is re-read periodically, so addresses may be changed
+// without restarting the client.
+type FileResolver struct {
+	// Path to the file with addresses.
+	Path string
+
+	// Interval between file re-reads.
+	// Default value is DefaultResolveInterval.
+	Interval time.Duration
+
+	// LogError is used for error logging.
+	//
+	// By default the function set via SetErrorLogger() is used.
+	LogError LoggerFunc
+}
+
+// Resolve sends addresses from the file to updates.
+func (r *FileResolver) Resolve(updates chan<- []string, stopChan <-chan struct{}) {
+	pollResolver(r.Interval, r.LogError, updates, stopChan, func() ([]string, error) {
+		data, err := ioutil.ReadFile(r.Path)
+		if err != nil {
+			return nil, fmt.Errorf("gorpc.FileResolver: cannot read addresses from [%s]: [%s]", r.Path, err)
+		}
+		addrs, err := parseAddrs(data)
+		if err != nil {
+			return nil, fmt.Errorf("gorpc.FileResolver: cannot parse addresses from [%s]: [%s]", r.Path, err)
+		}
+		return addrs, nil
+	})
+}
+
+func parseAddrs(data []byte) ([]string, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var addrs []string
+		if err := json.Unmarshal(data, &addrs); err != nil {
+			return nil, err
+		}
+		return addrs, nil
+	}
+
+	var addrs []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		addrs = append(addrs, line)
+	}
+	return addrs, nil
+}
+
+// DNSResolver is a Resolver periodically resolving the given host name
+// into server addresses via DNS A and AAAA records.
+type DNSResolver struct {
+	// Host name to resolve.
+	Host string
+
+	// Server port to append to the resolved IP addresses.
+	Port int
+
+	// Interval between host name re-resolutions.
+	// Default value is DefaultResolveInterval.
+	Interval time.Duration
+
+	// LogError is used for error logging.
+	//
+	// By default the function set via SetErrorLogger() is used.
+	LogError LoggerFunc
+}
+
+// Resolve sends addresses for the host to updates.
+func (r *DNSResolver) Resolve(updates chan<- []string, stopChan <-chan struct{}) {
+	port := strconv.Itoa(r.Port)
+	pollResolver(r.Interval, r.LogError, updates, stopChan, func() ([]string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+		defer cancel()
+		ips, err := net.DefaultResolver.LookupHost(ctx, r.Host)
+		if err != nil {
+			return nil, fmt.Errorf("gorpc.DNSResolver: cannot resolve [%s]: [%s]", r.Host, err)
+		}
+		addrs := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip, port))
+		}
+		return addrs, nil
+	})
+}
+
+// DNSSRVResolver is a Resolver periodically resolving server addresses
+// via DNS SRV records.
+//
+// See net.LookupSRV for details on Service, Proto and Name.
+type DNSSRVResolver struct {
+	// Service name, for instance "gorpc".
+	Service string
+
+	// Protocol name, for instance "tcp".
+	Proto string
+
+	// Domain name to lookup SRV records for.
+	Name string
+
+	// Interval between SRV records re-resolutions.
+	// Default value is DefaultResolveInterval.
+	Interval time.Duration
+
+	// LogError is used for error logging.
+	//
+	// By default the function set via SetErrorLogger() is used.
+	LogError LoggerFunc
+}
+
+// Resolve sends addresses from SRV records to updates.
+func (r *DNSSRVResolver) Resolve(updates chan<- []string, stopChan <-chan struct{}) {
+	pollResolver(r.Interval, r.LogError, updates, stopChan, func() ([]string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+		defer cancel()
+		_, srvs, err := net.DefaultResolver.LookupSRV(ctx, r.Service, r.Proto, r.Name)
+		if err != nil {
+			return nil, fmt.Errorf("gorpc.DNSSRVResolver: cannot resolve SRV records for service=[%s], proto=[%s], name=[%s]: [%s]",
+				r.Service, r.Proto, r.Name, err)
+		}
+		addrs := make([]string, 0, len(srvs))
+		for _, srv := range srvs {
+			host := strings.TrimSuffix(srv.Target, ".")
+			addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+		}
+		return addrs, nil
+	})
+}
+
+const dnsLookupTimeout = 10 * time.Second
+
+// pollResolver calls resolve every interval and sends the resolved
+// addresses to updates until stopChan is closed.
+//
+// The previously resolved addresses are kept on resolve errors.
+func pollResolver(interval time.Duration, logError LoggerFunc, updates chan<- []string, stopChan <-chan struct{}, resolve func() ([]string, error)) {
+	if interval <= 0 {
+		interval = DefaultResolveInterval
+	}
+	if logError == nil {
+		logError = errorLogger
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		addrs, err := resolve()
+		if err != nil {
+			logError("%s", err)
+		} else {
+			select {
+			case updates <- addrs:
+			case <-stopChan:
+				return
+			}
+		}
+
+		select {
+		case <-t.C:
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+// watchResolver runs the given resolver until stopChan is closed
+// and calls onUpdate for each distinct address set.
+//
+// Addresses passed to onUpdate are sorted and deduplicated.
+func watchResolver(r Resolver, stopChan <-chan struct{}, onUpdate func(addrs []string)) {
+	updates := make(chan []string)
+	resolverDone := make(chan struct{})
+	go func() {
+		r.Resolve(updates, stopChan)
+		close(resolverDone)
+	}()
+
+	var prevAddrs []string
+	for {
+		select {
+		case addrs := <-updates:
+			addrs = normalizeAddrs(addrs)
+			if prevAddrs != nil && equalAddrs(addrs, prevAddrs) {
+				continue
+			}
+			prevAddrs = addrs
+			onUpdate(addrs)
+		case <-stopChan:
+			<-resolverDone
+			return
+		}
+	}
+}
+
+func normalizeAddrs(addrs []string) []string {
+	m := make(map[string]struct{}, len(addrs))
+	result := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if _, ok := m[addr]; ok || addr == "" {
+			continue
+		}
+		m[addr] = struct{}{}
+		result = append(result, addr)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func equalAddrs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
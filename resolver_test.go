@@ -0,0 +1,274 @@
+package gorpc
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// testResolver sends address sets pushed to addrsChan.
+type testResolver struct {
+	addrsChan chan []string
+}
+
+func newTestResolver() *testResolver {
+	return &testResolver{
+		addrsChan: make(chan []string, 10),
+	}
+}
+
+func (r *testResolver) Resolve(updates chan<- []string, stopChan <-chan struct{}) {
+	for {
+		select {
+		case addrs := <-r.addrsChan:
+			select {
+			case updates <- addrs:
+			case <-stopChan:
+				return
+			}
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+func TestParseAddrs(t *testing.T) {
+	testParseAddrs(t, "", nil)
+	testParseAddrs(t, "foo:123", []string{"foo:123"})
+	testParseAddrs(t, "\n# comment\nfoo:123\n\n  bar:456  \n", []string{"foo:123", "bar:456"})
+	testParseAddrs(t, ` ["foo:123", "bar:456"] `, []string{"foo:123", "bar:456"})
+
+	if _, err := parseAddrs([]byte("[foo")); err == nil {
+		t.Fatalf("expecting error for invalid json")
+	}
+}
+
+func testParseAddrs(t *testing.T, s string, expectedAddrs []string) {
+	addrs, err := parseAddrs([]byte(s))
+	if err != nil {
+		t.Fatalf("unexpected error when parsing %q: [%s]", s, err)
+	}
+	if !equalAddrs(addrs, expectedAddrs) {
+		t.Fatalf("unexpected addrs parsed from %q: %v. Expected %v", s, addrs, expectedAddrs)
+	}
+}
+
+func TestNormalizeAddrs(t *testing.T) {
+	addrs := normalizeAddrs([]string{"b:1", "a:1", "", "b:1"})
+	expectedAddrs := []string{"a:1", "b:1"}
+	if !equalAddrs(addrs, expectedAddrs) {
+		t.Fatalf("unexpected addrs %v. Expected %v", addrs, expectedAddrs)
+	}
+}
+
+func TestStaticResolver(t *testing.T) {
+	r := StaticResolver{"foo:123", "bar:456"}
+	updates := make(chan []string)
+	stopChan := make(chan struct{})
+	doneChan := make(chan struct{})
+	go func() {
+		r.Resolve(updates, stopChan)
+		close(doneChan)
+	}()
+
+	addrs := <-updates
+	if !equalAddrs(addrs, r) {
+		t.Fatalf("unexpected addrs %v. Expected %v", addrs, r)
+	}
+
+	close(stopChan)
+	select {
+	case <-doneChan:
+	case <-time.After(time.Second):
+		t.Fatalf("StaticResolver didn't stop")
+	}
+}
+
+func TestFileResolver(t *testing.T) {
+	f, err := ioutil.TempFile("", "gorpc-resolver-test")
+	if err != nil {
+		t.Fatalf("cannot create temporary file: [%s]", err)
+	}
+	path := f.Name()
+	f.Close()
+	defer os.Remove(path)
+
+	if err = ioutil.WriteFile(path, []byte("foo:123\nbar:456\n"), 0600); err != nil {
+		t.Fatalf("cannot write addresses: [%s]", err)
+	}
+
+	r := &FileResolver{
+		Path:     path,
+		Interval: 10 * time.Millisecond,
+	}
+	updates := make(chan []string)
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	go r.Resolve(updates, stopChan)
+
+	expectResolvedAddrs(t, updates, []string{"foo:123", "bar:456"})
+
+	if err = ioutil.WriteFile(path, []byte(`["baz:789"]`), 0600); err != nil {
+		t.Fatalf("cannot write addresses: [%s]", err)
+	}
+	expectResolvedAddrs(t, updates, []string{"baz:789"})
+}
+
+func expectResolvedAddrs(t *testing.T, updates <-chan []string, expectedAddrs []string) {
+	tc := time.After(time.Second)
+	for {
+		select {
+		case addrs := <-updates:
+			if equalAddrs(addrs, expectedAddrs) {
+				return
+			}
+		case <-tc:
+			t.Fatalf("cannot obtain addrs %v from resolver", expectedAddrs)
+		}
+	}
+}
+
+func TestClientResolver(t *testing.T) {
+	servers := startBalancerServers(t, 2)
+	defer func() {
+		for _, s := range servers {
+			s.Stop()
+		}
+	}()
+	addrs := getServerAddrs(servers)
+
+	r := newTestResolver()
+	r.addrsChan <- addrs
+
+	c := &Client{
+		Resolver: r,
+	}
+	c.Start()
+	defer c.Stop()
+
+	waitForServerIDs(t, c.Call, []int{0, 1})
+
+	r.addrsChan <- addrs[1:]
+	waitForServerIDs(t, c.Call, []int{1})
+}
+
+func TestClientResolverDrain(t *testing.T) {
+	s := &Server{
+		Addr: getRandomAddr(),
+		Handler: func(clientAddr string, request interface{}) interface{} {
+			time.Sleep(200 * time.Millisecond)
+			return request
+		},
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	r := newTestResolver()
+	r.addrsChan <- []string{s.Addr}
+
+	closedChan := make(chan struct{}, 1)
+	c := &Client{
+		Resolver: r,
+		OnConnectionStateChange: func(addr string, state ConnectionState, err error) {
+			if state == ConnectionClosed {
+				closedChan <- struct{}{}
+			}
+		},
+	}
+	c.Start()
+	defer c.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.WaitConnected(ctx); err != nil {
+		t.Fatalf("cannot connect to the server: [%s]", err)
+	}
+	ar, err := c.CallAsync(123)
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// The draining connection mustn't be counted in ConnectedConns.
+	r.addrsChan <- nil
+	for i := 0; i < 100 && c.ConnectedConns() > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if n := c.ConnectedConns(); n != 0 {
+		t.Fatalf("unexpected number of connected conns: %d. Expected 0", n)
+	}
+
+	// The pending request must obtain the response after the address removal.
+	<-ar.Done
+	if ar.Error != nil {
+		t.Fatalf("unexpected error: [%s]", ar.Error)
+	}
+	if ar.Response.(int) != 123 {
+		t.Fatalf("unexpected response: %v. Expected 123", ar.Response)
+	}
+
+	// The drained connection must be closed.
+	select {
+	case <-closedChan:
+	case <-time.After(time.Second):
+		t.Fatalf("the connection to the removed address hasn't been closed")
+	}
+}
+
+func TestBalancingClientResolver(t *testing.T) {
+	servers := startBalancerServers(t, 3)
+	defer func() {
+		for _, s := range servers {
+			s.Stop()
+		}
+	}()
+	addrs := getServerAddrs(servers)
+
+	r := newTestResolver()
+	r.addrsChan <- addrs[:2]
+
+	bc := &BalancingClient{
+		Resolver: r,
+	}
+	bc.Start()
+	defer bc.Stop()
+
+	waitForServerIDs(t, bc.Call, []int{0, 1})
+
+	r.addrsChan <- addrs[1:]
+	waitForServerIDs(t, bc.Call, []int{1, 2})
+
+	if n := len(bc.Clients()); n != 2 {
+		t.Fatalf("unexpected number of clients: %d. Expected 2", n)
+	}
+}
+
+// waitForServerIDs waits until calls reach only the servers
+// with the given ids.
+func waitForServerIDs(t *testing.T, call func(request interface{}) (interface{}, error), expectedIDs []int) {
+	for i := 0; i < 100; i++ {
+		ids := make(map[int]bool)
+		for j := 0; j < 50; j++ {
+			resp, err := call(j)
+			if err != nil {
+				continue
+			}
+			ids[resp.(int)] = true
+		}
+		if len(ids) == len(expectedIDs) {
+			ok := true
+			for _, id := range expectedIDs {
+				ok = ok && ids[id]
+			}
+			if ok {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("cannot wait for calls reaching only servers %v", expectedIDs)
+}
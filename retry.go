@@ -0,0 +1,117 @@
+package gorpc
+
+import (
+	"context"
+	"time"
+)
+
+// RetryPolicy determines how failed calls are retried.
+//
+// Retry policy may be set via Client.RetryPolicy and overridden
+// per function via DispatcherClient.SetRetryPolicy.
+//
+// Retries must be enabled only for idempotent calls, since the server
+// may process the same request multiple times.
+//
+// All the attempts and delays between them share the timeout
+// of the call, i.e. retries never extend the call timeout.
+type RetryPolicy struct {
+	// The maximum number of attempts including the first one.
+	// Default value is DefaultRetryAttempts.
+	MaxAttempts int
+
+	// Backoff determines delays between attempts.
+	//
+	// The attempt isn't retried if the delay exceeds the time left
+	// until the call timeout.
+	//
+	// By default ExponentialBackoff with default settings is used.
+	Backoff Backoff
+
+	// The maximum duration of a single attempt.
+	//
+	// This allows retrying timed out attempts.
+	// By default each attempt may take all the time left until
+	// the call timeout.
+	AttemptTimeout time.Duration
+
+	// Retryable must return true if the call failed with the given error
+	// may be retried.
+	//
+	// By default only ClientError.Connection, ClientError.Overflow
+	// and ClientError.Rejected errors are retried, since the server
+	// didn't process the request in the majority of such cases.
+	// ClientError.Oversized errors aren't retried by default.
+	Retryable func(err *ClientError) bool
+}
+
+var defaultRetryBackoff = &ExponentialBackoff{}
+
+func isRetryableByDefault(err *ClientError) bool {
+	return err.Connection || err.Overflow || (err.Rejected && !err.Oversized)
+}
+
+// call calls f until it succeeds, returns non-retryable error,
+// the number of attempts exceeds MaxAttempts or the timeout elapses.
+//
+// f must return response during the given timeout.
+// The call is interrupted if doneCh is closed.
+func (p *RetryPolicy) call(timeout time.Duration, doneCh <-chan struct{}, f func(timeout time.Duration) (interface{}, error)) (response interface{}, err error) {
+	maxAttempts := p.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultRetryAttempts
+	}
+	backoff := p.Backoff
+	if backoff == nil {
+		backoff = defaultRetryBackoff
+	}
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = isRetryableByDefault
+	}
+
+	deadline := time.Now().Add(timeout)
+	for attempt := 1; ; attempt++ {
+		attemptTimeout := time.Until(deadline)
+		if p.AttemptTimeout > 0 && p.AttemptTimeout < attemptTimeout {
+			attemptTimeout = p.AttemptTimeout
+		}
+
+		if response, err = f(attemptTimeout); err == nil {
+			return response, nil
+		}
+		if attempt >= maxAttempts {
+			return nil, err
+		}
+		ce, ok := err.(*ClientError)
+		if !ok || !retryable(ce) {
+			return nil, err
+		}
+
+		delay := backoff.Delay(attempt)
+		if time.Until(deadline) <= delay {
+			return nil, err
+		}
+		t := acquireTimer(delay)
+		select {
+		case <-t.C:
+		case <-doneCh:
+			releaseTimer(t)
+			return nil, err
+		}
+		releaseTimer(t)
+	}
+}
+
+// callContext calls f with attempt contexts derived from the given ctx
+// until it succeeds or the retry policy stops retrying.
+//
+// ctx must have a deadline.
+func (p *RetryPolicy) callContext(ctx context.Context, f func(ctx context.Context) (interface{}, error)) (response interface{}, err error) {
+	deadline, _ := ctx.Deadline()
+	return p.call(time.Until(deadline), ctx.Done(), func(timeout time.Duration) (interface{}, error) {
+		attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return f(attemptCtx)
+	})
+}
@@ -0,0 +1,198 @@
+package gorpc
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newFlakyServer(t *testing.T, failures uint32) (s *Server, calls *uint32) {
+	calls = new(uint32)
+	s = startTestServer(t, &Server{
+		Handler: func(clientAddr string, request interface{}) interface{} {
+			if atomic.AddUint32(calls, 1) <= failures {
+				panic("flaky server")
+			}
+			return request
+		},
+	})
+	return s, calls
+}
+
+func isServerError(err *ClientError) bool {
+	return err.Server
+}
+
+func TestRetryPolicyServerError(t *testing.T) {
+	s, calls := newFlakyServer(t, 2)
+	defer s.Stop()
+
+	c := &Client{
+		Addr: s.Addr,
+		RetryPolicy: &RetryPolicy{
+			MaxAttempts: 3,
+			Backoff:     ConstantBackoff(time.Millisecond),
+			Retryable:   isServerError,
+		},
+	}
+	c.Start()
+	defer c.Stop()
+
+	resp, err := c.Call(123)
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	if resp.(int) != 123 {
+		t.Fatalf("unexpected response: %v. Expected 123", resp)
+	}
+	if n := atomic.LoadUint32(calls); n != 3 {
+		t.Fatalf("unexpected number of attempts: %d. Expected 3", n)
+	}
+}
+
+func TestRetryPolicyMaxAttempts(t *testing.T) {
+	s, calls := newFlakyServer(t, 10)
+	defer s.Stop()
+
+	c := &Client{
+		Addr: s.Addr,
+		RetryPolicy: &RetryPolicy{
+			MaxAttempts: 3,
+			Backoff:     ConstantBackoff(time.Millisecond),
+			Retryable:   isServerError,
+		},
+	}
+	c.Start()
+	defer c.Stop()
+
+	_, err := c.CallContext(context.Background(), 123)
+	if err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	if !err.(*ClientError).Server {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	if n := atomic.LoadUint32(calls); n != 3 {
+		t.Fatalf("unexpected number of attempts: %d. Expected 3", n)
+	}
+}
+
+func TestRetryPolicyNonRetryableError(t *testing.T) {
+	s, calls := newFlakyServer(t, 10)
+	defer s.Stop()
+
+	c := &Client{
+		Addr:        s.Addr,
+		RetryPolicy: &RetryPolicy{},
+	}
+	c.Start()
+	defer c.Stop()
+
+	// Server errors aren't retried by default.
+	if _, err := c.Call(123); err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	if n := atomic.LoadUint32(calls); n != 1 {
+		t.Fatalf("unexpected number of attempts: %d. Expected 1", n)
+	}
+}
+
+func TestRetryPolicyOversizedRequest(t *testing.T) {
+	s := startTestServer(t, &Server{
+		Handler:        echoHandler,
+		MaxRequestSize: 1024,
+	})
+	defer s.Stop()
+
+	c := &Client{
+		Addr: s.Addr,
+		RetryPolicy: &RetryPolicy{
+			MaxAttempts: 5,
+			Backoff:     ConstantBackoff(time.Millisecond),
+		},
+	}
+	c.Start()
+	defer c.Stop()
+
+	// Oversized requests cannot succeed, so they aren't retried by default.
+	_, err := c.Call(strings.Repeat("x", 2048))
+	if err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	ce := err.(*ClientError)
+	if !ce.Rejected || !ce.Oversized {
+		t.Fatalf("unexpected error: [%s]. Expecting oversized error", err)
+	}
+	if n := c.Stats.Snapshot().OversizedMessages; n != 1 {
+		t.Fatalf("unexpected number of attempts: %d. Expected 1", n)
+	}
+
+	// Other rejections are transient, so they are retried.
+	if !isRetryableByDefault(&ClientError{Rejected: true}) {
+		t.Fatalf("rejected errors must be retried by default")
+	}
+}
+
+func TestRetryPolicyAttemptTimeout(t *testing.T) {
+	var calls uint32
+	s := &Server{
+		Addr: getRandomAddr(),
+		Handler: func(clientAddr string, request interface{}) interface{} {
+			if atomic.AddUint32(&calls, 1) == 1 {
+				time.Sleep(time.Second)
+			}
+			return request
+		},
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := &Client{
+		Addr: s.Addr,
+		RetryPolicy: &RetryPolicy{
+			AttemptTimeout: 50 * time.Millisecond,
+			Backoff:        ConstantBackoff(time.Millisecond),
+			Retryable: func(err *ClientError) bool {
+				return err.Timeout
+			},
+		},
+	}
+	c.Start()
+	defer c.Stop()
+
+	resp, err := c.CallTimeout(123, 500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	if resp.(int) != 123 {
+		t.Fatalf("unexpected response: %v. Expected 123", resp)
+	}
+}
+
+func TestRetryPolicyBudget(t *testing.T) {
+	s, _ := newFlakyServer(t, 1000000)
+	defer s.Stop()
+
+	c := &Client{
+		Addr: s.Addr,
+		RetryPolicy: &RetryPolicy{
+			MaxAttempts: 1000000,
+			Backoff:     ConstantBackoff(10 * time.Millisecond),
+			Retryable:   isServerError,
+		},
+	}
+	c.Start()
+	defer c.Stop()
+
+	startTime := time.Now()
+	if _, err := c.CallTimeout(123, 100*time.Millisecond); err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+	if d := time.Since(startTime); d > 500*time.Millisecond {
+		t.Fatalf("retries exceeded call timeout: %s", d)
+	}
+}
@@ -1,13 +1,21 @@
 package gorpc
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
+	"os"
 	"reflect"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -22,10 +30,26 @@ func echoHandler(clientAddr string, request interface{}) interface{} {
 	return request
 }
 
+func echoBytesHandler(clientAddr string, request, dst []byte) []byte {
+	return append(dst, request...)
+}
+
 func getRandomAddr() string {
 	return fmt.Sprintf("127.0.0.1:%d", rand.Intn(20000)+10000)
 }
 
+// startTestServer starts the given server on a random address
+// unless the address is set.
+func startTestServer(t *testing.T, s *Server) *Server {
+	if s.Addr == "" {
+		s.Addr = getRandomAddr()
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	return s
+}
+
 func TestBadClient(t *testing.T) {
 	addr := getRandomAddr()
 	s := NewTCPServer(addr, echoHandler)
@@ -89,6 +113,8 @@ func TestBadServer(t *testing.T) {
 	// enabled compression
 	c := NewTCPClient(addr)
 	c.DisableCompression = false
+	c.LegacyHandshake = true
+	c.ReconnectPolicy = ConstantBackoff(10 * time.Millisecond)
 	c.Start()
 	for i := 0; i < 10; i++ {
 		c.Call("foobarbaz")
@@ -98,12 +124,26 @@ func TestBadServer(t *testing.T) {
 	// disabled compression
 	c = NewTCPClient(addr)
 	c.DisableCompression = true
+	c.LegacyHandshake = true
+	c.ReconnectPolicy = ConstantBackoff(10 * time.Millisecond)
 	c.Start()
 	for i := 0; i < 10; i++ {
 		c.Call("foobarbaz")
 	}
 	c.Stop()
 
+	// versioned handshake. Requests aren't sent to the server,
+	// since the handshake fails, so they time out.
+	c = NewTCPClient(addr)
+	c.RequestTimeout = 10 * time.Millisecond
+	c.Start()
+	for i := 0; i < 10; i++ {
+		if _, err := c.Call("foobarbaz"); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+	c.Stop()
+
 	ln.Close()
 	<-doneCh
 }
@@ -264,36 +304,53 @@ func TestCallTimeout(t *testing.T) {
 	}
 }
 
-func TestNoServer(t *testing.T) {
+func TestCallContextTimeout(t *testing.T) {
+	addr := getRandomAddr()
+	s := &Server{
+		Addr: addr,
+		Handler: func(clientAddr string, request interface{}) interface{} {
+			time.Sleep(10 * time.Second)
+			return request
+		},
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
 	c := &Client{
-		Addr:           getRandomAddr(),
-		RequestTimeout: 100 * time.Millisecond,
+		Addr: addr,
 	}
 	c.Start()
 	defer c.Stop()
 
-	resp, err := c.Call("foobar")
-	if err == nil {
-		t.Fatalf("Timeout error must be returned")
-	}
-	if !err.(*ClientError).Timeout {
-		t.Fatalf("Unexpected error: [%s]", err)
-	}
-	if resp != nil {
-		t.Fatalf("Unepxected response: %+v. Expected nil", resp)
+	for i := 0; i < 10; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		resp, err := c.CallContext(ctx, 123)
+		cancel()
+		if err == nil {
+			t.Fatalf("Timeout error must be returned")
+		}
+		if !err.(*ClientError).Timeout {
+			t.Fatalf("Unexpected error returned: [%s]", err)
+		}
+		if resp != nil {
+			t.Fatalf("Unexpected response %+v: expected nil", resp)
+		}
 	}
 }
 
-func TestServerPanic(t *testing.T) {
+func TestCallContextCancel(t *testing.T) {
 	addr := getRandomAddr()
+	var handlerCalls uint32
 	s := &Server{
 		Addr: addr,
 		Handler: func(clientAddr string, request interface{}) interface{} {
-			if request.(string) == "foobar" {
-				panic("server panic")
-			}
+			atomic.AddUint32(&handlerCalls, 1)
+			time.Sleep(200 * time.Millisecond)
 			return request
 		},
+		Concurrency: 1,
 	}
 	if err := s.Start(); err != nil {
 		t.Fatalf("Server.Start() failed: [%s]", err)
@@ -306,40 +363,65 @@ func TestServerPanic(t *testing.T) {
 	c.Start()
 	defer c.Stop()
 
-	for i := 0; i < 3; i++ {
-		resp, err := c.Call("foobar")
+	// Occupy the only server worker.
+	slowRes, err := c.CallAsync(123)
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			cancel()
+		}()
+		resp, err := c.CallContext(ctx, 456)
 		if err == nil {
-			t.Fatalf("Unexpected nil error")
+			t.Fatalf("Canceled error must be returned")
 		}
-		if resp != nil {
-			t.Fatalf("Unepxected response for panicing server: %+v. Expected nil", resp)
+		if !err.(*ClientError).Canceled {
+			t.Fatalf("Unexpected error returned: [%s]", err)
 		}
-		if !err.(*ClientError).Server {
-			t.Fatalf("Unexpected error type: %v. Expected server error", err)
+		if resp != nil {
+			t.Fatalf("Unexpected response %+v: expected nil", resp)
 		}
 	}
 
-	for i := 0; i < 3; i++ {
-		resp, err := c.Call("aaaaa")
-		if err != nil {
-			t.Fatalf("Unexpected error: [%s]", err)
-		}
-		if resp == nil {
-			t.Fatalf("Unepxected nil response")
-		}
-		if resp.(string) != "aaaaa" {
-			t.Fatalf("Unexpected response: %v. Expected 'aaaaa'", resp)
-		}
+	select {
+	case <-slowRes.Done:
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+	if slowRes.Error != nil {
+		t.Fatalf("unexpected error: [%s]", slowRes.Error)
+	}
+
+	// Make sure the server didn't process canceled calls.
+	resp, err := c.Call(789)
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	if resp.(int) != 789 {
+		t.Fatalf("unexpected response: %v. Expecting 789", resp)
+	}
+	if n := atomic.LoadUint32(&handlerCalls); n >= 7 {
+		t.Fatalf("expecting at least one canceled call to be skipped by the server. Handler calls: %d", n)
 	}
 }
 
-func TestServerStuck(t *testing.T) {
+func TestHandlerCtxCancel(t *testing.T) {
 	addr := getRandomAddr()
+	canceledCh := make(chan struct{}, 1)
 	s := &Server{
 		Addr: addr,
-		Handler: func(clientAddr string, request interface{}) interface{} {
-			time.Sleep(time.Second)
-			return "aaa"
+		HandlerCtx: func(ctx context.Context, clientAddr string, request interface{}) interface{} {
+			select {
+			case <-ctx.Done():
+				canceledCh <- struct{}{}
+			case <-time.After(10 * time.Second):
+			}
+			return request
 		},
 	}
 	if err := s.Start(); err != nil {
@@ -348,126 +430,498 @@ func TestServerStuck(t *testing.T) {
 	defer s.Stop()
 
 	c := &Client{
-		Addr:            addr,
-		PendingRequests: 100,
+		Addr: addr,
 	}
 	c.Start()
 	defer c.Stop()
 
-	var res [1500]*AsyncResult
-	var err error
-	for j := 0; j < 15; j++ {
-		for i := 0; i < 100; i++ {
-			res[i+100*j], err = c.CallAsync("abc")
-			if err != nil {
-				t.Fatalf("%d. Unexpected error in CallAsync: [%s]", j*100+i, err)
-			}
-		}
-		// This should prevent from overflow errors.
-		time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.CallContext(ctx, 123); err == nil {
+		t.Fatalf("Timeout error must be returned")
 	}
 
-	stuckErrors := 0
+	select {
+	case <-canceledCh:
+	case <-time.After(time.Second):
+		t.Fatalf("handler context wasn't canceled after the call cancellation")
+	}
+}
 
-	timer := acquireTimer(300 * time.Millisecond)
-	defer releaseTimer(timer)
+func TestHandlerCtxClientDisconnect(t *testing.T) {
+	addr := getRandomAddr()
+	startedCh := make(chan struct{}, 1)
+	canceledCh := make(chan struct{}, 1)
+	s := &Server{
+		Addr: addr,
+		HandlerCtx: func(ctx context.Context, clientAddr string, request interface{}) interface{} {
+			startedCh <- struct{}{}
+			select {
+			case <-ctx.Done():
+				canceledCh <- struct{}{}
+			case <-time.After(10 * time.Second):
+			}
+			return request
+		},
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
 
-	for i := 0; i < 1500; i++ {
-		r := res[i]
-		select {
-		case <-r.Done:
-		case <-timer.C:
-			goto exit
-		}
+	c := &Client{
+		Addr: addr,
+	}
+	c.Start()
 
-		if r.Error == nil {
-			t.Fatalf("Stuck server returned response? %+v", r.Response)
-		}
-		ce := r.Error.(*ClientError)
-		if ce.Connection {
-			stuckErrors++
-		} else if !ce.Overflow {
-			t.Fatalf("Unexpected error returned: [%s]", ce)
-		}
-		if r.Response != nil {
-			t.Fatalf("Unexpected response from stuck server: %+v", r.Response)
-		}
+	if _, err := c.CallAsync(123); err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
 	}
-exit:
+	select {
+	case <-startedCh:
+	case <-time.After(time.Second):
+		t.Fatalf("handler wasn't called")
+	}
+	c.Stop()
 
-	if stuckErrors == 0 {
-		t.Fatalf("Stuck server detector doesn't work?")
+	select {
+	case <-canceledCh:
+	case <-time.After(time.Second):
+		t.Fatalf("handler context wasn't canceled after client disconnect")
 	}
 }
 
-type customConn struct {
-	r io.ReadCloser
-	w io.WriteCloser
-}
+func TestExpiredRequestsDropped(t *testing.T) {
+	addr := getRandomAddr()
+	var handlerCalls uint32
+	s := &Server{
+		Addr: addr,
+		Handler: func(clientAddr string, request interface{}) interface{} {
+			atomic.AddUint32(&handlerCalls, 1)
+			time.Sleep(200 * time.Millisecond)
+			return request
+		},
+		Concurrency: 1,
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
 
-func (c *customConn) Read(p []byte) (int, error) {
-	return c.r.Read(p)
-}
+	c := &Client{
+		Addr: addr,
+	}
+	c.Start()
+	defer c.Stop()
 
-func (c *customConn) Write(p []byte) (int, error) {
-	return c.w.Write(p)
-}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.CallTimeout(123, 50*time.Millisecond)
+		}()
+	}
+	wg.Wait()
 
-func (c *customConn) Close() error {
-	c.r.Close()
-	return c.w.Close()
-}
+	// Wait until the server drains its' queue.
+	time.Sleep(300 * time.Millisecond)
 
-type customListener struct {
-	remoteAddr string
-	r          io.ReadCloser
-	w          io.WriteCloser
-	ch         chan struct{}
+	if n := atomic.LoadUint32(&handlerCalls); n >= 10 {
+		t.Fatalf("expecting expired requests to be dropped by the server. Handler calls: %d", n)
+	}
+	if n := s.Stats.Snapshot().ExpiredRequests; n == 0 {
+		t.Fatalf("expecting non-zero ExpiredRequests stats")
+	}
 }
 
-func newCustomListener(remoteAddr string, r io.ReadCloser, w io.WriteCloser) *customListener {
-	return &customListener{
-		remoteAddr: remoteAddr,
-		r:          r,
-		w:          w,
+func TestHandlerCtxDeadline(t *testing.T) {
+	addr := getRandomAddr()
+	s := &Server{
+		Addr: addr,
+		HandlerCtx: func(ctx context.Context, clientAddr string, request interface{}) interface{} {
+			deadline, ok := ctx.Deadline()
+			if !ok {
+				return int64(0)
+			}
+			return int64(time.Until(deadline))
+		},
 	}
-}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
 
-func (ln *customListener) Init(addr string) error {
-	ln.ch = make(chan struct{}, 1)
-	ln.ch <- struct{}{}
-	return nil
-}
+	c := &Client{
+		Addr: addr,
+	}
+	c.Start()
+	defer c.Stop()
 
-func (ln *customListener) Accept() (conn io.ReadWriteCloser, clientAddr string, err error) {
-	_, ok := <-ln.ch
-	if !ok {
-		return nil, "", fmt.Errorf("listener is closed")
+	resp, err := c.CallTimeout(123, 10*time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	d := time.Duration(resp.(int64))
+	if d <= 0 || d > 10*time.Second {
+		t.Fatalf("unexpected time left until deadline in the handler: %s", d)
+	}
+
+	// Requests without deadline must work as usual.
+	ar, err := c.CallAsync(123)
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	<-ar.Done
+	if ar.Error != nil {
+		t.Fatalf("unexpected error: [%s]", ar.Error)
+	}
+	if d = time.Duration(ar.Response.(int64)); d != 0 {
+		t.Fatalf("unexpected deadline for request without deadline: %s", d)
 	}
-	return &customConn{
-		r: ln.r,
-		w: ln.w,
-	}, ln.remoteAddr, nil
 }
 
-func (ln *customListener) Close() error {
-	close(ln.ch)
-	return nil
+func TestNoServer(t *testing.T) {
+	c := &Client{
+		Addr:           getRandomAddr(),
+		RequestTimeout: 100 * time.Millisecond,
+	}
+	c.Start()
+	defer c.Stop()
+
+	resp, err := c.Call("foobar")
+	if err == nil {
+		t.Fatalf("Timeout error must be returned")
+	}
+	if !err.(*ClientError).Timeout {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	if resp != nil {
+		t.Fatalf("Unepxected response: %+v. Expected nil", resp)
+	}
 }
 
-func (ln *customListener) ListenAddr() net.Addr {
-	return nil
+func TestClientReconnectPolicy(t *testing.T) {
+	var attempts []int
+	var attemptsLock sync.Mutex
+	c := &Client{
+		Addr: getRandomAddr(),
+		ReconnectPolicy: BackoffFunc(func(attempt int) time.Duration {
+			attemptsLock.Lock()
+			attempts = append(attempts, attempt)
+			attemptsLock.Unlock()
+			return 10 * time.Millisecond
+		}),
+	}
+	c.Start()
+	time.Sleep(200 * time.Millisecond)
+	c.Stop()
+
+	attemptsLock.Lock()
+	defer attemptsLock.Unlock()
+	if len(attempts) < 3 {
+		t.Fatalf("too small number of reconnect attempts: %d. Expected at least 3", len(attempts))
+	}
+	for i, attempt := range attempts {
+		if attempt != i+1 {
+			t.Fatalf("unexpected attempt number %d. Expected %d", attempt, i+1)
+		}
+	}
+	stats := c.Stats.Snapshot()
+	if stats.ReconnectAttempts == 0 {
+		t.Fatalf("expecting non-zero ReconnectAttempts stats")
+	}
 }
 
-func TestCustomTransport(t *testing.T) {
-	rc, ws := io.Pipe()
-	rs, wc := io.Pipe()
+func TestClientReconnectPolicyAfterClose(t *testing.T) {
+	addr := getRandomAddr()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("cannot listen on [%s]: [%s]", addr, err)
+	}
+	defer ln.Close()
+
+	// The server closes connections right after accepting them.
+	var accepts uint32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddUint32(&accepts, 1)
+			conn.Close()
+		}
+	}()
+
+	var attempts []int
+	var attemptsLock sync.Mutex
+	c := &Client{
+		Addr: addr,
+		ReconnectPolicy: BackoffFunc(func(attempt int) time.Duration {
+			attemptsLock.Lock()
+			attempts = append(attempts, attempt)
+			attemptsLock.Unlock()
+			return 50 * time.Millisecond
+		}),
+		LogError: func(format string, args ...interface{}) {},
+	}
+	c.Start()
+	time.Sleep(300 * time.Millisecond)
+	c.Stop()
+
+	// The client must delay reconnects after failed handshakes
+	// instead of redialing in a loop.
+	if n := atomic.LoadUint32(&accepts); n > 8 {
+		t.Fatalf("too many connections: %d. Expected no more than 8", n)
+	}
+	attemptsLock.Lock()
+	defer attemptsLock.Unlock()
+	for i, attempt := range attempts {
+		if attempt != i+1 {
+			t.Fatalf("unexpected attempt number %d. Expected %d", attempt, i+1)
+		}
+	}
+}
+
+func TestClientWaitConnected(t *testing.T) {
+	addr := getRandomAddr()
+	c := &Client{
+		Addr:            addr,
+		ReconnectPolicy: ConstantBackoff(10 * time.Millisecond),
+	}
+	c.Start()
+	defer c.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	err := c.WaitConnected(ctx)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error: [%v]. Expected [%s]", err, context.DeadlineExceeded)
+	}
+	if c.IsConnected() {
+		t.Fatalf("the client mustn't be connected without the server")
+	}
 
 	s := &Server{
-		Listener: newCustomListener("foobar", rs, ws),
+		Addr:    addr,
+		Handler: func(clientAddr string, request interface{}) interface{} { return request },
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	err = c.WaitConnected(ctx)
+	cancel()
+	if err != nil {
+		t.Fatalf("cannot wait for the connection: [%s]", err)
+	}
+	if !c.IsConnected() || c.ConnectedConns() != 1 {
+		t.Fatalf("unexpected number of connected conns: %d. Expected 1", c.ConnectedConns())
+	}
+}
+
+func TestClientConnectionStateChange(t *testing.T) {
+	addr := getRandomAddr()
+	statesChan := make(chan ConnectionState, 100)
+	lastState := ConnectionState(-1)
+	c := &Client{
+		Addr:            addr,
+		ReconnectPolicy: ConstantBackoff(10 * time.Millisecond),
+		OnConnectionStateChange: func(stateAddr string, state ConnectionState, err error) {
+			if stateAddr != addr {
+				t.Errorf("unexpected addr %q. Expected %q", stateAddr, addr)
+			}
+			if state == ConnectionDialFailed && err == nil {
+				t.Errorf("expecting non-nil error for %s state", state)
+			}
+			// Skip repeated dial failures, so statesChan isn't overflown.
+			if state != lastState {
+				lastState = state
+				statesChan <- state
+			}
+		},
+	}
+	c.Start()
+	defer c.Stop()
+
+	expectConnectionState(t, statesChan, ConnectionDialFailed)
+
+	s := &Server{
+		Addr:    addr,
+		Handler: func(clientAddr string, request interface{}) interface{} { return request },
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	expectConnectionState(t, statesChan, ConnectionEstablished)
+
+	s.Stop()
+	expectConnectionState(t, statesChan, ConnectionClosed)
+}
+
+func expectConnectionState(t *testing.T, statesChan <-chan ConnectionState, expectedState ConnectionState) {
+	tc := time.After(time.Second)
+	for {
+		select {
+		case state := <-statesChan:
+			if state == expectedState {
+				return
+			}
+		case <-tc:
+			t.Fatalf("cannot obtain %s connection state", expectedState)
+		}
+	}
+}
+
+func TestServerShutdownDrainsInFlightRequests(t *testing.T) {
+	s := &Server{
+		Addr: getRandomAddr(),
 		Handler: func(clientAddr string, request interface{}) interface{} {
-			if clientAddr != "foobar" {
-				t.Fatalf("Unexpected client address: [%s]. Expected [foobar]", clientAddr)
+			time.Sleep(200 * time.Millisecond)
+			return request
+		},
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+
+	c := &Client{
+		Addr: s.Addr,
+	}
+	c.Start()
+	defer c.Stop()
+
+	var results []*AsyncResult
+	for i := 0; i < 10; i++ {
+		m, err := c.CallAsync(i)
+		if err != nil {
+			t.Fatalf("unexpected error: [%s]", err)
+		}
+		results = append(results, m)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("unexpected error on shutdown: [%s]", err)
+	}
+
+	for i, m := range results {
+		<-m.Done
+		if m.Error != nil {
+			t.Fatalf("unexpected error: [%s]", m.Error)
+		}
+		if m.Response.(int) != i {
+			t.Fatalf("unexpected response: %v. Expected %d", m.Response, i)
+		}
+	}
+}
+
+func TestInFlightRequests(t *testing.T) {
+	var r inFlightRequests
+	select {
+	case <-r.done():
+	default:
+		t.Fatalf("done() must be closed without in-flight requests")
+	}
+
+	if n := r.inc(); n != 1 {
+		t.Fatalf("unexpected number of in-flight requests: %d. Expected 1", n)
+	}
+	if n := r.inc(); n != 2 {
+		t.Fatalf("unexpected number of in-flight requests: %d. Expected 2", n)
+	}
+	done := r.done()
+	r.dec()
+	select {
+	case <-done:
+		t.Fatalf("done() mustn't be closed while requests are in flight")
+	default:
+	}
+	r.dec()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("done() must be closed after processing all the requests")
+	}
+}
+
+func TestServerShutdownRejectsNewRequests(t *testing.T) {
+	startedChan := make(chan struct{}, 1)
+	releaseChan := make(chan struct{})
+	s := &Server{
+		Addr: getRandomAddr(),
+		Handler: func(clientAddr string, request interface{}) interface{} {
+			if request.(string) == "slow" {
+				startedChan <- struct{}{}
+				<-releaseChan
+			}
+			return request
+		},
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+
+	// Legacy clients without compression don't support GOAWAY control
+	// frames, so they may send requests to the server being shut down.
+	c := &Client{
+		Addr:               s.Addr,
+		DisableCompression: true,
+		LegacyHandshake:    true,
+	}
+	c.Start()
+	defer c.Stop()
+
+	slow, err := c.CallAsync("slow")
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	<-startedChan
+
+	shutdownDone := make(chan error, 1)
+	go func() {
+		shutdownDone <- s.Shutdown(context.Background())
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	_, err = c.Call("fast")
+	if err == nil {
+		t.Fatalf("expecting non-nil error for request sent during shutdown")
+	}
+	if !err.(*ClientError).Connection {
+		t.Fatalf("expecting connection error. Got [%s]", err)
+	}
+
+	close(releaseChan)
+	if err = <-shutdownDone; err != nil {
+		t.Fatalf("unexpected error on shutdown: [%s]", err)
+	}
+	<-slow.Done
+	if slow.Error != nil {
+		t.Fatalf("unexpected error: [%s]", slow.Error)
+	}
+	if slow.Response.(string) != "slow" {
+		t.Fatalf("unexpected response: %v. Expected %q", slow.Response, "slow")
+	}
+}
+
+func TestServerShutdownGoAway(t *testing.T) {
+	var fastCalls uint32
+	startedChan := make(chan struct{}, 1)
+	releaseChan := make(chan struct{})
+	s := &Server{
+		Addr: getRandomAddr(),
+		Handler: func(clientAddr string, request interface{}) interface{} {
+			if request.(string) == "slow" {
+				startedChan <- struct{}{}
+				<-releaseChan
+			} else {
+				atomic.AddUint32(&fastCalls, 1)
 			}
 			return request
 		},
@@ -475,191 +929,1586 @@ func TestCustomTransport(t *testing.T) {
 	if err := s.Start(); err != nil {
 		t.Fatalf("Server.Start() failed: [%s]", err)
 	}
+
+	c := &Client{
+		Addr:            s.Addr,
+		ReconnectPolicy: ConstantBackoff(10 * time.Millisecond),
+	}
+	c.Start()
+	defer c.Stop()
+
+	slow, err := c.CallAsync("slow")
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	<-startedChan
+
+	shutdownDone := make(chan error, 1)
+	go func() {
+		shutdownDone <- s.Shutdown(context.Background())
+	}()
+	for i := 0; i < 100 && c.Stats.Snapshot().GoAwayFrames == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := c.Stats.Snapshot().GoAwayFrames; n != 1 {
+		t.Fatalf("unexpected number of GOAWAY frames obtained by the client: %d. Expected 1", n)
+	}
+	for i := 0; i < 100 && c.ConnectedConns() > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if n := c.ConnectedConns(); n != 0 {
+		t.Fatalf("unexpected number of connected conns after GOAWAY: %d. Expected 0", n)
+	}
+
+	// The request mustn't be sent to the draining connection.
+	_, err = c.CallTimeout("fast", 100*time.Millisecond)
+	if err == nil || !err.(*ClientError).Timeout {
+		t.Fatalf("expecting timeout error. Got [%v]", err)
+	}
+	if n := atomic.LoadUint32(&fastCalls); n != 0 {
+		t.Fatalf("unexpected number of requests sent to the draining connection: %d. Expected 0", n)
+	}
+
+	// Responses for in-flight requests must be delivered.
+	close(releaseChan)
+	if err = <-shutdownDone; err != nil {
+		t.Fatalf("unexpected error on shutdown: [%s]", err)
+	}
+	<-slow.Done
+	if slow.Error != nil {
+		t.Fatalf("unexpected error: [%s]", slow.Error)
+	}
+
+	// The client must reconnect after the server restart.
+	if err = s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+	resp, err := c.Call("fast")
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	if resp.(string) != "fast" {
+		t.Fatalf("unexpected response: %v. Expected %q", resp, "fast")
+	}
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	releaseChan := make(chan struct{})
+	defer close(releaseChan)
+	s := &Server{
+		Addr: getRandomAddr(),
+		Handler: func(clientAddr string, request interface{}) interface{} {
+			<-releaseChan
+			return request
+		},
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+
+	c := &Client{
+		Addr: s.Addr,
+	}
+	c.Start()
+	defer c.Stop()
+
+	m, err := c.CallAsync(123)
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err = s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error on shutdown: [%v]. Expected [%s]", err, context.DeadlineExceeded)
+	}
+
+	<-m.Done
+	if m.Error == nil || !m.Error.(*ClientError).Connection {
+		t.Fatalf("expecting connection error. Got [%v]", m.Error)
+	}
+}
+
+func TestServerMaxConns(t *testing.T) {
+	s := &Server{
+		Addr:     getRandomAddr(),
+		Handler:  func(clientAddr string, request interface{}) interface{} { return request },
+		MaxConns: 1,
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	c1 := &Client{
+		Addr: s.Addr,
+	}
+	c1.Start()
+	defer c1.Stop()
+	if _, err := c1.Call(123); err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+
+	c2 := &Client{
+		Addr:            s.Addr,
+		ReconnectPolicy: ConstantBackoff(10 * time.Millisecond),
+	}
+	c2.Start()
+	defer c2.Stop()
+	if _, err := c2.CallTimeout(123, 100*time.Millisecond); err == nil {
+		t.Fatalf("expecting non-nil error for the connection exceeding MaxConns")
+	}
+	if n := s.Stats.Snapshot().RejectedConns; n == 0 {
+		t.Fatalf("expecting non-zero RejectedConns")
+	}
+
+	// The connection slot must be freed after the client disconnects.
+	c1.Stop()
+	var err error
+	for i := 0; i < 100; i++ {
+		if _, err = c2.CallTimeout(123, 100*time.Millisecond); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	c1.Start()
+}
+
+func TestServerMaxConnsPerClientIP(t *testing.T) {
+	s := &Server{
+		Addr:                getRandomAddr(),
+		Handler:             func(clientAddr string, request interface{}) interface{} { return request },
+		MaxConnsPerClientIP: 2,
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := &Client{
+		Addr:  s.Addr,
+		Conns: 3,
+	}
+	c.Start()
+	defer c.Stop()
+
+	for i := 0; i < 100 && s.Stats.Snapshot().RejectedConns == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := s.Stats.Snapshot().RejectedConns; n == 0 {
+		t.Fatalf("expecting non-zero RejectedConns")
+	}
+
+	// Rejected connections are closed by the server right after accept.
+	for i := 0; i < 100 && c.ConnectedConns() > 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := c.ConnectedConns(); n > 2 {
+		t.Fatalf("unexpected number of connected conns: %d. Expected no more than 2", n)
+	}
+}
+
+func TestServerHandlerTimeout(t *testing.T) {
+	abandonedChan := make(chan struct{}, 1)
+	releaseChan := make(chan struct{})
+	s := &Server{
+		Addr: getRandomAddr(),
+		HandlerCtx: func(ctx context.Context, clientAddr string, request interface{}) interface{} {
+			if request.(string) == "slow" {
+				<-ctx.Done()
+				abandonedChan <- struct{}{}
+				<-releaseChan
+			}
+			return request
+		},
+		HandlerTimeout: 50 * time.Millisecond,
+		Concurrency:    1,
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := &Client{
+		Addr: s.Addr,
+	}
+	c.Start()
+	defer c.Stop()
+
+	_, err := c.Call("slow")
+	if err == nil || !err.(*ClientError).Timeout {
+		t.Fatalf("expecting timeout error. Got [%v]", err)
+	}
+	select {
+	case <-abandonedChan:
+	case <-time.After(time.Second):
+		t.Fatalf("the abandoned handler must be notified via ctx")
+	}
+	if n := s.Stats.Snapshot().HandlerTimeouts; n != 1 {
+		t.Fatalf("unexpected HandlerTimeouts: %d. Expected 1", n)
+	}
+
+	// The Concurrency slot must be held until the abandoned handler returns.
+	_, err = c.CallTimeout("fast", 100*time.Millisecond)
+	if err == nil || !err.(*ClientError).Timeout {
+		t.Fatalf("expecting timeout error. Got [%v]", err)
+	}
+	close(releaseChan)
+	resp, err := c.Call("fast")
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	if resp.(string) != "fast" {
+		t.Fatalf("unexpected response: %v. Expected %q", resp, "fast")
+	}
+}
+
+func TestServerInterceptors(t *testing.T) {
+	var calls []string
+	var callsLock sync.Mutex
+	addCall := func(call string) {
+		callsLock.Lock()
+		calls = append(calls, call)
+		callsLock.Unlock()
+	}
+	getCalls := func() []string {
+		callsLock.Lock()
+		defer callsLock.Unlock()
+		result := calls
+		calls = nil
+		return result
+	}
+
+	s := &Server{
+		Addr: getRandomAddr(),
+		Handler: func(clientAddr string, request interface{}) interface{} {
+			addCall("handler")
+			if strings.HasPrefix(request.(string), "panic") {
+				panic("foobar")
+			}
+			return request.(string) + "-response"
+		},
+	}
+	s.Use(
+		func(ctx context.Context, info *ServerCallInfo, request interface{}, next ServerInvoker) (interface{}, error) {
+			addCall("first")
+			if info.ClientAddr == "" || info.StartTime.IsZero() || info.Method != "" {
+				return nil, fmt.Errorf("unexpected info: %+v", info)
+			}
+			if request.(string) == "deny" {
+				return nil, fmt.Errorf("denied")
+			}
+			return next(ctx, request)
+		},
+		func(ctx context.Context, info *ServerCallInfo, request interface{}, next ServerInvoker) (interface{}, error) {
+			addCall("second")
+			response, err := next(ctx, request.(string)+"-rewritten")
+			if err != nil {
+				return nil, fmt.Errorf("intercepted error: %s", err)
+			}
+			return response, nil
+		},
+	)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := &Client{
+		Addr: s.Addr,
+	}
+	c.Start()
+	defer c.Stop()
+
+	resp, err := c.Call("foo")
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	if resp.(string) != "foo-rewritten-response" {
+		t.Fatalf("unexpected response: %v. Expected %q", resp, "foo-rewritten-response")
+	}
+	expectedCalls := []string{"first", "second", "handler"}
+	if calls := getCalls(); !reflect.DeepEqual(calls, expectedCalls) {
+		t.Fatalf("unexpected calls: %v. Expected %v", calls, expectedCalls)
+	}
+
+	_, err = c.Call("deny")
+	if err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Fatalf("expecting denied error. Got [%v]", err)
+	}
+	expectedCalls = []string{"first"}
+	if calls := getCalls(); !reflect.DeepEqual(calls, expectedCalls) {
+		t.Fatalf("unexpected calls: %v. Expected %v", calls, expectedCalls)
+	}
+
+	_, err = c.Call("panic")
+	if err == nil || !strings.Contains(err.Error(), "intercepted error: Panic occured: foobar") {
+		t.Fatalf("expecting intercepted panic error. Got [%v]", err)
+	}
+}
+
+func TestClientInterceptors(t *testing.T) {
+	s := &Server{
+		Addr: getRandomAddr(),
+		Handler: func(clientAddr string, request interface{}) interface{} {
+			return request.(string) + "-response"
+		},
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	var intercepted []string
+	var interceptedLock sync.Mutex
+	c := &Client{
+		Addr: s.Addr,
+	}
+	c.Use(
+		func(ctx context.Context, info *ClientCallInfo, request interface{}, next ClientInvoker) (interface{}, error) {
+			interceptedLock.Lock()
+			intercepted = append(intercepted, request.(string))
+			interceptedLock.Unlock()
+			if info.Addr != s.Addr || info.Method != "" {
+				return nil, fmt.Errorf("unexpected info: %+v", info)
+			}
+			if request.(string) == "cached" {
+				return "cached-response", nil
+			}
+			return next(ctx, request)
+		},
+		func(ctx context.Context, info *ClientCallInfo, request interface{}, next ClientInvoker) (interface{}, error) {
+			response, err := next(ctx, request.(string)+"-rewritten")
+			if err != nil || info.SkipResponse || info.Async {
+				return nil, err
+			}
+			return response.(string) + "-intercepted", nil
+		},
+	)
+	c.Start()
+	defer c.Stop()
+
+	expectResponse := func(resp interface{}, err error, expectedResp string) {
+		if err != nil {
+			t.Fatalf("unexpected error: [%s]", err)
+		}
+		if resp.(string) != expectedResp {
+			t.Fatalf("unexpected response: %v. Expected %q", resp, expectedResp)
+		}
+	}
+
+	resp, err := c.Call("foo")
+	expectResponse(resp, err, "foo-rewritten-response-intercepted")
+
+	resp, err = c.CallContext(context.Background(), "bar")
+	expectResponse(resp, err, "bar-rewritten-response-intercepted")
+
+	resp, err = c.Call("cached")
+	expectResponse(resp, err, "cached-response")
+
+	ar, err := c.CallAsync("async")
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	<-ar.Done
+	expectResponse(ar.Response, ar.Error, "async-rewritten-response")
+
+	ar, err = c.CallAsync("cached")
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	<-ar.Done
+	expectResponse(ar.Response, ar.Error, "cached-response")
+
+	if err = c.Send("send"); err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+
+	b := c.NewBatch()
+	br := b.Add("batch")
+	b.AddSkipResponse("batch-skip")
+	if err = b.Call(); err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	<-br.Done
+	expectResponse(br.Response, br.Error, "batch-rewritten-response")
+
+	interceptedLock.Lock()
+	defer interceptedLock.Unlock()
+	sort.Strings(intercepted)
+	expected := []string{"async", "bar", "batch", "batch-skip", "cached", "cached", "foo", "send"}
+	if !reflect.DeepEqual(intercepted, expected) {
+		t.Fatalf("unexpected intercepted requests: %v. Expected %v", intercepted, expected)
+	}
+}
+
+func TestClientInterceptorsAsyncErrors(t *testing.T) {
+	cb := &CircuitBreaker{
+		MinCalls:    1,
+		OpenTimeout: time.Hour,
+	}
+	c := &Client{
+		Addr:           getRandomAddr(),
+		CircuitBreaker: cb,
+	}
+	errRejected := errors.New("rejected by interceptor")
+	var asyncCalls uint32
+	c.Use(func(ctx context.Context, info *ClientCallInfo, request interface{}, next ClientInvoker) (interface{}, error) {
+		if info.Async {
+			atomic.AddUint32(&asyncCalls, 1)
+		}
+		if request.(string) == "reject" {
+			return nil, errRejected
+		}
+		return next(ctx, request)
+	})
+	c.Start()
+	defer c.Stop()
+
+	// Errors returned from interceptors must be returned directly.
+	if _, err := c.CallAsync("reject"); err != errRejected {
+		t.Fatalf("unexpected error: [%v]. Expected [%s]", err, errRejected)
+	}
+	b := c.NewBatch()
+	b.Add("reject")
+	if err := b.Call(); err != errRejected {
+		t.Fatalf("unexpected error: [%v]. Expected [%s]", err, errRejected)
+	}
+
+	// The open circuit must be reported directly.
+	token, _ := cb.allow()
+	cb.done(token, &ClientError{Timeout: true})
+	_, err := c.CallAsync("foo")
+	if err == nil || !err.(*ClientError).CircuitOpen {
+		t.Fatalf("expecting circuit open error. Got [%v]", err)
+	}
+	if n := atomic.LoadUint32(&asyncCalls); n != 3 {
+		t.Fatalf("unexpected number of async calls: %d. Expected 3", n)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	s := &Server{
+		Addr: getRandomAddr(),
+		HandlerCtx: func(ctx context.Context, clientAddr string, request interface{}) interface{} {
+			md := RequestMetadata(ctx)
+			SetResponseMetadata(ctx, "request-id", md["request-id"])
+			SetResponseMetadata(ctx, "load", "low")
+			return md["tenant"]
+		},
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := &Client{
+		Addr: s.Addr,
+	}
+	c.Use(func(ctx context.Context, info *ClientCallInfo, request interface{}, next ClientInvoker) (interface{}, error) {
+		ctx = WithMetadata(ctx, Metadata{"request-id": request.(string)})
+		return next(ctx, request)
+	})
+	c.Start()
+	defer c.Stop()
+
+	var respMD Metadata
+	ctx := WithMetadata(context.Background(), Metadata{"tenant": "foo"})
+	ctx = WithResponseMetadata(ctx, &respMD)
+	resp, err := c.CallContext(ctx, "req1")
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	if resp.(string) != "foo" {
+		t.Fatalf("unexpected response: %v. Expected %q", resp, "foo")
+	}
+	expectedMD := Metadata{"request-id": "req1", "load": "low"}
+	if !reflect.DeepEqual(respMD, expectedMD) {
+		t.Fatalf("unexpected response metadata: %v. Expected %v", respMD, expectedMD)
+	}
+
+	// Calls without request metadata must work.
+	resp, err = c.Call("req2")
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	if resp.(string) != "" {
+		t.Fatalf("unexpected response: %v. Expected empty response", resp)
+	}
+
+	ar, err := c.CallAsync("req3")
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	<-ar.Done
+	if ar.Error != nil {
+		t.Fatalf("unexpected error: [%s]", ar.Error)
+	}
+	expectedMD = Metadata{"request-id": "req3", "load": "low"}
+	if !reflect.DeepEqual(ar.Metadata, expectedMD) {
+		t.Fatalf("unexpected response metadata: %v. Expected %v", ar.Metadata, expectedMD)
+	}
+}
+
+func TestMetadataWithoutHandlerCtx(t *testing.T) {
+	s := &Server{
+		Addr:    getRandomAddr(),
+		Handler: echoHandler,
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := &Client{
+		Addr: s.Addr,
+	}
+	c.Start()
+	defer c.Stop()
+
+	var respMD Metadata
+	ctx := WithMetadata(context.Background(), Metadata{"foo": "bar"})
+	ctx = WithResponseMetadata(ctx, &respMD)
+	resp, err := c.CallContext(ctx, "foobar")
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	if resp.(string) != "foobar" {
+		t.Fatalf("unexpected response: %v. Expected %q", resp, "foobar")
+	}
+	if respMD != nil {
+		t.Fatalf("unexpected response metadata: %v. Expected nil", respMD)
+	}
+}
+
+func TestServerMaxInFlightPerConn(t *testing.T) {
+	startedChan := make(chan struct{}, 1)
+	releaseChan := make(chan struct{})
+	s := &Server{
+		Addr: getRandomAddr(),
+		Handler: func(clientAddr string, request interface{}) interface{} {
+			if request.(string) == "slow" {
+				startedChan <- struct{}{}
+				<-releaseChan
+			}
+			return request
+		},
+		MaxInFlightPerConn: 1,
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := &Client{
+		Addr: s.Addr,
+	}
+	c.Start()
+	defer c.Stop()
+
+	slow, err := c.CallAsync("slow")
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	<-startedChan
+
+	_, err = c.Call("fast")
+	if err == nil || !err.(*ClientError).Rejected {
+		t.Fatalf("expecting rejected error. Got [%v]", err)
+	}
+	if n := s.Stats.Snapshot().RejectedRequests; n != 1 {
+		t.Fatalf("unexpected RejectedRequests: %d. Expected 1", n)
+	}
+
+	close(releaseChan)
+	<-slow.Done
+	if slow.Error != nil {
+		t.Fatalf("unexpected error: [%s]", slow.Error)
+	}
+
+	resp, err := c.Call("fast")
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	if resp.(string) != "fast" {
+		t.Fatalf("unexpected response: %v. Expected %q", resp, "fast")
+	}
+}
+
+func TestServerPanic(t *testing.T) {
+	addr := getRandomAddr()
+	s := &Server{
+		Addr: addr,
+		Handler: func(clientAddr string, request interface{}) interface{} {
+			if request.(string) == "foobar" {
+				panic("server panic")
+			}
+			return request
+		},
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := &Client{
+		Addr: addr,
+	}
+	c.Start()
+	defer c.Stop()
+
+	for i := 0; i < 3; i++ {
+		resp, err := c.Call("foobar")
+		if err == nil {
+			t.Fatalf("Unexpected nil error")
+		}
+		if resp != nil {
+			t.Fatalf("Unepxected response for panicing server: %+v. Expected nil", resp)
+		}
+		if !err.(*ClientError).Server {
+			t.Fatalf("Unexpected error type: %v. Expected server error", err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		resp, err := c.Call("aaaaa")
+		if err != nil {
+			t.Fatalf("Unexpected error: [%s]", err)
+		}
+		if resp == nil {
+			t.Fatalf("Unepxected nil response")
+		}
+		if resp.(string) != "aaaaa" {
+			t.Fatalf("Unexpected response: %v. Expected 'aaaaa'", resp)
+		}
+	}
+}
+
+func TestServerStuck(t *testing.T) {
+	addr := getRandomAddr()
+	s := &Server{
+		Addr: addr,
+		Handler: func(clientAddr string, request interface{}) interface{} {
+			time.Sleep(time.Second)
+			return "aaa"
+		},
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := &Client{
+		Addr:            addr,
+		PendingRequests: 100,
+	}
+	c.Start()
+	defer c.Stop()
+
+	var res [1500]*AsyncResult
+	var err error
+	for j := 0; j < 15; j++ {
+		for i := 0; i < 100; i++ {
+			res[i+100*j], err = c.CallAsync("abc")
+			if err != nil {
+				t.Fatalf("%d. Unexpected error in CallAsync: [%s]", j*100+i, err)
+			}
+		}
+		// This should prevent from overflow errors.
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	stuckErrors := 0
+
+	timer := acquireTimer(300 * time.Millisecond)
+	defer releaseTimer(timer)
+
+	for i := 0; i < 1500; i++ {
+		r := res[i]
+		select {
+		case <-r.Done:
+		case <-timer.C:
+			goto exit
+		}
+
+		if r.Error == nil {
+			t.Fatalf("Stuck server returned response? %+v", r.Response)
+		}
+		ce := r.Error.(*ClientError)
+		if ce.Connection {
+			stuckErrors++
+		} else if !ce.Overflow {
+			t.Fatalf("Unexpected error returned: [%s]", ce)
+		}
+		if r.Response != nil {
+			t.Fatalf("Unexpected response from stuck server: %+v", r.Response)
+		}
+	}
+exit:
+
+	if stuckErrors == 0 {
+		t.Fatalf("Stuck server detector doesn't work?")
+	}
+}
+
+type customConn struct {
+	r io.ReadCloser
+	w io.WriteCloser
+}
+
+func (c *customConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *customConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func (c *customConn) Close() error {
+	c.r.Close()
+	return c.w.Close()
+}
+
+type customListener struct {
+	remoteAddr string
+	r          io.ReadCloser
+	w          io.WriteCloser
+	ch         chan struct{}
+}
+
+func newCustomListener(remoteAddr string, r io.ReadCloser, w io.WriteCloser) *customListener {
+	return &customListener{
+		remoteAddr: remoteAddr,
+		r:          r,
+		w:          w,
+	}
+}
+
+func (ln *customListener) Init(addr string) error {
+	ln.ch = make(chan struct{}, 1)
+	ln.ch <- struct{}{}
+	return nil
+}
+
+func (ln *customListener) Accept() (conn io.ReadWriteCloser, clientAddr string, err error) {
+	_, ok := <-ln.ch
+	if !ok {
+		return nil, "", fmt.Errorf("listener is closed")
+	}
+	return &customConn{
+		r: ln.r,
+		w: ln.w,
+	}, ln.remoteAddr, nil
+}
+
+func (ln *customListener) Close() error {
+	close(ln.ch)
+	return nil
+}
+
+func (ln *customListener) ListenAddr() net.Addr {
+	return nil
+}
+
+func TestCustomTransport(t *testing.T) {
+	rc, ws := io.Pipe()
+	rs, wc := io.Pipe()
+
+	s := &Server{
+		Listener: newCustomListener("foobar", rs, ws),
+		Handler: func(clientAddr string, request interface{}) interface{} {
+			if clientAddr != "foobar" {
+				t.Fatalf("Unexpected client address: [%s]. Expected [foobar]", clientAddr)
+			}
+			return request
+		},
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := &Client{
+		Conns: 1,
+		Dial: func(addr string) (conn io.ReadWriteCloser, err error) {
+			return &customConn{
+				r: rc,
+				w: wc,
+			}, nil
+		},
+	}
+	c.Start()
+	defer c.Stop()
+
+	testIntClient(t, c)
+}
+
+func testIntClient(t *testing.T, c *Client) {
+	for i := 0; i < 10; i++ {
+		resp, err := c.Call(i)
+		if err != nil {
+			t.Fatalf("Unexpected error: [%s]", err)
+		}
+		x, ok := resp.(int)
+		if !ok {
+			t.Fatalf("Unexpected response type: %T. Expected int", resp)
+		}
+		if x != i {
+			t.Fatalf("Unexpected value returned: %d. Expected %d", x, i)
+		}
+	}
+}
+
+type onConnectRwcWrapper struct {
+	rwc io.ReadWriteCloser
+	t   *testing.T
+}
+
+func (w *onConnectRwcWrapper) Read(p []byte) (int, error) {
+	n, err := w.rwc.Read(p)
+	sillyDecrypt(p)
+	return n, err
+}
+
+func (w *onConnectRwcWrapper) Write(p []byte) (int, error) {
+	sillyEncrypt(p)
+	return w.rwc.Write(p)
+}
+
+func (w *onConnectRwcWrapper) Close() error {
+	return w.rwc.Close()
+}
+
+func sillyEncrypt(p []byte) {
+	for i := 0; i < len(p); i++ {
+		p[i] ^= 42
+	}
+}
+
+func sillyDecrypt(p []byte) {
+	sillyEncrypt(p)
+}
+
+func newOnConnectFunc(t *testing.T) OnConnectFunc {
+	return func(remoteAddr string, rwc io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+		return &onConnectRwcWrapper{
+			rwc: rwc,
+			t:   t,
+		}, nil
+	}
+}
+
+func TestOnConnect(t *testing.T) {
+	addr := "./test-onconnect.sock"
+	s := NewUnixServer(addr, echoHandler)
+	s.OnConnect = newOnConnectFunc(t)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := NewUnixClient(addr)
+	c.OnConnect = newOnConnectFunc(t)
+	c.Start()
+	defer c.Stop()
+
+	testIntClient(t, c)
+}
+
+func TestConcurrency(t *testing.T) {
+	addr := getRandomAddr()
+	s := NewTCPServer(addr, func(clientAddr string, request interface{}) interface{} {
+		time.Sleep(time.Duration(request.(int)) * time.Millisecond)
+		return request
+	})
+	s.Concurrency = 2
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := NewTCPClient(addr)
+	c.Start()
+	defer c.Stop()
+
+	if err := c.Send(100); err != nil {
+		t.Fatalf("Unepxected error in Send(): [%s]", err)
+	}
+	if err := c.Send(100); err != nil {
+		t.Fatalf("Unepxected error in Send(): [%s]", err)
+	}
+
+	resp, err := c.CallTimeout(5, 50*time.Millisecond)
+	if err == nil {
+		t.Fatalf("Unexpected nil error")
+	}
+	if !err.(*ClientError).Timeout {
+		t.Fatalf("Unexepcted error type: %v. Expected timeout error", err)
+	}
+
+	resp, err = c.CallTimeout(34, 200*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	if resp.(int) != 34 {
+		t.Fatalf("Unexpected response: [%d]. Expected [34]", resp)
+	}
+}
+
+func TestTCPTransport(t *testing.T) {
+	addr := getRandomAddr()
+	s := NewTCPServer(addr, echoHandler)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := NewTCPClient(addr)
+	c.Start()
+	defer c.Stop()
+
+	testIntClient(t, c)
+}
+
+func TestUnixTransport(t *testing.T) {
+	addr := "./gorpc-test-sock.unix"
+	s := NewUnixServer(addr, echoHandler)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := NewUnixClient(addr)
+	c.Start()
+	defer c.Stop()
+
+	testIntClient(t, c)
+}
+
+func TestTLSTransport(t *testing.T) {
+	certFile := "./ssl-cert-snakeoil.pem"
+	keyFile := "./ssl-cert-snakeoil.key"
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Cannot load TLS certificates: [%s]", err)
+	}
+	serverCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	clientCfg := &tls.Config{
+		InsecureSkipVerify: true,
+	}
+
+	addr := getRandomAddr()
+	s := NewTLSServer(addr, echoHandler, serverCfg)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := NewTLSClient(addr, clientCfg)
+	c.Start()
+	defer c.Stop()
+
+	testIntClient(t, c)
+}
+
+func TestPeerInfoUnix(t *testing.T) {
+	addr := "./gorpc-test-peer-sock.unix"
+	s := NewUnixServer(addr, nil)
+	s.HandlerCtx = func(ctx context.Context, clientAddr string, request interface{}) interface{} {
+		p := PeerFromContext(ctx)
+		if p == nil {
+			return "nil peer"
+		}
+		if p.ConnID == 0 || p.RemoteAddr != clientAddr || p.LocalAddr == "" || p.TLS != nil {
+			return fmt.Sprintf("unexpected peer: %+v", p)
+		}
+		if runtime.GOOS == "linux" && (p.UnixCred == nil || p.UnixCred.UID != uint32(os.Getuid())) {
+			return fmt.Sprintf("unexpected unix credentials: %+v", p.UnixCred)
+		}
+		return p.Value("user")
+	}
+	s.OnPeerConnect = func(p *PeerInfo, conn io.ReadWriteCloser) error {
+		p.SetValue("user", "foobar")
+		return nil
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := NewUnixClient(addr)
+	c.Start()
+	defer c.Stop()
+
+	resp, err := c.Call("foo")
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	if resp.(string) != "foobar" {
+		t.Fatalf("unexpected response: %v. Expected %q", resp, "foobar")
+	}
+}
+
+type testPeerValuerConn struct {
+	io.ReadWriteCloser
+	user string
+}
+
+func (c *testPeerValuerConn) PeerValues() map[string]interface{} {
+	return map[string]interface{}{
+		"user": c.user,
+	}
+}
+
+func TestPeerInfoOnConnect(t *testing.T) {
+	s := &Server{
+		Addr: getRandomAddr(),
+		HandlerCtx: func(ctx context.Context, clientAddr string, request interface{}) interface{} {
+			return PeerFromContext(ctx).Value("user")
+		},
+		OnConnect: func(remoteAddr string, rwc io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+			return &testPeerValuerConn{
+				ReadWriteCloser: rwc,
+				user:            "foobar",
+			}, nil
+		},
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := &Client{
+		Addr: s.Addr,
+	}
+	c.Start()
+	defer c.Stop()
+
+	// The identity established in OnConnect must be passed to handlers.
+	resp, err := c.Call("foo")
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	if resp.(string) != "foobar" {
+		t.Fatalf("unexpected response: %v. Expected %q", resp, "foobar")
+	}
+}
+
+func TestPeerInfoTLS(t *testing.T) {
+	certFile := "./ssl-cert-snakeoil.pem"
+	keyFile := "./ssl-cert-snakeoil.key"
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Cannot load TLS certificates: [%s]", err)
+	}
+	serverCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	clientCfg := &tls.Config{
+		InsecureSkipVerify: true,
+	}
+
+	addr := getRandomAddr()
+	s := NewTLSServer(addr, nil, serverCfg)
+	s.HandlerCtx = func(ctx context.Context, clientAddr string, request interface{}) interface{} {
+		p := PeerFromContext(ctx)
+		if p == nil || p.TLS == nil || !p.TLS.HandshakeComplete {
+			return fmt.Sprintf("unexpected peer: %+v", p)
+		}
+		return "ok"
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := NewTLSClient(addr, clientCfg)
+	c.Start()
+	defer c.Stop()
+
+	resp, err := c.Call("foo")
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	if resp.(string) != "ok" {
+		t.Fatalf("unexpected response: %v", resp)
+	}
+}
+
+func TestPeerConnectError(t *testing.T) {
+	s := &Server{
+		Addr:    getRandomAddr(),
+		Handler: echoHandler,
+		OnPeerConnect: func(p *PeerInfo, conn io.ReadWriteCloser) error {
+			return fmt.Errorf("unauthorized")
+		},
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := &Client{
+		Addr: s.Addr,
+	}
+	c.Start()
+	defer c.Stop()
+
+	_, err := c.CallTimeout("foo", 100*time.Millisecond)
+	if err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+}
+
+type testCodec struct {
+	name    string
+	encodes uint32
+}
+
+func (c *testCodec) Name() string {
+	return c.name
+}
+
+func (c *testCodec) NewEncoder(w io.Writer) Encoder {
+	return &testCodecEncoder{
+		c: c,
+		e: GobCodec.NewEncoder(w),
+	}
+}
+
+func (c *testCodec) NewDecoder(r io.Reader) Decoder {
+	return GobCodec.NewDecoder(r)
+}
+
+type testCodecEncoder struct {
+	c *testCodec
+	e Encoder
+}
+
+func (e *testCodecEncoder) Encode(msg interface{}) error {
+	atomic.AddUint32(&e.c.encodes, 1)
+	return e.e.Encode(msg)
+}
+
+func TestCodec(t *testing.T) {
+	serverCodec := &testCodec{name: "test"}
+	s := &Server{
+		Addr:    getRandomAddr(),
+		Handler: echoHandler,
+		Codecs:  []Codec{serverCodec},
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	clientCodec := &testCodec{name: "test"}
+	c := &Client{
+		Addr:  s.Addr,
+		Codec: clientCodec,
+	}
+	c.Start()
+	defer c.Stop()
+
+	testIntClient(t, c)
+
+	if n := atomic.LoadUint32(&clientCodec.encodes); n == 0 {
+		t.Fatalf("the client codec wasn't used")
+	}
+	if n := atomic.LoadUint32(&serverCodec.encodes); n == 0 {
+		t.Fatalf("the server codec wasn't used")
+	}
+
+	// Clients with the default codec must work too.
+	c1 := &Client{
+		Addr: s.Addr,
+	}
+	c1.Start()
+	defer c1.Stop()
+
+	testIntClient(t, c1)
+}
+
+func TestCodecUnsupported(t *testing.T) {
+	s := &Server{
+		Addr:    getRandomAddr(),
+		Handler: echoHandler,
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
 	defer s.Stop()
 
 	c := &Client{
-		Conns: 1,
-		Dial: func(addr string) (conn io.ReadWriteCloser, err error) {
-			return &customConn{
-				r: rc,
-				w: wc,
-			}, nil
-		},
+		Addr:  s.Addr,
+		Codec: &testCodec{name: "unknown"},
 	}
 	c.Start()
 	defer c.Stop()
 
-	testIntClient(t, c)
-}
-
-func testIntClient(t *testing.T, c *Client) {
-	for i := 0; i < 10; i++ {
-		resp, err := c.Call(i)
-		if err != nil {
-			t.Fatalf("Unexpected error: [%s]", err)
-		}
-		x, ok := resp.(int)
-		if !ok {
-			t.Fatalf("Unexpected response type: %T. Expected int", resp)
-		}
-		if x != i {
-			t.Fatalf("Unexpected value returned: %d. Expected %d", x, i)
-		}
+	_, err := c.CallTimeout(123, 100*time.Millisecond)
+	if err == nil {
+		t.Fatalf("expecting non-nil error")
 	}
 }
 
-type onConnectRwcWrapper struct {
-	rwc io.ReadWriteCloser
-	t   *testing.T
-}
-
-func (w *onConnectRwcWrapper) Read(p []byte) (int, error) {
-	n, err := w.rwc.Read(p)
-	sillyDecrypt(p)
-	return n, err
-}
+func TestCodecInvalid(t *testing.T) {
+	s := &Server{
+		Addr:    getRandomAddr(),
+		Handler: echoHandler,
+		Codecs:  []Codec{&testCodec{}},
+	}
+	testPanic(t, func() { s.Start() })
 
-func (w *onConnectRwcWrapper) Write(p []byte) (int, error) {
-	sillyEncrypt(p)
-	return w.rwc.Write(p)
+	c := &Client{
+		Addr:  s.Addr,
+		Codec: &testCodec{},
+	}
+	testPanic(t, func() { c.Start() })
 }
 
-func (w *onConnectRwcWrapper) Close() error {
-	return w.rwc.Close()
+func TestHandshakeOldServer(t *testing.T) {
+	testHandshakeOldServer(t, &Client{
+		Codec: &testCodec{name: "test"},
+	})
+	testHandshakeOldServer(t, &Client{
+		Compressors: []Compressor{GzipCompressor},
+	})
+	testHandshakeOldServer(t, &Client{
+		Compressors:        []Compressor{GzipCompressor},
+		Codec:              &testCodec{name: "test"},
+		DisableCompression: true,
+	})
 }
 
-func sillyEncrypt(p []byte) {
-	for i := 0; i < len(p); i++ {
-		p[i] ^= 42
+func testHandshakeOldServer(t *testing.T, c *Client) {
+	ln, err := net.Listen("tcp", getRandomAddr())
+	if err != nil {
+		t.Fatalf("cannot listen: [%s]", err)
 	}
-}
+	defer ln.Close()
 
-func sillyDecrypt(p []byte) {
-	sillyEncrypt(p)
-}
+	// Emulate old server, which reads the handshake byte and never replies.
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var buf [1]byte
+		conn.Read(buf[:])
+		time.Sleep(time.Second)
+	}()
 
-func newOnConnectFunc(t *testing.T) OnConnectFunc {
-	return func(remoteAddr string, rwc io.ReadWriteCloser) (io.ReadWriteCloser, error) {
-		return &onConnectRwcWrapper{
-			rwc: rwc,
-			t:   t,
-		}, nil
+	c.Addr = ln.Addr().String()
+	c.Start()
+	time.Sleep(100 * time.Millisecond)
+
+	// Client.Stop mustn't hang on waiting for the handshake reply.
+	stopped := make(chan struct{})
+	go func() {
+		c.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("Client.Stop() hangs on the handshake")
 	}
 }
 
-func TestOnConnect(t *testing.T) {
-	addr := "./test-onconnect.sock"
-	s := NewUnixServer(addr, echoHandler)
-	s.OnConnect = newOnConnectFunc(t)
+func TestJSONCodec(t *testing.T) {
+	s := &Server{
+		Addr: getRandomAddr(),
+		Handler: func(clientAddr string, request interface{}) interface{} {
+			if _, ok := request.(json.RawMessage); !ok {
+				return fmt.Sprintf("unexpected request type: %T", request)
+			}
+			return request
+		},
+		Codecs: []Codec{JSONCodec},
+	}
 	if err := s.Start(); err != nil {
 		t.Fatalf("Server.Start() failed: [%s]", err)
 	}
 	defer s.Stop()
 
-	c := NewUnixClient(addr)
-	c.OnConnect = newOnConnectFunc(t)
+	c := &Client{
+		Addr:  s.Addr,
+		Codec: JSONCodec,
+	}
 	c.Start()
 	defer c.Stop()
 
-	testIntClient(t, c)
+	resp, err := c.Call(map[string]int{"foo": 123})
+	if err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	data, ok := resp.(json.RawMessage)
+	if !ok {
+		t.Fatalf("Unexpected response type: %T. Expected json.RawMessage", resp)
+	}
+	if string(data) != `{"foo":123}` {
+		t.Fatalf("Unexpected response: %q. Expected %q", data, `{"foo":123}`)
+	}
 }
 
-func TestConcurrency(t *testing.T) {
-	addr := getRandomAddr()
-	s := NewTCPServer(addr, func(clientAddr string, request interface{}) interface{} {
-		time.Sleep(time.Duration(request.(int)) * time.Millisecond)
-		return request
-	})
-	s.Concurrency = 2
+func TestJSONCodecRawConn(t *testing.T) {
+	s := &Server{
+		Addr: getRandomAddr(),
+		HandlerCtx: func(ctx context.Context, clientAddr string, request interface{}) interface{} {
+			SetResponseMetadata(ctx, "user", RequestMetadata(ctx)["user"])
+			return request
+		},
+		Codecs: []Codec{JSONCodec},
+	}
 	if err := s.Start(); err != nil {
 		t.Fatalf("Server.Start() failed: [%s]", err)
 	}
 	defer s.Stop()
 
-	c := NewTCPClient(addr)
-	c.Start()
-	defer c.Stop()
-
-	if err := c.Send(100); err != nil {
-		t.Fatalf("Unepxected error in Send(): [%s]", err)
-	}
-	if err := c.Send(100); err != nil {
-		t.Fatalf("Unepxected error in Send(): [%s]", err)
+	conn, err := net.Dial("tcp", s.Addr)
+	if err != nil {
+		t.Fatalf("cannot establish connection to server on addr=[%s]: [%s]", s.Addr, err)
 	}
+	defer conn.Close()
 
-	resp, err := c.CallTimeout(5, 50*time.Millisecond)
-	if err == nil {
-		t.Fatalf("Unexpected nil error")
+	// Emulate the client written in other language: versioned handshake
+	// with capCodec capability and "json" codec name in the payload.
+	handshake := "gorpc\x01" + "\x00\x00\x00\x00\x00\x00\x00\x02" + "\x00\x00\x00\x05" + "\x04json"
+	if _, err = conn.Write([]byte(handshake)); err != nil {
+		t.Fatalf("cannot write handshake: [%s]", err)
 	}
-	if !err.(*ClientError).Timeout {
-		t.Fatalf("Unexepcted error type: %v. Expected timeout error", err)
+	var reply [14]byte
+	if _, err = io.ReadFull(conn, reply[:]); err != nil {
+		t.Fatalf("cannot read handshake reply: [%s]", err)
+	}
+	expectedReply := "gorpc\x01" + "\x00\x00\x00\x00\x00\x00\x00\x02"
+	if string(reply[:]) != expectedReply {
+		t.Fatalf("unexpected handshake reply: %q. Expected %q", reply[:], expectedReply)
 	}
 
-	resp, err = c.CallTimeout(34, 200*time.Millisecond)
+	if _, err = conn.Write([]byte(`{"id":42,"request":[1,"two"],"metadata":{"user":"foo"}}` + "\n")); err != nil {
+		t.Fatalf("cannot write request: [%s]", err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
 	if err != nil {
-		t.Fatalf("Unexpected error: [%s]", err)
+		t.Fatalf("cannot read response: [%s]", err)
 	}
-	if resp.(int) != 34 {
-		t.Fatalf("Unexpected response: [%d]. Expected [34]", resp)
+	expectedLine := `{"id":42,"response":[1,"two"],"metadata":{"user":"foo"}}` + "\n"
+	if line != expectedLine {
+		t.Fatalf("Unexpected response: %q. Expected %q", line, expectedLine)
 	}
 }
 
-func TestTCPTransport(t *testing.T) {
-	addr := getRandomAddr()
-	s := NewTCPServer(addr, echoHandler)
+type testCompressor struct {
+	Compressor
+	writers uint32
+}
+
+func (c *testCompressor) NewWriter(w io.Writer) CompressWriter {
+	atomic.AddUint32(&c.writers, 1)
+	return c.Compressor.NewWriter(w)
+}
+
+func TestCompressors(t *testing.T) {
+	for _, compressor := range []Compressor{FlateCompressor, NewFlateCompressor(9), GzipCompressor, ZlibCompressor, NoCompressor} {
+		testCompression(t, compressor)
+	}
+}
+
+func testCompression(t *testing.T, compressor Compressor) {
+	serverCompressor := &testCompressor{Compressor: compressor}
+	s := &Server{
+		Addr:        getRandomAddr(),
+		Handler:     echoHandler,
+		Compressors: []Compressor{serverCompressor},
+	}
 	if err := s.Start(); err != nil {
 		t.Fatalf("Server.Start() failed: [%s]", err)
 	}
 	defer s.Stop()
 
-	c := NewTCPClient(addr)
+	clientCompressor := &testCompressor{Compressor: compressor}
+	c := &Client{
+		Addr:        s.Addr,
+		Compressors: []Compressor{clientCompressor},
+	}
 	c.Start()
 	defer c.Stop()
 
 	testIntClient(t, c)
+
+	request := strings.Repeat("foobar", 1000)
+	resp, err := c.Call(request)
+	if err != nil {
+		t.Fatalf("Unexpected error: [%s]", err)
+	}
+	if resp.(string) != request {
+		t.Fatalf("Unexpected response for compressor %q", compressor.Name())
+	}
+
+	sendRatio, recvRatio := c.Stats.Snapshot().CompressionRatio()
+	if compressor == NoCompressor {
+		if sendRatio != 1 || recvRatio != 1 {
+			t.Fatalf("Unexpected compression ratio: %f, %f. Expected 1", sendRatio, recvRatio)
+		}
+		return
+	}
+	if n := atomic.LoadUint32(&clientCompressor.writers); n == 0 {
+		t.Fatalf("the client compressor %q wasn't used", compressor.Name())
+	}
+	if n := atomic.LoadUint32(&serverCompressor.writers); n == 0 {
+		t.Fatalf("the server compressor %q wasn't used", compressor.Name())
+	}
+	if sendRatio <= 1 || recvRatio <= 1 {
+		t.Fatalf("Unexpected compression ratio for compressor %q: %f, %f. Expected more than 1", compressor.Name(), sendRatio, recvRatio)
+	}
 }
 
-func TestUnixTransport(t *testing.T) {
-	addr := "./gorpc-test-sock.unix"
-	s := NewUnixServer(addr, echoHandler)
+func TestCompressorsNegotiation(t *testing.T) {
+	zlibCompressor := &testCompressor{Compressor: ZlibCompressor}
+	s := &Server{
+		Addr:        getRandomAddr(),
+		Handler:     echoHandler,
+		Compressors: []Compressor{FlateCompressor, zlibCompressor},
+	}
 	if err := s.Start(); err != nil {
 		t.Fatalf("Server.Start() failed: [%s]", err)
 	}
 	defer s.Stop()
 
-	c := NewUnixClient(addr)
+	// The server must pick the first supported compressor
+	// in the client's order of preference.
+	gzipCompressor := &testCompressor{Compressor: GzipCompressor}
+	c := &Client{
+		Addr:        s.Addr,
+		Compressors: []Compressor{gzipCompressor, ZlibCompressor, FlateCompressor},
+	}
 	c.Start()
 	defer c.Stop()
 
 	testIntClient(t, c)
-}
 
-func TestTLSTransport(t *testing.T) {
-	certFile := "./ssl-cert-snakeoil.pem"
-	keyFile := "./ssl-cert-snakeoil.key"
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		t.Fatalf("Cannot load TLS certificates: [%s]", err)
+	if n := atomic.LoadUint32(&zlibCompressor.writers); n == 0 {
+		t.Fatalf("zlib compressor wasn't selected by the server")
 	}
-	serverCfg := &tls.Config{
-		Certificates: []tls.Certificate{cert},
+	if n := atomic.LoadUint32(&gzipCompressor.writers); n != 0 {
+		t.Fatalf("unsupported gzip compressor has been selected")
 	}
-	clientCfg := &tls.Config{
-		InsecureSkipVerify: true,
+
+	// The connection must be uncompressed if the server supports
+	// none of the client's compressors.
+	c1 := &Client{
+		Addr:        s.Addr,
+		Compressors: []Compressor{gzipCompressor},
 	}
+	c1.Start()
+	defer c1.Stop()
 
-	addr := getRandomAddr()
-	s := NewTLSServer(addr, echoHandler, serverCfg)
-	if err := s.Start(); err != nil {
-		t.Fatalf("Server.Start() failed: [%s]", err)
+	testIntClient(t, c1)
+
+	if n := atomic.LoadUint32(&gzipCompressor.writers); n != 0 {
+		t.Fatalf("unsupported gzip compressor has been selected")
+	}
+	sendRatio, recvRatio := c1.Stats.Snapshot().CompressionRatio()
+	if sendRatio != 1 || recvRatio != 1 {
+		t.Fatalf("Unexpected compression ratio: %f, %f. Expected 1", sendRatio, recvRatio)
+	}
+
+	// Clients with default settings must work too.
+	c2 := &Client{
+		Addr: s.Addr,
+	}
+	c2.Start()
+	defer c2.Stop()
+
+	testIntClient(t, c2)
+}
+
+func TestCompressorsInvalid(t *testing.T) {
+	compressors := make([]Compressor, maxCompressors+1)
+	for i := range compressors {
+		compressors[i] = FlateCompressor
+	}
+	s := &Server{
+		Addr:        getRandomAddr(),
+		Handler:     echoHandler,
+		Compressors: compressors,
 	}
+	testPanic(t, func() { s.Start() })
+}
+
+func TestCompressionRatioNoTraffic(t *testing.T) {
+	var cs ConnStats
+	sendRatio, recvRatio := cs.CompressionRatio()
+	if sendRatio != 1 || recvRatio != 1 {
+		t.Fatalf("Unexpected compression ratio: %f, %f. Expected 1", sendRatio, recvRatio)
+	}
+}
+
+func TestCompressionRatioPerConn(t *testing.T) {
+	var peersLock sync.Mutex
+	var peers []*PeerInfo
+	s := startTestServer(t, &Server{
+		Handler: echoHandler,
+		OnPeerConnect: func(p *PeerInfo, conn io.ReadWriteCloser) error {
+			peersLock.Lock()
+			peers = append(peers, p)
+			peersLock.Unlock()
+			return nil
+		},
+	})
 	defer s.Stop()
 
-	c := NewTLSClient(addr, clientCfg)
-	c.Start()
-	defer c.Stop()
+	request := strings.Repeat("foobar", 1000)
+	for _, disableCompression := range []bool{false, true} {
+		c := &Client{
+			Addr:               s.Addr,
+			Conns:              1,
+			DisableCompression: disableCompression,
+		}
+		c.Start()
+		if _, err := c.Call(request); err != nil {
+			t.Fatalf("Unexpected error: [%s]", err)
+		}
 
-	testIntClient(t, c)
+		connsStats := c.ConnsStats()
+		if len(connsStats) != 1 {
+			t.Fatalf("Unexpected number of connection stats: %d. Expected 1", len(connsStats))
+		}
+		sendRatio, recvRatio := connsStats[0].CompressionRatio()
+		if disableCompression && (sendRatio != 1 || recvRatio != 1) {
+			t.Fatalf("Unexpected compression ratio: %f, %f. Expected 1", sendRatio, recvRatio)
+		}
+		if !disableCompression && (sendRatio <= 1 || recvRatio <= 1) {
+			t.Fatalf("Unexpected compression ratio: %f, %f. Expected more than 1", sendRatio, recvRatio)
+		}
+		c.Stop()
+		if n := len(c.ConnsStats()); n != 0 {
+			t.Fatalf("Unexpected number of connection stats after Client.Stop: %d. Expected 0", n)
+		}
+	}
+
+	peersLock.Lock()
+	defer peersLock.Unlock()
+	if len(peers) != 2 {
+		t.Fatalf("Unexpected number of connections: %d. Expected 2", len(peers))
+	}
+	sendRatio, recvRatio := peers[0].Stats().CompressionRatio()
+	if sendRatio <= 1 || recvRatio <= 1 {
+		t.Fatalf("Unexpected compression ratio: %f, %f. Expected more than 1", sendRatio, recvRatio)
+	}
+	sendRatio, recvRatio = peers[1].Stats().CompressionRatio()
+	if sendRatio != 1 || recvRatio != 1 {
+		t.Fatalf("Unexpected compression ratio: %f, %f. Expected 1", sendRatio, recvRatio)
+	}
 }
 
 func TestNoRequestBufferring(t *testing.T) {
@@ -963,6 +2812,60 @@ func TestAsyncResultCancel(t *testing.T) {
 	}
 }
 
+func TestAsyncResultCancelLargeRequests(t *testing.T) {
+	addr := getRandomAddr()
+	s := &Server{
+		Addr:         addr,
+		Handler:      echoHandler,
+		BytesHandler: echoBytesHandler,
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Server.Start() failed: [%s]", err)
+	}
+	defer s.Stop()
+
+	c := &Client{
+		Addr:               addr,
+		DisableCompression: true,
+	}
+	c.Start()
+	defer c.Stop()
+
+	// Large requests are written directly to the connection, so responses
+	// may be read before clientWriter returns from writing the request.
+	// Run with -race for detecting access to released AsyncResults.
+	request := strings.Repeat("x", 256*1024)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			timeout := time.Duration(i%3*50+1) * time.Millisecond
+			for j := 0; j < 50; j++ {
+				var err error
+				if j%2 == 0 {
+					_, err = c.CallTimeout(request, timeout)
+				} else {
+					_, err = c.CallBytesTimeout(nil, []byte(request), timeout)
+				}
+				if err != nil && !err.(*ClientError).Timeout {
+					t.Errorf("unexpected error: [%s]", err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	resp, err := c.CallTimeout("foobar", time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	if resp.(string) != "foobar" {
+		t.Fatalf("unexpected response: %v", resp)
+	}
+}
+
 func TestIntHandler(t *testing.T) {
 	addr := getRandomAddr()
 	s := &Server{
@@ -1,8 +1,10 @@
 package gorpc
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"net"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -21,6 +23,25 @@ import (
 // Hint: use Dispatcher for HandlerFunc construction.
 type HandlerFunc func(clientAddr string, request interface{}) (response interface{})
 
+// HandlerFuncCtx is a server handler function accepting request context.
+//
+// ctx is canceled when the client cancels the request, when the client
+// connection is closed or when the server is stopped, so long-running
+// handlers may stop processing the request early.
+//
+// See HandlerFunc for details on the rest of arguments.
+//
+// Hint: use Dispatcher.NewHandlerFuncCtx for HandlerFuncCtx construction.
+type HandlerFuncCtx func(ctx context.Context, clientAddr string, request interface{}) (response interface{})
+
+// BytesHandlerFunc is a server handler function for raw requests sent
+// via Client.CallBytes.
+//
+// The handler must append the response to dst and return the result.
+// The handler mustn't retain references to request and dst after returning,
+// since they are reused for subsequent requests.
+type BytesHandlerFunc func(clientAddr string, request, dst []byte) (response []byte)
+
 // Server implements RPC server.
 //
 // Default server settings are optimized for high load, so don't override
@@ -46,10 +67,81 @@ type Server struct {
 	// Hint: use Dispatcher for HandlerFunc construction.
 	Handler HandlerFunc
 
+	// Handler function for incoming requests, which accepts request context.
+	//
+	// HandlerCtx takes precedence over Handler if both are set.
+	//
+	// Hint: use Dispatcher for HandlerFuncCtx construction.
+	HandlerCtx HandlerFuncCtx
+
+	// Handler function for raw requests sent via Client.CallBytes.
+	//
+	// Raw requests and responses are passed as is without encoding,
+	// so BytesHandler is suitable for payloads serialized by the application
+	// itself (for instance, protobuf). Interceptors registered via
+	// Server.Use() and Server.HandlerTimeout aren't applied to BytesHandler.
+	//
+	// Raw requests are rejected if BytesHandler isn't set.
+	BytesHandler BytesHandlerFunc
+
 	// The maximum number of concurrent rpc calls the server may perform.
 	// Default is DefaultConcurrency.
 	Concurrency int
 
+	// The maximum duration for the handler call.
+	//
+	// The server sends timeout error to the client if the handler
+	// doesn't return response during the timeout. Handlers passed
+	// via HandlerCtx may notice they have been abandoned via ctx.Done().
+	// The Concurrency slot is freed only after the abandoned handler
+	// returns.
+	//
+	// The timeout may be overridden per function via
+	// Dispatcher.SetHandlerTimeout.
+	//
+	// By default the handler duration is unlimited.
+	HandlerTimeout time.Duration
+
+	// The maximum number of concurrent client connections.
+	//
+	// New connections exceeding the limit are closed right after accept.
+	//
+	// By default the number of connections is unlimited.
+	MaxConns int
+
+	// The maximum number of concurrent connections from a single
+	// client IP.
+	//
+	// New connections exceeding the limit are closed right after accept.
+	//
+	// By default the number of connections per client IP is unlimited.
+	MaxConnsPerClientIP int
+
+	// The maximum number of requests the server processes concurrently
+	// per client connection.
+	//
+	// This prevents a single client from occupying all the Concurrency
+	// slots. Requests exceeding the limit are rejected and the client
+	// obtains ClientError.Rejected error for them.
+	//
+	// By default the number of requests per connection is limited
+	// only by Concurrency.
+	MaxInFlightPerConn int
+
+	// The maximum size of a request the server accepts from clients
+	// in bytes.
+	//
+	// The limit is advertised to clients during the handshake, so clients
+	// return ClientError.Rejected error for oversized requests without
+	// sending them to the server. Oversized requests from misbehaving
+	// clients are skipped without decoding and are rejected with
+	// the same error, while the connection remains usable where possible.
+	//
+	// The limit isn't enforced for clients with Client.LegacyHandshake.
+	//
+	// By default the request size is unlimited.
+	MaxRequestSize int
+
 	// The maximum delay between response flushes to clients.
 	//
 	// Negative values lead to immediate requests' sending to the client
@@ -71,6 +163,11 @@ type Server struct {
 	// Default is DefaultBufferSize.
 	RecvBufferSize int
 
+	// The maximum duration for obtaining the handshake from the client.
+	//
+	// Default is DefaultHandshakeTimeout.
+	HandshakeTimeout time.Duration
+
 	// OnConnect is called whenever connection from client is accepted.
 	// The callback can be used for authentication/authorization/encryption
 	// and/or for custom transport wrapping.
@@ -79,6 +176,34 @@ type Server struct {
 	// implementation.
 	OnConnect OnConnectFunc
 
+	// OnPeerConnect is called after OnConnect and the handshake with
+	// the client.
+	//
+	// The callback may attach values to PeerInfo, which is passed
+	// to handlers. See PeerFromContext() for details.
+	OnPeerConnect PeerConnectFunc
+
+	// Codecs supported by the server in addition to GobCodec.
+	//
+	// The codec is chosen during the handshake according to Client.Codec.
+	// Connections from clients with unsupported codecs are rejected.
+	//
+	// GobCodec is always supported.
+	Codecs []Codec
+
+	// Compressors supported by the server.
+	//
+	// The server picks the first compressor advertised by the client
+	// via Client.Compressors, which is supported by the server.
+	// Clients using Client.LegacyHandshake always use flate if compression
+	// is enabled.
+	//
+	// NoCompressor is always supported.
+	//
+	// By default FlateCompressor, GzipCompressor and ZlibCompressor
+	// are supported.
+	Compressors []Compressor
+
 	// The server obtains new client connections via Listener.Accept().
 	//
 	// Override the listener if you want custom underlying transport
@@ -105,8 +230,35 @@ type Server struct {
 	// any time you wish.
 	Stats ConnStats
 
+	handler HandlerFuncCtx
+
+	interceptors []ServerInterceptor
+
+	// connsLock protects conns, connsPerIP and lastConnID.
+	connsLock  sync.Mutex
+	conns      int
+	connsPerIP map[string]int
+	lastConnID uint64
+
 	serverStopChan chan struct{}
-	stopWg         sync.WaitGroup
+
+	// serverDrainChan is closed by Shutdown.
+	serverDrainChan chan struct{}
+
+	stopWg sync.WaitGroup
+}
+
+// Use registers the given interceptors for all the requests
+// processed by the server.
+//
+// Interceptors are called in the order they are registered. Interceptors
+// registered via Server.Use() are called before interceptors registered
+// via Dispatcher.Use(). Panics in the handler are converted to errors
+// before passing them to interceptors.
+//
+// The function must be called before Server.Start().
+func (s *Server) Use(interceptors ...ServerInterceptor) {
+	s.interceptors = append(s.interceptors, interceptors...)
 }
 
 // Start starts rpc server.
@@ -119,14 +271,23 @@ func (s *Server) Start() error {
 	if s.LogError == nil {
 		s.LogError = errorLogger
 	}
-	if s.Handler == nil {
+	if s.Handler == nil && s.HandlerCtx == nil {
 		panic("gorpc.Server: Server.Handler cannot be nil")
 	}
+	if err := validateCompressors(s.Compressors); err != nil {
+		panic(fmt.Sprintf("gorpc.Server: invalid Server.Compressors: %s", err))
+	}
+	for _, codec := range s.Codecs {
+		if err := validateCodec(codec); err != nil {
+			panic(fmt.Sprintf("gorpc.Server: invalid codec in Server.Codecs: %s", err))
+		}
+	}
 
 	if s.serverStopChan != nil {
 		panic("gorpc.Server: server is already running. Stop it before starting it again")
 	}
 	s.serverStopChan = make(chan struct{})
+	s.serverDrainChan = make(chan struct{})
 
 	if s.Concurrency <= 0 {
 		s.Concurrency = DefaultConcurrency
@@ -143,6 +304,20 @@ func (s *Server) Start() error {
 	if s.RecvBufferSize <= 0 {
 		s.RecvBufferSize = DefaultBufferSize
 	}
+	if s.HandshakeTimeout <= 0 {
+		s.HandshakeTimeout = DefaultHandshakeTimeout
+	}
+	if s.Compressors == nil {
+		s.Compressors = []Compressor{FlateCompressor, GzipCompressor, ZlibCompressor}
+	}
+
+	s.handler = s.HandlerCtx
+	if s.handler == nil {
+		handler := s.Handler
+		s.handler = func(ctx context.Context, clientAddr string, request interface{}) interface{} {
+			return handler(clientAddr, request)
+		}
+	}
 
 	if s.Listener == nil {
 		s.Listener = &defaultListener{}
@@ -167,6 +342,51 @@ func (s *Server) Stop() {
 	close(s.serverStopChan)
 	s.stopWg.Wait()
 	s.serverStopChan = nil
+	s.serverDrainChan = nil
+}
+
+// Shutdown gracefully stops rpc server.
+//
+// It stops accepting new connections, rejects new requests
+// on the established connections, waits until the requests being
+// processed are finished and their responses are sent to clients,
+// and then closes all the connections.
+//
+// Clients supporting control frames obtain GOAWAY frame, so they stop
+// sending new requests to the server and establish new connections
+// while responses for their pending requests are still delivered.
+// Other clients see the rejected requests as ClientError.Connection errors,
+// so they may be safely retried on other servers.
+//
+// The server is stopped immediately via Stop when the ctx is done
+// before all the connections are drained. ctx.Err() is returned
+// in this case.
+//
+// Stopped server can be started again.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.serverStopChan == nil {
+		panic("gorpc.Server: server must be started before shutting it down")
+	}
+	close(s.serverDrainChan)
+
+	drainedChan := make(chan struct{})
+	go func() {
+		s.stopWg.Wait()
+		close(drainedChan)
+	}()
+
+	var err error
+	select {
+	case <-drainedChan:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.LogError("gorpc.Server: [%s]. Cannot drain connections before shutdown deadline: [%s]. Stopping the server", s.Addr, err)
+	}
+	close(s.serverStopChan)
+	<-drainedChan
+	s.serverStopChan = nil
+	s.serverDrainChan = nil
+	return err
 }
 
 // Serve starts rpc server and blocks until it is stopped.
@@ -203,6 +423,14 @@ func serverHandler(s *Server, workersCh chan struct{}) {
 			s.Listener.Close()
 			<-acceptChan
 			return
+		case <-s.serverDrainChan:
+			stopping.Store(true)
+			s.Listener.Close()
+			<-acceptChan
+			if err == nil {
+				conn.Close()
+			}
+			return
 		case <-acceptChan:
 			s.Stats.incAcceptCalls()
 		}
@@ -212,19 +440,90 @@ func serverHandler(s *Server, workersCh chan struct{}) {
 			select {
 			case <-s.serverStopChan:
 				return
+			case <-s.serverDrainChan:
+				return
 			case <-time.After(time.Second):
 			}
 			continue
 		}
 
+		if err = s.acquireConn(clientAddr); err != nil {
+			s.Stats.incRejectedConns()
+			s.LogError("gorpc.Server: [%s]->[%s]. Rejecting the connection: [%s]", clientAddr, s.Addr, err)
+			conn.Close()
+			continue
+		}
+
 		s.stopWg.Add(1)
 		go serverHandleConnection(s, conn, clientAddr, workersCh)
 	}
 }
 
+// acquireConn registers new connection from the given client address.
+//
+// Returns non-nil error if the connection exceeds MaxConns
+// or MaxConnsPerClientIP limits.
+func (s *Server) acquireConn(clientAddr string) error {
+	ip := clientIP(clientAddr)
+
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+
+	if s.MaxConns > 0 && s.conns >= s.MaxConns {
+		return fmt.Errorf("too many connections: %d. Try increasing Server.MaxConns", s.conns)
+	}
+	if s.MaxConnsPerClientIP > 0 {
+		if n := s.connsPerIP[ip]; n >= s.MaxConnsPerClientIP {
+			return fmt.Errorf("too many connections from client ip %q: %d. Try increasing Server.MaxConnsPerClientIP", ip, n)
+		}
+	}
+
+	s.conns++
+	if s.connsPerIP == nil {
+		s.connsPerIP = make(map[string]int)
+	}
+	s.connsPerIP[ip]++
+	return nil
+}
+
+// releaseConn unregisters the connection registered via acquireConn.
+func (s *Server) releaseConn(clientAddr string) {
+	ip := clientIP(clientAddr)
+
+	s.connsLock.Lock()
+	s.conns--
+	if s.connsPerIP[ip]--; s.connsPerIP[ip] <= 0 {
+		delete(s.connsPerIP, ip)
+	}
+	s.connsLock.Unlock()
+}
+
+// clientIP returns ip part of the client address.
+//
+// The whole address is returned if it doesn't contain port,
+// for instance, for unix sockets.
+func clientIP(clientAddr string) string {
+	host, _, err := net.SplitHostPort(clientAddr)
+	if err != nil {
+		return clientAddr
+	}
+	return host
+}
+
+// nextConnID returns unique id for new connection.
+func (s *Server) nextConnID() uint64 {
+	s.connsLock.Lock()
+	s.lastConnID++
+	connID := s.lastConnID
+	s.connsLock.Unlock()
+	return connID
+}
+
 func serverHandleConnection(s *Server, conn io.ReadWriteCloser, clientAddr string, workersCh chan struct{}) {
 	defer s.stopWg.Done()
+	defer s.releaseConn(clientAddr)
 
+	acceptedConn := conn
 	if s.OnConnect != nil {
 		newConn, err := s.OnConnect(clientAddr, conn)
 		if err != nil {
@@ -235,23 +534,23 @@ func serverHandleConnection(s *Server, conn io.ReadWriteCloser, clientAddr strin
 		conn = newConn
 	}
 
-	var enabledCompression bool
+	var handshake *serverHandshake
 	var err error
 	var stopping atomic.Value
 
-	zChan := make(chan bool, 1)
+	zChan := make(chan *serverHandshake, 1)
 	go func() {
-		var buf [1]byte
-		if _, err = conn.Read(buf[:]); err != nil {
+		hs, err := readClientHandshake(conn)
+		if err != nil {
 			if stopping.Load() == nil {
 				s.LogError("gorpc.Server: [%s]->[%s]. Error when reading handshake from client: [%s]", clientAddr, s.Addr, err)
 			}
 		}
-		zChan <- (buf[0] != 0)
+		zChan <- hs
 	}()
 	select {
-	case enabledCompression = <-zChan:
-		if err != nil {
+	case handshake = <-zChan:
+		if handshake == nil {
 			conn.Close()
 			return
 		}
@@ -259,44 +558,211 @@ func serverHandleConnection(s *Server, conn io.ReadWriteCloser, clientAddr strin
 		stopping.Store(true)
 		conn.Close()
 		return
-	case <-time.After(10 * time.Second):
-		s.LogError("gorpc.Server: [%s]->[%s]. Cannot obtain handshake from client during 10s", clientAddr, s.Addr)
+	case <-s.serverDrainChan:
+		stopping.Store(true)
+		conn.Close()
+		return
+	case <-time.After(s.HandshakeTimeout):
+		s.LogError("gorpc.Server: [%s]->[%s]. Cannot obtain handshake from client during %s", clientAddr, s.Addr, s.HandshakeTimeout)
 		conn.Close()
 		return
 	}
 
+	params, err := s.acceptHandshake(conn, handshake)
+	if err != nil {
+		s.LogError("gorpc.Server: [%s]->[%s]. Handshake error: [%s]", clientAddr, s.Addr, err)
+		conn.Close()
+		return
+	}
+	enabledControlFrames := (handshake.caps&capControlFrames != 0)
+	params.stats = &ConnStats{}
+
+	// TLS handshake is complete at the moment, since the handshake
+	// has been read from the connection.
+	peer := newPeerInfo(s.nextConnID(), clientAddr, acceptedConn, conn)
+	peer.ProtocolVersion = int(handshake.version)
+	peer.stats = params.stats
+	if s.OnPeerConnect != nil {
+		if err = s.OnPeerConnect(peer, conn); err != nil {
+			s.LogError("gorpc.Server: [%s]->[%s]. OnPeerConnect error: [%s]", clientAddr, s.Addr, err)
+			conn.Close()
+			return
+		}
+	}
+
 	responsesChan := make(chan *serverMessage, s.PendingResponses)
 	stopChan := make(chan struct{})
 
+	// Requests being processed. Responses for these requests must be
+	// sent to the client before closing the connection on Shutdown.
+	var inFlight inFlightRequests
+	drainChan := make(chan struct{})
+
+	pendingRequests := make(map[uint64]*serverMessage)
+	var pendingRequestsLock sync.Mutex
+
+	// Request contexts are derived from connCtx, so they are canceled
+	// when the connection is closed or the server is stopped.
+	connCtx, connCancel := context.WithCancel(context.WithValue(context.Background(), peerInfoKey{}, peer))
+
 	readerDone := make(chan struct{})
-	go serverReader(s, conn, clientAddr, responsesChan, stopChan, readerDone, enabledCompression, workersCh)
+	go serverReader(s, conn, clientAddr, connCtx, responsesChan, pendingRequests, &pendingRequestsLock, &inFlight, stopChan, readerDone, params, workersCh)
 
 	writerDone := make(chan struct{})
-	go serverWriter(s, conn, clientAddr, responsesChan, stopChan, writerDone, enabledCompression)
+	go serverWriter(s, conn, clientAddr, responsesChan, stopChan, drainChan, writerDone, params)
 
 	select {
 	case <-readerDone:
 		close(stopChan)
+		connCancel()
 		conn.Close()
 		<-writerDone
 	case <-writerDone:
 		close(stopChan)
+		connCancel()
 		conn.Close()
 		<-readerDone
 	case <-s.serverStopChan:
 		close(stopChan)
+		connCancel()
+		conn.Close()
+		<-readerDone
+		<-writerDone
+	case <-s.serverDrainChan:
+		if enabledControlFrames {
+			// Tell the client to stop sending new requests
+			// to the connection.
+			m := serverMessagePool.Get().(*serverMessage)
+			m.GoAway = true
+			select {
+			case responsesChan <- m:
+			case <-s.serverStopChan:
+			}
+		}
+		if waitForInFlightRequests(s, &inFlight, readerDone, writerDone) {
+			// Let the writer send the remaining responses to the client.
+			close(drainChan)
+			select {
+			case <-writerDone:
+			case <-s.serverStopChan:
+			}
+		}
+		close(stopChan)
+		connCancel()
 		conn.Close()
 		<-readerDone
 		<-writerDone
 	}
 }
 
+// waitForInFlightRequests waits until all the requests on the connection
+// are processed.
+//
+// Returns false if the connection is broken or the server is stopped
+// while waiting.
+func waitForInFlightRequests(s *Server, inFlight *inFlightRequests, readerDone, writerDone <-chan struct{}) bool {
+	select {
+	case <-inFlight.done():
+		return true
+	case <-readerDone:
+		return false
+	case <-writerDone:
+		return false
+	case <-s.serverStopChan:
+		return false
+	}
+}
+
+// inFlightRequests counts requests being processed on the connection.
+type inFlightRequests struct {
+	lock sync.Mutex
+	n    int
+
+	// doneChan is closed when n drops to zero. It is created lazily
+	// by done(), so requests don't allocate it.
+	doneChan chan struct{}
+}
+
+// inc registers new request and returns the number of requests
+// being processed including the new one.
+func (r *inFlightRequests) inc() int {
+	r.lock.Lock()
+	r.n++
+	n := r.n
+	r.lock.Unlock()
+	return n
+}
+
+// dec must be called after the request registered via inc is processed.
+func (r *inFlightRequests) dec() {
+	r.lock.Lock()
+	r.n--
+	if r.n == 0 && r.doneChan != nil {
+		close(r.doneChan)
+		r.doneChan = nil
+	}
+	r.lock.Unlock()
+}
+
+// done returns a channel, which is closed when all the currently
+// registered requests are processed.
+func (r *inFlightRequests) done() <-chan struct{} {
+	r.lock.Lock()
+	ch := closedChan
+	if r.n > 0 {
+		if r.doneChan == nil {
+			r.doneChan = make(chan struct{})
+		}
+		ch = r.doneChan
+	}
+	r.lock.Unlock()
+	return ch
+}
+
+var closedChan = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
 type serverMessage struct {
 	ID         uint64
 	Request    interface{}
 	Response   interface{}
 	Error      string
 	ClientAddr string
+
+	// Canceled is protected by the pending requests' lock
+	// of the connection the message has been received from.
+	Canceled bool
+
+	// Timeout is set if the request has been dropped because
+	// of deadline.
+	Timeout bool
+
+	// ShuttingDown is set if the request has been rejected
+	// because of server shutdown.
+	ShuttingDown bool
+
+	// Rejected is set if the request has been rejected because
+	// of Server.MaxInFlightPerConn limit.
+	Rejected bool
+
+	// GoAway is set for GOAWAY control frame.
+	GoAway bool
+
+	// RequestMetadata and ResponseMetadata contain optional metadata
+	// sent along with the request and the response.
+	RequestMetadata  Metadata
+	ResponseMetadata Metadata
+
+	// ctx is passed to Server.HandlerCtx. cancel is called when
+	// the client cancels the request.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// deadline is the deadline for the request obtained from the client.
+	deadline time.Time
 }
 
 var serverMessagePool = &sync.Pool{
@@ -318,8 +784,9 @@ func isServerStop(stopChan <-chan struct{}) bool {
 	}
 }
 
-func serverReader(s *Server, r io.Reader, clientAddr string, responsesChan chan<- *serverMessage,
-	stopChan <-chan struct{}, done chan<- struct{}, enabledCompression bool, workersCh chan struct{}) {
+func serverReader(s *Server, r io.Reader, clientAddr string, connCtx context.Context, responsesChan chan<- *serverMessage,
+	pendingRequests map[uint64]*serverMessage, pendingRequestsLock *sync.Mutex, inFlight *inFlightRequests,
+	stopChan <-chan struct{}, done chan<- struct{}, params *connParams, workersCh chan struct{}) {
 
 	defer func() {
 		if r := recover(); r != nil {
@@ -328,25 +795,156 @@ func serverReader(s *Server, r io.Reader, clientAddr string, responsesChan chan<
 		close(done)
 	}()
 
-	d := newMessageDecoder(r, s.RecvBufferSize, enabledCompression, &s.Stats)
+	d := newMessageDecoder(r, s.RecvBufferSize, params, &s.Stats)
 	defer d.Close()
 
 	var wr wireRequest
 	for {
 		if err := d.Decode(&wr); err != nil {
+			if fe, ok := err.(*frameSizeError); ok {
+				// The request has been skipped, so the connection
+				// remains usable.
+				s.Stats.incOversizedMessages()
+				if fe.id == 0 {
+					// There is no way to notify the client about rejected
+					// request if it doesn't wait for the response.
+					continue
+				}
+				m := serverMessagePool.Get().(*serverMessage)
+				m.ID = fe.id
+				m.Rejected = true
+				m.Error = fmt.Sprintf("gorpc.Server: the request size %d bytes exceeds Server.MaxRequestSize=%d bytes", fe.size, fe.maxSize)
+				select {
+				case responsesChan <- m:
+				case <-stopChan:
+					return
+				}
+				continue
+			}
 			if !isClientDisconnect(err) && !isServerStop(stopChan) {
 				s.LogError("gorpc.Server: [%s]->[%s]. Cannot decode request: [%s]", clientAddr, s.Addr, err)
 			}
 			return
 		}
 
+		if wr.CancelID != 0 {
+			pendingRequestsLock.Lock()
+			if m, ok := pendingRequests[wr.CancelID]; ok {
+				m.Canceled = true
+				if m.cancel != nil {
+					m.cancel()
+				}
+			}
+			pendingRequestsLock.Unlock()
+
+			wr.CancelID = 0
+			wr.Request = nil
+			continue
+		}
+
 		m := serverMessagePool.Get().(*serverMessage)
 		m.ID = wr.ID
 		m.Request = wr.Request
+		m.RequestMetadata = wr.Metadata
 		m.ClientAddr = clientAddr
+		m.Canceled = false
+		m.deadline = zeroTime
+		if wr.Timeout > 0 {
+			m.deadline = time.Now().Add(wr.Timeout)
+		}
 
 		wr.ID = 0
 		wr.Request = nil
+		wr.Timeout = 0
+		wr.Metadata = nil
+
+		// Register the request before checking for shutdown, so Shutdown
+		// either waits for the request or the request is rejected.
+		n := inFlight.inc()
+
+		if isServerStop(s.serverDrainChan) {
+			// Do not process new requests during shutdown.
+			inFlight.dec()
+			if m.ID == 0 {
+				m.Request = nil
+				m.RequestMetadata = nil
+				m.ClientAddr = ""
+				m.deadline = zeroTime
+				serverMessagePool.Put(m)
+				continue
+			}
+			m.Request = nil
+			m.RequestMetadata = nil
+			m.ClientAddr = ""
+			m.deadline = zeroTime
+			m.ShuttingDown = true
+			m.Error = errServerShutdown
+			select {
+			case responsesChan <- m:
+			case <-stopChan:
+				return
+			}
+			continue
+		}
+
+		if s.MaxInFlightPerConn > 0 && n > s.MaxInFlightPerConn {
+			inFlight.dec()
+			s.Stats.incRejectedRequests()
+			m.Request = nil
+			m.RequestMetadata = nil
+			m.ClientAddr = ""
+			m.deadline = zeroTime
+			if m.ID == 0 {
+				// There is no way to notify the client about rejected request
+				// if it doesn't wait for the response.
+				serverMessagePool.Put(m)
+				continue
+			}
+			m.Rejected = true
+			m.Error = errTooManyRequests
+			select {
+			case responsesChan <- m:
+			case <-stopChan:
+				return
+			}
+			continue
+		}
+
+		if m.ID != 0 && !m.deadline.IsZero() && !time.Now().Before(m.deadline) {
+			// The client isn't waiting for the response anymore, so there is
+			// no need in occupying a worker for the request.
+			s.Stats.incExpiredRequests()
+			m.Request = nil
+			m.RequestMetadata = nil
+			m.ClientAddr = ""
+			m.deadline = zeroTime
+			m.Timeout = true
+			m.Error = errExpiredRequest
+			select {
+			case responsesChan <- m:
+			case <-stopChan:
+				return
+			}
+			inFlight.dec()
+			continue
+		}
+
+		// Do not bother with request contexts if the handler cannot see them.
+		if s.HandlerCtx != nil || len(s.interceptors) > 0 {
+			if m.ID == 0 {
+				m.ctx = connCtx
+			} else if !m.deadline.IsZero() {
+				m.ctx, m.cancel = context.WithDeadline(connCtx, m.deadline)
+			} else {
+				m.ctx, m.cancel = context.WithCancel(connCtx)
+			}
+		}
+
+		if m.ID != 0 {
+			pendingRequestsLock.Lock()
+			pendingRequests[m.ID] = m
+			pendingRequestsLock.Unlock()
+		}
 
 		select {
 		case workersCh <- struct{}{}:
@@ -357,15 +955,34 @@ func serverReader(s *Server, r io.Reader, clientAddr string, responsesChan chan<
 				return
 			}
 		}
-		go serveRequest(s, responsesChan, stopChan, m, workersCh)
+		go serveRequest(s, responsesChan, pendingRequests, pendingRequestsLock, inFlight, stopChan, m, workersCh)
 	}
 }
 
-func serveRequest(s *Server, responsesChan chan<- *serverMessage, stopChan <-chan struct{}, m *serverMessage, workersCh <-chan struct{}) {
+const (
+	errExpiredRequest  = "gorpc.Server: the request deadline exceeded before processing it"
+	errServerShutdown  = "gorpc.Server: the server is shutting down"
+	errHandlerTimeout  = "gorpc.Server: the handler didn't return response during the handler timeout"
+	errTooManyRequests = "gorpc.Server: too many concurrent requests on the connection. Try increasing Server.MaxInFlightPerConn"
+	errNoBytesHandler  = "gorpc.Server: cannot process raw request, since Server.BytesHandler isn't set"
+)
+
+func serveRequest(s *Server, responsesChan chan<- *serverMessage, pendingRequests map[uint64]*serverMessage, pendingRequestsLock *sync.Mutex,
+	inFlight *inFlightRequests, stopChan <-chan struct{}, m *serverMessage, workersCh <-chan struct{}) {
+
 	request := m.Request
 	m.Request = nil
+	requestMetadata := m.RequestMetadata
+	m.RequestMetadata = nil
 	clientAddr := m.ClientAddr
 	m.ClientAddr = ""
+	ctx := m.ctx
+	m.ctx = nil
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	deadline := m.deadline
+	m.deadline = zeroTime
 	skipResponse := (m.ID == 0)
 
 	if skipResponse {
@@ -375,13 +992,93 @@ func serveRequest(s *Server, responsesChan chan<- *serverMessage, stopChan <-cha
 		serverMessagePool.Put(m)
 	}
 
-	t := time.Now()
-	response, err := callHandlerWithRecover(s.LogError, s.Handler, clientAddr, s.Addr, request)
-	s.Stats.incRPCTime(uint64(time.Since(t).Seconds() * 1000))
+	canceled := false
+	if !skipResponse {
+		pendingRequestsLock.Lock()
+		canceled = m.Canceled
+		pendingRequestsLock.Unlock()
+	}
+
+	// The request could expire while waiting for a free worker.
+	expired := !deadline.IsZero() && !time.Now().Before(deadline)
+	if expired {
+		s.Stats.incExpiredRequests()
+	}
+
+	var response interface{}
+	var err string
+	var responseMetadata Metadata
+	var ht *handlerTimeout
+	timedOut := false
+	rawRequest, isRawRequest := request.(*rawMessage)
+	if expired {
+		err = errExpiredRequest
+	} else if isRawRequest {
+		if !canceled {
+			t := time.Now()
+			response, err = callBytesHandler(s, clientAddr, rawRequest)
+			s.Stats.incRPCTime(uint64(time.Since(t).Seconds() * 1000))
+		}
+	} else if !canceled {
+		var smd *serverMetadata
+		if s.HandlerCtx != nil || len(s.interceptors) > 0 {
+			smd = &serverMetadata{
+				request: requestMetadata,
+			}
+			ctx = context.WithValue(ctx, serverMetadataKey{}, smd)
+		}
+
+		if s.HandlerTimeout > 0 || s.HandlerCtx != nil {
+			// Handlers obtained via Dispatcher.NewHandlerFuncCtx may
+			// override the timeout or abandon the function themselves.
+			ht = &handlerTimeout{}
+			if s.HandlerTimeout > 0 {
+				ht.timeoutCh = make(chan time.Duration, 1)
+			}
+			ctx = context.WithValue(ctx, handlerTimeoutKey{}, ht)
+		}
+
+		t := time.Now()
+		if s.HandlerTimeout > 0 {
+			response, err = callHandlerWithTimeout(s, ctx, ht, clientAddr, request)
+		} else {
+			response, err = callHandler(s, ctx, clientAddr, request)
+		}
+		s.Stats.incRPCTime(uint64(time.Since(t).Seconds() * 1000))
+
+		if ht != nil && ht.abandonedChan != nil {
+			if s.HandlerTimeout <= 0 {
+				// The function has been abandoned by Dispatcher.
+				s.Stats.incHandlerTimeouts()
+				s.LogError("gorpc.Server: [%s]->[%s]. The handler didn't return response during the timeout set via Dispatcher.SetHandlerTimeout", clientAddr, s.Addr)
+			}
+			response, err, timedOut = nil, errHandlerTimeout, true
+		}
+
+		if smd != nil {
+			responseMetadata = smd.getResponse()
+		}
+	}
+	if isRawRequest {
+		releaseRawMessage(rawRequest)
+	}
 
 	if !skipResponse {
+		pendingRequestsLock.Lock()
+		delete(pendingRequests, m.ID)
+		m.Canceled = canceled && !expired
+		m.Timeout = expired || timedOut
+		cancel := m.cancel
+		m.cancel = nil
+		pendingRequestsLock.Unlock()
+
+		if cancel != nil {
+			cancel()
+		}
+
 		m.Response = response
 		m.Error = err
+		m.ResponseMetadata = responseMetadata
 
 		// Select hack for better performance.
 		// See https://github.com/valyala/gorpc/pull/1 for details.
@@ -395,10 +1092,119 @@ func serveRequest(s *Server, responsesChan chan<- *serverMessage, stopChan <-cha
 		}
 	}
 
+	inFlight.dec()
+
+	if timedOut {
+		// The abandoned handler may still consume resources,
+		// so don't exceed Server.Concurrency until it returns.
+		<-ht.abandonedChan
+	}
 	<-workersCh
 }
 
-func callHandlerWithRecover(logErrorFunc LoggerFunc, handler HandlerFunc, clientAddr, serverAddr string, request interface{}) (response interface{}, errStr string) {
+// handlerTimeout allows overriding Server.HandlerTimeout
+// for the handler call.
+type handlerTimeout struct {
+	// timeoutCh is nil if Server.HandlerTimeout isn't set.
+	timeoutCh chan time.Duration
+
+	// abandonedChan is closed when the abandoned handler returns.
+	abandonedChan <-chan struct{}
+}
+
+type handlerTimeoutKey struct{}
+
+// setHandlerTimeout overrides Server.HandlerTimeout for the handler call
+// with the given ctx.
+//
+// The timeout is counted from the handler call start.
+//
+// Returns false if the server doesn't limit the handler duration,
+// so the caller must apply the timeout itself.
+func setHandlerTimeout(ctx context.Context, timeout time.Duration) bool {
+	ht, ok := ctx.Value(handlerTimeoutKey{}).(*handlerTimeout)
+	if !ok || ht.timeoutCh == nil {
+		return false
+	}
+	select {
+	case ht.timeoutCh <- timeout:
+	default:
+	}
+	return true
+}
+
+// abandonHandler notifies the server the handler call with the given ctx
+// has been abandoned after the timeout set via setHandlerTimeout
+// returned false.
+//
+// The server sends timeout error to the client and holds the worker slot
+// until doneChan is closed.
+//
+// Returns false if the handler isn't called by the server.
+func abandonHandler(ctx context.Context, doneChan <-chan struct{}) bool {
+	ht, ok := ctx.Value(handlerTimeoutKey{}).(*handlerTimeout)
+	if !ok {
+		return false
+	}
+	// The handler is called synchronously if the server doesn't limit
+	// its duration, so there is no need in locking.
+	ht.abandonedChan = doneChan
+	return true
+}
+
+type handlerResult struct {
+	response interface{}
+	errStr   string
+}
+
+// callHandlerWithTimeout calls the server handler in a separate goroutine
+// and abandons it if it doesn't return response during Server.HandlerTimeout.
+//
+// The ctx passed to the abandoned handler is canceled, while
+// ht.abandonedChan is closed when the abandoned handler returns.
+func callHandlerWithTimeout(s *Server, ctx context.Context, ht *handlerTimeout, clientAddr string, request interface{}) (response interface{}, errStr string) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resultCh := make(chan handlerResult, 1)
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		var r handlerResult
+		r.response, r.errStr = callHandler(s, ctx, clientAddr, request)
+		resultCh <- r
+	}()
+
+	timeout := s.HandlerTimeout
+	startTime := time.Now()
+	t := acquireTimer(timeout)
+	defer releaseTimer(t)
+	for {
+		select {
+		case r := <-resultCh:
+			return r.response, r.errStr
+		case timeout = <-ht.timeoutCh:
+			if !t.Stop() {
+				<-t.C
+			}
+			t.Reset(time.Until(startTime.Add(timeout)))
+		case <-t.C:
+			s.Stats.incHandlerTimeouts()
+			s.LogError("gorpc.Server: [%s]->[%s]. The handler didn't return response during timeout=%s", clientAddr, s.Addr, timeout)
+			ht.abandonedChan = doneCh
+			return nil, errHandlerTimeout
+		}
+	}
+}
+
+func callHandler(s *Server, ctx context.Context, clientAddr string, request interface{}) (response interface{}, errStr string) {
+	if len(s.interceptors) > 0 {
+		return callInterceptedHandler(s, ctx, clientAddr, request)
+	}
+	return callHandlerWithRecover(s.LogError, s.handler, ctx, clientAddr, s.Addr, request)
+}
+
+func callHandlerWithRecover(logErrorFunc LoggerFunc, handler HandlerFuncCtx, ctx context.Context, clientAddr, serverAddr string, request interface{}) (response interface{}, errStr string) {
 	defer func() {
 		if x := recover(); x != nil {
 			stackTrace := make([]byte, 1<<20)
@@ -407,31 +1213,63 @@ func callHandlerWithRecover(logErrorFunc LoggerFunc, handler HandlerFunc, client
 			logErrorFunc("gorpc.Server: [%s]->[%s]. %s", clientAddr, serverAddr, errStr)
 		}
 	}()
-	response = handler(clientAddr, request)
+	response = handler(ctx, clientAddr, request)
 	return
 }
 
-func serverWriter(s *Server, w io.Writer, clientAddr string, responsesChan <-chan *serverMessage, stopChan <-chan struct{}, done chan<- struct{}, enabledCompression bool) {
+func callBytesHandler(s *Server, clientAddr string, request *rawMessage) (response interface{}, errStr string) {
+	if s.BytesHandler == nil {
+		return nil, errNoBytesHandler
+	}
+	defer func() {
+		if x := recover(); x != nil {
+			stackTrace := make([]byte, 1<<20)
+			n := runtime.Stack(stackTrace, false)
+			errStr = fmt.Sprintf("Panic occured: %v\nStack trace: %s", x, stackTrace[:n])
+			s.LogError("gorpc.Server: [%s]->[%s]. %s", clientAddr, s.Addr, errStr)
+		}
+	}()
+	rm := acquireRawMessage()
+	rm.B = s.BytesHandler(clientAddr, request.B, rm.B[:0])
+	return rm, ""
+}
+
+func serverWriter(s *Server, w io.Writer, clientAddr string, responsesChan <-chan *serverMessage, stopChan, drainChan <-chan struct{},
+	done chan<- struct{}, params *connParams) {
 	defer func() { close(done) }()
 
-	e := newMessageEncoder(w, s.SendBufferSize, enabledCompression, &s.Stats)
+	e := newMessageEncoder(w, s.SendBufferSize, params, &s.Stats)
 	defer e.Close()
 
 	var flushChan <-chan time.Time
 	t := time.NewTimer(s.FlushDelay)
 	var wr wireResponse
+	draining := false
 	for {
 		var m *serverMessage
 
 		select {
 		case m = <-responsesChan:
 		default:
+			if draining {
+				// All the pending responses are written. Flush them
+				// to the client before closing the connection.
+				if err := e.Flush(); err != nil {
+					s.LogError("gorpc.Server: [%s]->[%s]: Cannot flush responses to underlying stream: [%s]", clientAddr, s.Addr, err)
+				}
+				return
+			}
+
 			// Give the last chance for ready goroutines filling responsesChan :)
 			runtime.Gosched()
 
 			select {
 			case <-stopChan:
 				return
+			case <-drainChan:
+				draining = true
+				drainChan = nil
+				continue
 			case m = <-responsesChan:
 			case <-flushChan:
 				if err := e.Flush(); err != nil {
@@ -445,6 +1283,19 @@ func serverWriter(s *Server, w io.Writer, clientAddr string, responsesChan <-cha
 			}
 		}
 
+		if m.GoAway {
+			m.GoAway = false
+			serverMessagePool.Put(m)
+			if err := writeGoAway(e); err != nil {
+				if !isServerStop(stopChan) {
+					s.LogError("gorpc.Server: [%s]->[%s]. Cannot send GOAWAY control frame to wire: [%s]", clientAddr, s.Addr, err)
+				}
+				return
+			}
+			s.Stats.incGoAwayFrames()
+			continue
+		}
+
 		if flushChan == nil {
 			flushChan = getFlushChan(t, s.FlushDelay)
 		}
@@ -452,18 +1303,56 @@ func serverWriter(s *Server, w io.Writer, clientAddr string, responsesChan <-cha
 		wr.ID = m.ID
 		wr.Response = m.Response
 		wr.Error = m.Error
+		wr.Canceled = m.Canceled
+		wr.Timeout = m.Timeout
+		wr.ShuttingDown = m.ShuttingDown
+		wr.Rejected = m.Rejected
+		wr.Metadata = m.ResponseMetadata
 
 		m.Response = nil
+		m.ResponseMetadata = nil
 		m.Error = ""
+		m.Canceled = false
+		m.Timeout = false
+		m.ShuttingDown = false
+		m.Rejected = false
 		serverMessagePool.Put(m)
 
-		if err := e.Encode(wr); err != nil {
+		err := e.Encode(wr)
+		if fe, ok := err.(*frameSizeError); ok {
+			// Notify the client about the oversized response instead
+			// of dropping the connection.
+			s.Stats.incOversizedMessages()
+			s.LogError("gorpc.Server: [%s]->[%s]. The response size exceeds Client.MaxResponseSize=%d bytes", clientAddr, s.Addr, fe.maxSize)
+			wr.Response = nil
+			wr.Metadata = nil
+			wr.Error = fmt.Sprintf("gorpc.Server: the response size exceeds Client.MaxResponseSize=%d bytes", fe.maxSize)
+			err = e.Encode(wr)
+		}
+		if err != nil {
 			s.LogError("gorpc.Server: [%s]->[%s]. Cannot send response to wire: [%s]", clientAddr, s.Addr, err)
 			return
 		}
+		if rm, ok := wr.Response.(*rawMessage); ok {
+			releaseRawMessage(rm)
+		}
 		wr.Response = nil
 		wr.Error = ""
+		wr.Canceled = false
+		wr.Timeout = false
+		wr.ShuttingDown = false
+		wr.Rejected = false
+		wr.Metadata = nil
 
 		s.Stats.incRPCCalls()
 	}
 }
+
+// writeGoAway writes GOAWAY control frame and immediately flushes it,
+// so the client stops sending new requests as soon as possible.
+func writeGoAway(e *messageEncoder) error {
+	if err := e.Encode(wireResponse{GoAway: true}); err != nil {
+		return err
+	}
+	return e.Flush()
+}